@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// apiRetries 网络错误时的重试次数, 间隔从 apiRetryBackoff 开始翻倍
+	apiRetries      = 3
+	apiRetryBackoff = 500 * time.Millisecond
+	// breakerThreshold 连续网络错误达到该次数后熔断, 熔断期间不再请求api
+	breakerThreshold   = 5
+	breakerCooldown    = 30 * time.Second
+	breakerMaxCooldown = 5 * time.Minute
+)
+
+// ConnectError 网络错误或zabbix web服务不可用, 可通过 errors.Is(er, ConnectError) 判断
+var ConnectError = errors.New("connectError")
+
+// TransportError 请求未得到api响应
+type TransportError struct {
+	Method string
+	Err    error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("%s failed:%s", e.Method, e.Err)
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TransportError) Is(target error) bool {
+	return target == ConnectError
+}
+
+// ApiError api返回的 error 对象
+type ApiError struct {
+	Method  string `json:"-"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    string `json:"data"`
+}
+
+func (e *ApiError) Error() string {
+	return fmt.Sprintf("%s failed:%d %s %s", e.Method, e.Code, e.Message, e.Data)
+}
+
+// AuthFailed session过期或未登录, 需要重新登录.
+// 不同版本的提示不同: "Session terminated, re-login, please.", "Not authorised.", "Not authorized."
+func (e *ApiError) AuthFailed() bool {
+	data := strings.ToLower(e.Data)
+	return strings.Contains(data, "session terminated") || strings.Contains(data, "re-login") ||
+		strings.Contains(data, "not authorised") || strings.Contains(data, "not authorized")
+}
+
+// PermissionDenied 用户没有权限访问该对象, 重新登录无效
+func (e *ApiError) PermissionDenied() bool {
+	data := strings.ToLower(e.Data)
+	return strings.Contains(data, "no permissions") || strings.Contains(data, "permission denied")
+}
+
+// CircuitOpenError 熔断期间的请求直接返回该错误
+type CircuitOpenError struct {
+	Until time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("zabbix api unavailable, circuit open until %s", e.Until.Format(timeLayouts[1]))
+}
+
+// Breaker 连续网络错误时暂停请求api, 冷却时间结束后放行请求, 再次失败时冷却时间翻倍
+type Breaker struct {
+	Locker   sync.Mutex
+	Failures int
+	Cooldown time.Duration
+	Until    time.Time
+}
+
+// Allow 熔断期间返回 CircuitOpenError
+func (b *Breaker) Allow() error {
+	b.Locker.Lock()
+	defer b.Locker.Unlock()
+	if time.Now().Before(b.Until) {
+		return &CircuitOpenError{Until: b.Until}
+	}
+	return nil
+}
+
+func (b *Breaker) Success() {
+	b.Locker.Lock()
+	defer b.Locker.Unlock()
+	b.Failures = 0
+	b.Cooldown = 0
+	b.Until = time.Time{}
+}
+
+// Failure 返回 true 表示本次失败触发了熔断
+func (b *Breaker) Failure() bool {
+	b.Locker.Lock()
+	defer b.Locker.Unlock()
+	b.Failures++
+	if b.Failures < breakerThreshold {
+		return false
+	}
+	switch {
+	case b.Cooldown == 0:
+		b.Cooldown = breakerCooldown
+	case b.Cooldown < breakerMaxCooldown:
+		b.Cooldown *= 2
+		if b.Cooldown > breakerMaxCooldown {
+			b.Cooldown = breakerMaxCooldown
+		}
+	}
+	b.Until = time.Now().Add(b.Cooldown)
+	return true
+}
+
+func authFailed(er error) bool {
+	var apiError *ApiError
+	return errors.As(er, &apiError) && apiError.AuthFailed()
+}
+
+func permissionDenied(er error) bool {
+	var apiError *ApiError
+	return errors.As(er, &apiError) && apiError.PermissionDenied()
+}
+
+// requestObjects 请求参数中的主机、采集项等id, 用于记录没有权限访问的对象
+func requestObjects(params interface{}) string {
+	p, _ := params.(map[string]interface{})
+	var objects []string
+	for _, field := range []string{"hostids", "itemids", "triggerids", "groupids"} {
+		if ids, ok := p[field]; ok {
+			objects = append(objects, fmt.Sprintf("%s=%v", field, ids))
+		}
+	}
+	if len(objects) == 0 {
+		return "unknown objects"
+	}
+	return strings.Join(objects, " ")
+}
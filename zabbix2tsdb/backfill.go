@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type BackfillConfig struct {
+	From string
+	To   string
+	// TrendsBefore 早于该时间的数据使用 trends.get, 输出 min/avg/max
+	TrendsBefore string
+	// Window 每次查询的时间窗口, 单位秒
+	Window     int64
+	ItemBatch  int
+	Checkpoint string
+}
+
+// Checkpoint 记录已完成的时间窗口, 重启后从 Next 继续
+type Checkpoint struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+	Next int64 `json:"next"`
+}
+
+var timeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"}
+
+// parseTime 支持unix时间戳以及 timeLayouts 中的格式
+func parseTime(s string) (int64, error) {
+	if ts, er := strconv.ParseInt(s, 10, 64); er == nil {
+		return ts, nil
+	}
+	for _, layout := range timeLayouts {
+		if t, er := time.ParseInLocation(layout, s, time.Local); er == nil {
+			return t.Unix(), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time:%s", s)
+}
+
+func loadCheckpoint(path string, from, to int64) int64 {
+	data, er := ioutil.ReadFile(path)
+	if er != nil {
+		return from
+	}
+	var cp Checkpoint
+	if er := json.Unmarshal(data, &cp); er != nil || cp.From != from || cp.To != to {
+		_, _ = fmt.Fprintf(os.Stderr, "ignore checkpoint %s, start from beginning\n", path)
+		return from
+	}
+	return cp.Next
+}
+
+func saveCheckpoint(path string, cp Checkpoint) error {
+	return writeJSONFile(path, cp)
+}
+
+// writeJSONFile 先写入临时文件再重命名, 避免中断时文件不完整
+func writeJSONFile(path string, v interface{}) error {
+	data, _ := json.Marshal(v)
+	tmp := path + ".tmp"
+	if er := ioutil.WriteFile(tmp, data, 0644); er != nil {
+		return er
+	}
+	return os.Rename(tmp, path)
+}
+
+// ItemList 获取主机下需要同步的采集项, itemid -> item
+func (z *ZabbixApi) ItemList(hostIds []string) (map[string]map[string]interface{}, error) {
+	items := map[string]map[string]interface{}{}
+	for start := 0; start < len(hostIds); start += hostQueryBatch {
+		end := start + hostQueryBatch
+		if end > len(hostIds) {
+			end = len(hostIds)
+		}
+		params := map[string]interface{}{
+			"output":                 []string{"itemid", "key_", "hostid", "value_type"},
+			"hostids":                hostIds[start:end],
+			"search":                 map[string]interface{}{"key_": z.Cluster.Config.AccetpKeys},
+			"searchWildcardsEnabled": true,
+			"searchByAny":            true,
+		}
+		z.Cluster.ItemLabelConfig.ItemParams(*z.Version, params)
+		z.Cluster.lldParams(params)
+		z.Cluster.metadataParams(*z.Version, params)
+		result, er := z.request(context.Background(), "item.get", params)
+		if er != nil {
+			return nil, er
+		}
+		list, _ := result.([]interface{})
+		z.loadPrototypes(context.Background(), list)
+		z.loadValueMaps(context.Background(), list)
+		for _, v := range list {
+			item := v.(map[string]interface{})
+			items[item["itemid"].(string)] = item
+		}
+	}
+	return items, nil
+}
+
+// backfillWindow 按 itemid 分批查询 [from, till] 内的历史数据并输出
+func (z *ZabbixApi) backfillWindow(items map[string]map[string]interface{}, from, till int64, trends bool) error {
+	// history.get 一次只能查询一种 value_type, trends.get 不区分. 日志类型没有trends, 配置了事件输出时同步全部日志
+	itemIdsByType := map[string][]string{}
+	for itemId, item := range items {
+		valueType := item["value_type"].(string)
+		logs := valueType == valueTypeLog && !trends && sinks.HasEvents()
+		if !numericItem(item) && !logs {
+			continue
+		}
+		if trends {
+			valueType = ""
+		}
+		itemIdsByType[valueType] = append(itemIdsByType[valueType], itemId)
+	}
+	for valueType, itemIds := range itemIdsByType {
+		sort.Strings(itemIds)
+		batch := zabbixConfig.Backfill.ItemBatch
+		for start := 0; start < len(itemIds); start += batch {
+			end := start + batch
+			if end > len(itemIds) {
+				end = len(itemIds)
+			}
+			method := "history.get"
+			params := map[string]interface{}{
+				"output":    "extend",
+				"itemids":   itemIds[start:end],
+				"time_from": from,
+				"time_till": till,
+				"sortfield": "clock",
+				"sortorder": "ASC",
+			}
+			if trends {
+				method = "trends.get"
+				params["output"] = []string{"itemid", "clock", "value_min", "value_avg", "value_max"}
+				delete(params, "sortfield")
+				delete(params, "sortorder")
+			} else {
+				params["history"] = valueType
+			}
+			result, er := z.request(context.Background(), method, params)
+			if er != nil {
+				return er
+			}
+			records, _ := result.([]interface{})
+			for _, v := range records {
+				record := v.(map[string]interface{})
+				item, ok := items[fmt.Sprint(record["itemid"])]
+				if !ok {
+					continue
+				}
+				// 与实时采集一致, 保留名称, 单位, 值映射等item信息, 只替换历史数据的字段
+				data := make(map[string]interface{}, len(item)+4)
+				for k, v := range item {
+					data[k] = v
+				}
+				data["lastclock"] = record["clock"]
+				if trends {
+					data["value_min"] = record["value_min"]
+					data["value_avg"] = record["value_avg"]
+					data["value_max"] = record["value_max"]
+				} else {
+					data["lastvalue"] = record["value"]
+					for _, field := range []string{"ns", "source", "severity", "logeventid"} {
+						if v, ok := record[field]; ok {
+							data[field] = v
+						}
+					}
+				}
+				// 丢弃的数据无法再补充, 缓存已满时等待
+				if er := z.Cluster.processMetric(data, true); er != nil {
+					_, _ = fmt.Fprintln(os.Stderr, er.Error())
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Backfill 一次性同步 [From, To) 的历史数据, 按时间窗口推进并记录 checkpoint
+func (cluster *Cluster) Backfill(checkpoint string) error {
+	c := zabbixConfig.Backfill
+	if c.From == "" || c.To == "" {
+		return fmt.Errorf("--from and --to are required")
+	}
+	from, er := parseTime(c.From)
+	if er != nil {
+		return er
+	}
+	to, er := parseTime(c.To)
+	if er != nil {
+		return er
+	}
+	var trendsBefore int64
+	if c.TrendsBefore != "" {
+		if trendsBefore, er = parseTime(c.TrendsBefore); er != nil {
+			return er
+		}
+	}
+	// 登录或主机查询失败, 以及没有需要同步的主机或采集项时不推进进度
+	cluster.updateGroupAndHost()
+	cluster.Hosts.Locker.RLock()
+	hostIds := append([]string{}, cluster.Hosts.Ids...)
+	loaded := cluster.Hosts.Loaded
+	cluster.Hosts.Locker.RUnlock()
+	if !loaded {
+		return fmt.Errorf("query hosts failed")
+	}
+	if len(hostIds) == 0 {
+		return fmt.Errorf("no hosts matched")
+	}
+	items, er := cluster.Api.ItemList(hostIds)
+	if er != nil {
+		return er
+	}
+	if len(items) == 0 {
+		return fmt.Errorf("no items matched")
+	}
+	start := loadCheckpoint(checkpoint, from, to)
+	for start < to {
+		end := start + c.Window
+		if end > to {
+			end = to
+		}
+		trends := start < trendsBefore
+		if trends && end > trendsBefore {
+			end = trendsBefore
+		}
+		// session过期及网络错误已在 request 中重试
+		if er := cluster.Api.backfillWindow(items, start, end-1, trends); er != nil {
+			return er
+		}
+		// 数据全部写出后才保存进度, 写入失败的窗口重新执行时再次查询
+		if er := sinks.Flush(true); er != nil {
+			return er
+		}
+		if er := saveCheckpoint(checkpoint, Checkpoint{From: from, To: to, Next: end}); er != nil {
+			return er
+		}
+		_, _ = fmt.Fprintf(os.Stderr, "backfill %s - %s done\n",
+			time.Unix(start, 0).Format(timeLayouts[1]), time.Unix(end, 0).Format(timeLayouts[1]))
+		start = end
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeZabbix 按 method 返回固定的 result, 没有配置的 method 返回空列表
+func fakeZabbix(t *testing.T, results map[string]interface{}) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string `json:"method"`
+		}
+		if er := json.NewDecoder(r.Body).Decode(&req); er != nil {
+			t.Errorf("decode request failed:%s", er)
+		}
+		result, ok := results[req.Method]
+		if !ok {
+			result = []interface{}{}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "result": result, "id": 1})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// recordWriter 记录写入的数据, 每次写入等待 delay, Flush 返回 flushErr
+type recordWriter struct {
+	locker   sync.Mutex
+	samples  []Sample
+	delay    time.Duration
+	flushErr error
+}
+
+func (r *recordWriter) Write(_, _ string, samples []Sample) error {
+	time.Sleep(r.delay)
+	r.locker.Lock()
+	r.samples = append(r.samples, samples...)
+	r.locker.Unlock()
+	return nil
+}
+
+func (r *recordWriter) Flush() error {
+	return r.flushErr
+}
+
+func backfillCluster(t *testing.T, hosts []interface{}) *Cluster {
+	records := make([]interface{}, 0, 20)
+	for i := 0; i < 20; i++ {
+		records = append(records, map[string]interface{}{
+			"itemid": "23000", "clock": fmt.Sprint(1690891200 + i*60), "value": fmt.Sprint(i), "ns": "0",
+		})
+	}
+	server := fakeZabbix(t, map[string]interface{}{
+		"apiinfo.version": "6.0.0",
+		"user.login":      "session",
+		"hostgroup.get":   []interface{}{map[string]interface{}{"groupid": "2", "name": "Linux servers"}},
+		"host.get":        hosts,
+		"item.get": []interface{}{map[string]interface{}{
+			"itemid": "23000", "key_": "system.cpu.load[all,avg1]", "hostid": "10084", "value_type": "0",
+		}},
+		"history.get": records,
+	})
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: server.URL, Groups: []string{"Linux servers"}})
+	if er != nil {
+		t.Fatal(er)
+	}
+	if er := c.Api.Login(); er != nil {
+		t.Fatal(er)
+	}
+	return c
+}
+
+// TestBackfillFullSink 输出缓存已满时等待写入, 数据全部写出后才保存进度; 写入失败时不保存进度
+func TestBackfillFullSink(t *testing.T) {
+	hosts := []interface{}{map[string]interface{}{"hostid": "10084", "host": "web_01"}}
+	defer func(s Sinks) { sinks = s }(sinks)
+	slow := &recordWriter{delay: time.Millisecond}
+	sinks = Sinks{NewSink("slow", slow, 1)}
+	c := backfillCluster(t, hosts)
+	defer func(c BackfillConfig) { zabbixConfig.Backfill = c }(zabbixConfig.Backfill)
+	zabbixConfig.Backfill = BackfillConfig{From: "1690891200", To: "1690894800", Window: 3600, ItemBatch: 100}
+	checkpoint := filepath.Join(t.TempDir(), "backfill.checkpoint")
+	if er := c.Backfill(checkpoint); er != nil {
+		t.Fatal(er)
+	}
+	if len(slow.samples) != 20 {
+		t.Errorf("got %d samples, want 20", len(slow.samples))
+	}
+	if next := loadCheckpoint(checkpoint, 1690891200, 1690894800); next != 1690894800 {
+		t.Errorf("checkpoint next %d, want 1690894800", next)
+	}
+
+	failed := &recordWriter{flushErr: fmt.Errorf("dropped 20 samples")}
+	sinks = Sinks{NewSink("failed", failed, 1)}
+	checkpoint = filepath.Join(t.TempDir(), "backfill.checkpoint")
+	if er := c.Backfill(checkpoint); er == nil {
+		t.Error("backfill should fail when the sink drops samples")
+	}
+	if _, er := os.Stat(checkpoint); !os.IsNotExist(er) {
+		t.Errorf("checkpoint should not be saved, stat: %v", er)
+	}
+}
+
+// TestBackfillNoHosts 没有匹配的主机时返回错误, 不保存进度
+func TestBackfillNoHosts(t *testing.T) {
+	defer func(s Sinks) { sinks = s }(sinks)
+	w := &recordWriter{}
+	sinks = Sinks{NewSink("record", w, 0)}
+	c := backfillCluster(t, []interface{}{})
+	defer func(c BackfillConfig) { zabbixConfig.Backfill = c }(zabbixConfig.Backfill)
+	zabbixConfig.Backfill = BackfillConfig{From: "1690891200", To: "1690894800", Window: 3600, ItemBatch: 100}
+	checkpoint := filepath.Join(t.TempDir(), "backfill.checkpoint")
+	if er := c.Backfill(checkpoint); er == nil {
+		t.Fatal("backfill should fail without hosts")
+	}
+	if _, er := os.Stat(checkpoint); !os.IsNotExist(er) {
+		t.Errorf("checkpoint should not be saved, stat: %v", er)
+	}
+}
+
+// TestBackfillMetadata 补充的数据与实时采集一致, 使用item的单位, 名称及值映射
+func TestBackfillMetadata(t *testing.T) {
+	defer func(s Sinks) { sinks = s }(sinks)
+	store := NewMetricStore()
+	sinks = Sinks{NewSink("exporter", store, 0)}
+	server := fakeZabbix(t, map[string]interface{}{
+		"apiinfo.version": "6.0.0",
+		"user.login":      "session",
+		"hostgroup.get":   []interface{}{map[string]interface{}{"groupid": "2", "name": "Linux servers"}},
+		"host.get":        []interface{}{map[string]interface{}{"hostid": "10084", "host": "web01"}},
+		"item.get": []interface{}{
+			map[string]interface{}{
+				"itemid": "23000", "key_": "system.cpu.util[0]", "hostid": "10084", "value_type": "0",
+				"name": "CPU utilization", "units": "%", "description": "",
+			},
+			map[string]interface{}{
+				"itemid": "23001", "key_": "net.if.status[eth0]", "hostid": "10084", "value_type": "3",
+				"name": "Operational status", "units": "", "description": "",
+				"valuemap": map[string]interface{}{"mappings": []interface{}{
+					map[string]interface{}{"type": "0", "value": "1", "newvalue": "up"},
+				}},
+			},
+		},
+		"history.get": []interface{}{
+			map[string]interface{}{"itemid": "23000", "clock": "1690891200", "value": "50", "ns": "0"},
+			map[string]interface{}{"itemid": "23001", "clock": "1690891200", "value": "1", "ns": "0"},
+		},
+	})
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: server.URL, Groups: []string{"Linux servers"}, Metadata: true, ValueMapLabels: true})
+	if er != nil {
+		t.Fatal(er)
+	}
+	if er := c.Api.Login(); er != nil {
+		t.Fatal(er)
+	}
+	defer func(c BackfillConfig) { zabbixConfig.Backfill = c }(zabbixConfig.Backfill)
+	zabbixConfig.Backfill = BackfillConfig{From: "1690891200", To: "1690894800", Window: 3600, ItemBatch: 100}
+	if er := c.Backfill(filepath.Join(t.TempDir(), "backfill.checkpoint")); er != nil {
+		t.Fatal(er)
+	}
+	got := storeSeries(store, "0", "10084")
+	want := []string{
+		`net_if_status{c="0",__endpoint__="web01",p="eth0",state="up"} 1`,
+		`system_cpu_util_ratio{c="0",__endpoint__="web01",p="0"} 0.5`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	want := time.Date(2023, 8, 1, 12, 0, 0, 0, time.Local).Unix()
+	for _, s := range []string{fmt.Sprint(want), "2023-08-01 12:00:00", time.Unix(want, 0).Format(time.RFC3339)} {
+		if got, er := parseTime(s); er != nil || got != want {
+			t.Errorf("parseTime(%s) = %d, %v, want %d", s, got, er, want)
+		}
+	}
+	if _, er := parseTime("yesterday"); er == nil {
+		t.Error("invalid time should fail")
+	}
+}
+
+// TestCheckpoint --from/--to 与checkpoint不一致时从头开始
+func TestCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backfill.checkpoint")
+	if next := loadCheckpoint(path, 100, 200); next != 100 {
+		t.Errorf("got %d without checkpoint, want 100", next)
+	}
+	if er := saveCheckpoint(path, Checkpoint{From: 100, To: 200, Next: 150}); er != nil {
+		t.Fatal(er)
+	}
+	if next := loadCheckpoint(path, 100, 200); next != 150 {
+		t.Errorf("got %d, want 150", next)
+	}
+	if next := loadCheckpoint(path, 100, 300); next != 100 {
+		t.Errorf("got %d for another range, want 100", next)
+	}
+}
+
+// TestBackfillWindow history.get 的数据按 lastvalue 输出, trends.get 的数据输出 min/avg/max
+func TestBackfillWindow(t *testing.T) {
+	server := fakeZabbix(t, map[string]interface{}{
+		"history.get": []interface{}{
+			map[string]interface{}{"itemid": "23000", "clock": "1690891200", "value": "1.5", "ns": "0"},
+			map[string]interface{}{"itemid": "23000", "clock": "1690891260", "value": "2.5", "ns": "0"},
+		},
+		"trends.get": []interface{}{
+			map[string]interface{}{"itemid": "23000", "clock": "1690887600", "value_min": "1", "value_avg": "2", "value_max": "3"},
+		},
+	})
+	defer func(c Config, s Sinks) { zabbixConfig, sinks = c, s }(zabbixConfig, sinks)
+	zabbixConfig.Backfill.ItemBatch = 100
+	store := NewMetricStore()
+	sinks = Sinks{NewSink("exporter", store, 0)}
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: server.URL})
+	if er != nil {
+		t.Fatal(er)
+	}
+	c.HostIdHost.Store("10084", "web01")
+	items := map[string]map[string]interface{}{
+		"23000": {"itemid": "23000", "key_": "system.cpu.load[all,avg1]", "hostid": "10084", "value_type": "0"},
+		"23001": {"itemid": "23001", "key_": "system.sw.os", "hostid": "10084", "value_type": "4"},
+	}
+	if er := c.Api.backfillWindow(items, 1690891200, 1690894799, false); er != nil {
+		t.Fatal(er)
+	}
+	if er := c.Api.backfillWindow(items, 1690887600, 1690891199, true); er != nil {
+		t.Fatal(er)
+	}
+	var got []string
+	for _, s := range store.Clusters["0"]["10084"] {
+		got = append(got, fmt.Sprintf("%s=%s@%d", s.Name, formatValue(s.Value), s.Timestamp/1e3))
+	}
+	sort.Strings(got)
+	want := []string{
+		"system_cpu_load=2.5@1690891260",
+		"system_cpu_load_avg=2@1690887600",
+		"system_cpu_load_max=3@1690887600",
+		"system_cpu_load_min=1@1690887600",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ClusterConfig 单个zabbix集群的配置, 未通过 --config 配置多个集群时由命令行参数生成
+type ClusterConfig struct {
+	Cluster          string   `yaml:"cluster"`
+	Address          string   `yaml:"address"`
+	User             string   `yaml:"user"`
+	Password         string   `yaml:"password"`
+	Token            string   `yaml:"token"`
+	ApiVersion       string   `yaml:"apiVersion"`
+	Groups           []string `yaml:"groups"`
+	ExcludeGroups    []string `yaml:"excludeGroups"`
+	Hosts            []string `yaml:"hosts"`
+	ExcludeHosts     []string `yaml:"excludeHosts"`
+	Templates        []string `yaml:"templates"`
+	HostTags         []string `yaml:"hostTags"`
+	AccetpKeys       []string `yaml:"acceptKeys"`
+	Interval         int64    `yaml:"interval"`
+	StaleIntervals   int      `yaml:"staleIntervals"`
+	Problems         bool     `yaml:"problems"`
+	HostStatus       bool     `yaml:"hostStatus"`
+	LldLabels        bool     `yaml:"lldLabels"`
+	TrapperOnly      bool     `yaml:"trapperOnly"`
+	ExportDir        string   `yaml:"exportDir"`
+	ExportCheckpoint string   `yaml:"exportCheckpoint"`
+	InfoKeys         []string `yaml:"infoKeys"`
+	InfoMaxLength    int      `yaml:"infoMaxLength"`
+	Metadata         bool     `yaml:"metadata"`
+	CounterKeys      []string `yaml:"counterKeys"`
+	ValueMapLabels   bool     `yaml:"valueMapLabels"`
+	RawHostNames     bool     `yaml:"rawHostNames"`
+	Concurrency      int      `yaml:"concurrency"`
+	ItemLimit        int      `yaml:"itemLimit"`
+	HostLabels       []string `yaml:"hostLabels"`
+	HostLabelPrefix  string   `yaml:"hostLabelPrefix"`
+	ItemLabels       []string `yaml:"itemLabels"`
+	ItemLabelPrefix  string   `yaml:"itemLabelPrefix"`
+}
+
+// Cluster 一个zabbix集群的配置及运行时状态, 各集群之间互不影响
+type Cluster struct {
+	Config ClusterConfig
+	Api    *ZabbixApi
+	// HostIdHost 通过item.get获取到hostId之后，需要查找对应的host
+	HostIdHost sync.Map
+	// HostIdLabels hostId -> []Label, 已转换为合法的label
+	HostIdLabels sync.Map
+	Hosts        Host
+	GroupNameId  sync.Map
+	// ItemStates itemid -> *itemState
+	ItemStates sync.Map
+	// HostAvailable hostId -> 上次输出的 zabbix_host_available 序列
+	HostAvailable sync.Map
+	// ActiveProblems series -> 上次输出的未恢复问题
+	ActiveProblems map[string]activeProblem
+
+	HostLabelConfig HostLabelConfig
+	ItemLabelConfig ItemLabelConfig
+	HostFilter      HostFilter
+	// AcceptKeys 由 --acceptKeys 编译, 用于过滤 trapper 接收的数据, item.get 由zabbix过滤
+	AcceptKeys []*regexp.Regexp
+	// InfoKeys 由 --infoKeys 编译, 匹配的字符及文本类型item输出为 _info 序列
+	InfoKeys []*regexp.Regexp
+	// CounterKeys 由 --counterKeys 编译, 开启 --metadata 时匹配的item为counter
+	CounterKeys []*regexp.Regexp
+	// ValueMaps 5.4 之前的全局值映射 valuemapid -> value -> newvalue
+	ValueMaps sync.Map
+	// Prototypes 自动发现原型的itemid -> 各参数位置的宏名称
+	Prototypes sync.Map
+	// ActiveChecks hostId -> activeChecks, agent 主动模式需要采集的item
+	ActiveChecks sync.Map
+	// ExportItems 实时导出数据的 itemid -> item.get 的结果, 不需要输出的为nil
+	ExportItems sync.Map
+	// FilterLogs 上次输出的匹配结果
+	FilterLogs sync.Map
+}
+
+// clusters 所有需要同步的zabbix集群
+var clusters []*Cluster
+
+func NewCluster(config ClusterConfig) (*Cluster, error) {
+	config.Cluster = ReplParamsPattern.ReplaceAllString(config.Cluster, "_")
+	if !strings.HasSuffix(config.Address, ApiSuffix) {
+		config.Address = fmt.Sprintf("%s/%s", strings.TrimSuffix(config.Address, "/"), ApiSuffix)
+	}
+	if config.Interval < 30 {
+		config.Interval = 30
+	}
+	if config.Concurrency < 1 {
+		config.Concurrency = 1
+	}
+	filter, er := parseHostFilter(config)
+	if er != nil {
+		return nil, fmt.Errorf("cluster %s:%s", config.Cluster, er)
+	}
+	infoKeys, er := compilePatterns(config.InfoKeys)
+	if er != nil {
+		return nil, fmt.Errorf("cluster %s:%s", config.Cluster, er)
+	}
+	acceptKeys, er := compilePatterns(config.AccetpKeys)
+	if er != nil {
+		return nil, fmt.Errorf("cluster %s:%s", config.Cluster, er)
+	}
+	counterKeys, er := compilePatterns(config.CounterKeys)
+	if er != nil {
+		return nil, fmt.Errorf("cluster %s:%s", config.Cluster, er)
+	}
+	c := &Cluster{
+		Config:          config,
+		HostLabelConfig: parseHostLabels(config.HostLabels, config.HostLabelPrefix),
+		ItemLabelConfig: parseItemLabels(config.ItemLabels, config.ItemLabelPrefix),
+		HostFilter:      filter,
+		AcceptKeys:      acceptKeys,
+		InfoKeys:        infoKeys,
+		CounterKeys:     counterKeys,
+	}
+	c.Api = NewZabbixClient(c)
+	return c, nil
+}
+
+// envPattern 配置文件中只替换 ${ENV}, 密码及正则中的 $ 保持原样
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+func expandEnv(s string) string {
+	return envPattern.ReplaceAllStringFunc(s, func(v string) string {
+		return os.Getenv(v[2 : len(v)-1])
+	})
+}
+
+// expandNodeEnv 解析yaml后再替换标量中的 ${ENV}, 环境变量中的 #, ": " 及换行不会改变配置结构.
+// 未加引号的值替换后重新推断类型, 如 interval: ${INTERVAL}
+func expandNodeEnv(node *yaml.Node) {
+	if node.Kind == yaml.ScalarNode {
+		value := expandEnv(node.Value)
+		if value != node.Value {
+			node.Value = value
+			if node.Style == 0 {
+				node.Tag = ""
+			}
+		}
+	}
+	for _, child := range node.Content {
+		expandNodeEnv(child)
+	}
+}
+
+// loadConfigFile 读取 --config 中的集群及输出配置, 集群未配置的字段使用命令行参数的值,
+// 没有 clusters 时只同步命令行参数指定的集群. 配置文件中可以使用 ${ENV} 引用环境变量, 如密码
+func loadConfigFile(file string, base ClusterConfig) ([]ClusterConfig, []SinkConfig, error) {
+	data, er := ioutil.ReadFile(file)
+	if er != nil {
+		return nil, nil, er
+	}
+	var document yaml.Node
+	if er := yaml.Unmarshal(data, &document); er != nil {
+		return nil, nil, fmt.Errorf("parse %s failed:%s", file, er)
+	}
+	expandNodeEnv(&document)
+	var root struct {
+		Clusters []yaml.Node  `yaml:"clusters"`
+		Sinks    []SinkConfig `yaml:"sinks"`
+	}
+	if er := document.Decode(&root); er != nil {
+		return nil, nil, fmt.Errorf("parse %s failed:%s", file, er)
+	}
+	if len(root.Clusters) == 0 && len(root.Sinks) == 0 {
+		return nil, nil, fmt.Errorf("no clusters or sinks in %s", file)
+	}
+	if len(root.Clusters) == 0 {
+		return []ClusterConfig{base}, root.Sinks, nil
+	}
+	var configs []ClusterConfig
+	names := map[string]struct{}{}
+	for i, node := range root.Clusters {
+		config := base
+		if er := node.Decode(&config); er != nil {
+			return nil, nil, fmt.Errorf("parse cluster %d failed:%s", i, er)
+		}
+		if config.Address == "" {
+			return nil, nil, fmt.Errorf("cluster %s: address 不能为空", config.Cluster)
+		}
+		// 集群名称作为 c label, 重复会导致数据混乱
+		name := ReplParamsPattern.ReplaceAllString(config.Cluster, "_")
+		if _, ok := names[name]; ok {
+			return nil, nil, fmt.Errorf("duplicate cluster name:%s", config.Cluster)
+		}
+		names[name] = struct{}{}
+		configs = append(configs, config)
+	}
+	return configs, root.Sinks, nil
+}
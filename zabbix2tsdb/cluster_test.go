@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// TestLoadConfigFile 未配置的字段使用命令行参数的值, 集群名称不能重复
+func TestLoadConfigFile(t *testing.T) {
+	t.Setenv("Z2T_TOKEN", "secret")
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if er := ioutil.WriteFile(path, []byte(data), 0644); er != nil {
+			t.Fatal(er)
+		}
+		return path
+	}
+	base := ClusterConfig{User: "Admin", Interval: 60, Groups: []string{"Linux servers"}}
+	configs, _, er := loadConfigFile(write("config.yaml", `clusters:
+  - cluster: prod
+    address: http://10.0.0.1
+    token: ${Z2T_TOKEN}
+  - cluster: test
+    address: http://10.0.0.2
+    interval: 120
+    groups: [Web]
+`), base)
+	if er != nil {
+		t.Fatal(er)
+	}
+	if len(configs) != 2 {
+		t.Fatalf("got %d clusters, want 2", len(configs))
+	}
+	if c := configs[0]; c.Token != "secret" || c.User != "Admin" || c.Interval != 60 || c.Groups[0] != "Linux servers" {
+		t.Errorf("prod config %+v", c)
+	}
+	if c := configs[1]; c.Interval != 120 || len(c.Groups) != 1 || c.Groups[0] != "Web" {
+		t.Errorf("test config %+v", c)
+	}
+
+	// 只配置输出时同步命令行参数指定的集群
+	configs, sinkConfigs, er := loadConfigFile(write("sinks.yaml", `sinks:
+  - type: stdout
+    format: prometheus
+`), base)
+	if er != nil {
+		t.Fatal(er)
+	}
+	if len(configs) != 1 || configs[0].User != "Admin" || len(sinkConfigs) != 1 || sinkConfigs[0].Format != "prometheus" {
+		t.Errorf("got clusters %+v, sinks %+v", configs, sinkConfigs)
+	}
+
+	for name, data := range map[string]string{
+		"empty.yaml":     "clusters: []\n",
+		"address.yaml":   "clusters:\n  - cluster: prod\n",
+		"duplicate.yaml": "clusters:\n  - cluster: prod a\n    address: http://a\n  - cluster: prod_a\n    address: http://b\n",
+	} {
+		if _, _, er := loadConfigFile(write(name, data), base); er == nil {
+			t.Errorf("%s should fail", name)
+		}
+	}
+}
+
+// TestLoadConfigFileEnv 只替换 ${ENV}, 密码及正则中的 $ 保持原样
+func TestLoadConfigFileEnv(t *testing.T) {
+	t.Setenv("Z2T_TOKEN", "secret")
+	t.Setenv("x", "unexpected")
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := `clusters:
+  - cluster: prod
+    address: http://127.0.0.1
+    token: ${Z2T_TOKEN}
+    password: pa$$w0rd$x
+    hosts: ['re:^web$x', '${UNSET_Z2T_VAR}db']
+`
+	if er := ioutil.WriteFile(path, []byte(data), 0644); er != nil {
+		t.Fatal(er)
+	}
+	configs, _, er := loadConfigFile(path, ClusterConfig{})
+	if er != nil {
+		t.Fatal(er)
+	}
+	c := configs[0]
+	if c.Token != "secret" || c.Password != "pa$$w0rd$x" {
+		t.Errorf("token %q password %q", c.Token, c.Password)
+	}
+	if len(c.Hosts) != 2 || c.Hosts[0] != "re:^web$x" || c.Hosts[1] != "db" {
+		t.Errorf("hosts %q", c.Hosts)
+	}
+}
+
+// TestLoadConfigFileEnvValues 环境变量中的 #, ": " 及换行原样作为值, 不改变配置结构
+func TestLoadConfigFileEnvValues(t *testing.T) {
+	t.Setenv("Z2T_PASSWORD", "pa#ss: word\nhosts: [evil]")
+	t.Setenv("Z2T_INTERVAL", "30")
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := `clusters:
+  - cluster: prod
+    address: http://127.0.0.1
+    password: ${Z2T_PASSWORD}
+    interval: ${Z2T_INTERVAL}
+    hosts: [web]
+`
+	if er := ioutil.WriteFile(path, []byte(data), 0644); er != nil {
+		t.Fatal(er)
+	}
+	configs, _, er := loadConfigFile(path, ClusterConfig{})
+	if er != nil {
+		t.Fatal(er)
+	}
+	c := configs[0]
+	if c.Password != "pa#ss: word\nhosts: [evil]" {
+		t.Errorf("password %q", c.Password)
+	}
+	if c.Interval != 30 {
+		t.Errorf("interval %d, want 30", c.Interval)
+	}
+	if len(c.Hosts) != 1 || c.Hosts[0] != "web" {
+		t.Errorf("hosts %q", c.Hosts)
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// exportHistoryPattern zabbix server 实时导出(ExportDir)的历史数据文件, 每个 history syncer 一个文件
+	exportHistoryPattern = "history-history-syncer-*.ndjson"
+	// exportRotatedSuffix 文件超过 ExportFileSize 后重命名为 <文件>.old, 再创建新文件
+	exportRotatedSuffix = ".old"
+	exportPollInterval  = time.Second
+	// exportReadSize 每次读取的最大字节数, 读取的数据输出后再继续. 超过该长度的行跳过
+	exportReadSize = 4 << 20
+	// exportItemBatch 每次查询的 itemid 数量
+	exportItemBatch = 500
+
+	metricExportRecords = "zabbix2tsdb_export_records_total"
+)
+
+// exportPosition 文件的读取位置, 按 inode 识别轮转
+type exportPosition struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+// exportRecord 实时导出的一条历史数据. 4.0 中 host 为主机名称, 5.0 起为 {"host","name"}
+type exportRecord struct {
+	Host   json.RawMessage `json:"host"`
+	ItemId json.Number     `json:"itemid"`
+	Clock  json.Number     `json:"clock"`
+	Ns     json.Number     `json:"ns"`
+	Value  interface{}     `json:"value"`
+	Type   json.Number     `json:"type"`
+	// Source, Severity, EventId 只有日志类型有
+	Source   string      `json:"source"`
+	Severity json.Number `json:"severity"`
+	EventId  json.Number `json:"eventid"`
+}
+
+func (r exportRecord) hostName() string {
+	var name string
+	if json.Unmarshal(r.Host, &name) == nil {
+		return name
+	}
+	var host struct {
+		Host string `json:"host"`
+	}
+	_ = json.Unmarshal(r.Host, &host)
+	return host.Host
+}
+
+// exportCheckpointPath 多个集群使用同一个checkpoint文件时加上集群名称
+func (c *Cluster) exportCheckpointPath() string {
+	if len(clusters) > 1 {
+		return fmt.Sprintf("%s.%s", c.Config.ExportCheckpoint, c.Config.Cluster)
+	}
+	return c.Config.ExportCheckpoint
+}
+
+func loadExportCheckpoint(path string) (map[string]exportPosition, bool) {
+	positions := map[string]exportPosition{}
+	data, er := ioutil.ReadFile(path)
+	if er != nil {
+		return positions, false
+	}
+	if er := json.Unmarshal(data, &positions); er != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "ignore checkpoint %s:%s\n", path, er)
+		return map[string]exportPosition{}, false
+	}
+	return positions, true
+}
+
+// tailExport 持续读取 --exportDir 中新增的历史数据, 数据全部写入输出后保存读取位置, 重启后从保存的位置继续.
+// 没有checkpoint时从文件末尾开始, 之后新建的文件从头读取
+func (c *Cluster) tailExport(ctx context.Context) {
+	checkpoint := c.exportCheckpointPath()
+	positions, restored := loadExportCheckpoint(checkpoint)
+	first := !restored
+	ticker := time.NewTicker(exportPollInterval)
+	defer ticker.Stop()
+	for {
+		// 主机列表更新前无法判断数据是否需要输出, 不读取
+		c.Hosts.Locker.RLock()
+		ready := len(c.Hosts.Ids) > 0
+		c.Hosts.Locker.RUnlock()
+		if ready {
+			var ok bool
+			// 写入失败时保留上次的读取位置, 首次读取成功前仍从文件末尾开始
+			if positions, ok = c.syncExport(ctx, checkpoint, positions, first); ok {
+				first = false
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncExport 在 positions 的副本上读取新增的数据, 全部写入输出后保存并返回新的读取位置.
+// 写入失败时返回原来的读取位置, 下次重新读取, 避免数据丢失
+func (c *Cluster) syncExport(ctx context.Context, checkpoint string, positions map[string]exportPosition, first bool) (map[string]exportPosition, bool) {
+	next := make(map[string]exportPosition, len(positions))
+	for name, pos := range positions {
+		next[name] = pos
+	}
+	if !c.readExport(ctx, next, first) {
+		return next, true
+	}
+	if er := sinks.Flush(true); er != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "cluster %s write export records failed, retry from last checkpoint:%s\n", c.Config.Cluster, er)
+		return positions, false
+	}
+	if er := writeJSONFile(checkpoint, next); er != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "cluster %s save export checkpoint failed:%s\n", c.Config.Cluster, er)
+	}
+	return next, true
+}
+
+// readExport 读取各文件新增的数据, 有数据或读取位置变化时返回 true
+func (c *Cluster) readExport(ctx context.Context, positions map[string]exportPosition, first bool) bool {
+	files, er := filepath.Glob(filepath.Join(c.Config.ExportDir, exportHistoryPattern))
+	if er != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "cluster %s list export files failed:%s\n", c.Config.Cluster, er)
+		return false
+	}
+	changed := false
+	for _, path := range files {
+		fi, er := os.Stat(path)
+		if er != nil {
+			continue
+		}
+		name, inode := filepath.Base(path), fileInode(fi)
+		pos, ok := positions[name]
+		switch {
+		case !ok && first:
+			pos = exportPosition{Inode: inode, Offset: fi.Size()}
+			changed = true
+		case ok && pos.Inode != inode:
+			// 轮转后先读完 .old 中剩余的数据, 失败时保留 .old 的读取位置, 下次重新读取
+			if old, er := os.Stat(path + exportRotatedSuffix); er == nil && fileInode(old) == pos.Inode {
+				n, er := c.readExportFile(ctx, path+exportRotatedSuffix, pos.Offset)
+				if n > 0 {
+					pos.Offset += n
+					changed = true
+				}
+				if er != nil {
+					_, _ = fmt.Fprintf(os.Stderr, "cluster %s read %s failed:%s\n", c.Config.Cluster, path+exportRotatedSuffix, er)
+					positions[name] = pos
+					continue
+				}
+			}
+			pos = exportPosition{Inode: inode}
+			changed = true
+		case fi.Size() < pos.Offset:
+			// 文件被截断或 windows 上的轮转
+			pos.Offset = 0
+			changed = true
+		}
+		pos.Inode = inode
+		n, er := c.readExportFile(ctx, path, pos.Offset)
+		if er != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "cluster %s read %s failed:%s\n", c.Config.Cluster, path, er)
+		}
+		if n > 0 {
+			pos.Offset += n
+			changed = true
+		}
+		positions[name] = pos
+	}
+	return changed
+}
+
+// readExportFile 从 offset 开始读取完整的行, 返回已处理的字节数. 查询item失败时停止, 下次从失败的位置重新读取
+func (c *Cluster) readExportFile(ctx context.Context, path string, offset int64) (int64, error) {
+	f, er := os.Open(path)
+	if er != nil {
+		return 0, er
+	}
+	defer f.Close()
+	if _, er := f.Seek(offset, io.SeekStart); er != nil {
+		return 0, er
+	}
+	var read int64
+	buf := make([]byte, exportReadSize)
+	for {
+		n, er := io.ReadFull(f, buf)
+		if er != nil && er != io.ErrUnexpectedEOF && er != io.EOF {
+			return read, er
+		}
+		end := bytes.LastIndexByte(buf[:n], '\n')
+		if end < 0 && n < len(buf) {
+			// 最后一行尚未写完
+			return read, nil
+		}
+		if end < 0 {
+			skipped, complete, er := skipLine(f)
+			if er != nil || !complete {
+				return read, er
+			}
+			_, _ = fmt.Fprintf(os.Stderr, "cluster %s skip export record of %d bytes in %s\n", c.Config.Cluster, int64(n)+skipped, path)
+			selfMetrics.Add(metricExportRecords, metricTypeCounter, 1, "cluster", c.Config.Cluster, "status", "failed")
+			read += int64(n) + skipped
+			if _, er := f.Seek(offset+read, io.SeekStart); er != nil {
+				return read, er
+			}
+			continue
+		}
+		if er := c.processExport(ctx, buf[:end+1]); er != nil {
+			return read, er
+		}
+		read += int64(end + 1)
+		if n < len(buf) {
+			return read, nil
+		}
+		if _, er := f.Seek(offset+read, io.SeekStart); er != nil {
+			return read, er
+		}
+	}
+}
+
+// skipLine 读到换行为止, 返回读取的字节数. 没有换行时 complete 为false
+func skipLine(r io.Reader) (n int64, complete bool, er error) {
+	br := bufio.NewReader(r)
+	for {
+		chunk, er := br.ReadSlice('\n')
+		n += int64(len(chunk))
+		switch er {
+		case nil:
+			return n, true, nil
+		case bufio.ErrBufferFull:
+		case io.EOF:
+			return n, false, nil
+		default:
+			return n, false, er
+		}
+	}
+}
+
+// processExport 先查询未缓存的item, 再逐条转换输出. 无法解析的行跳过
+func (c *Cluster) processExport(ctx context.Context, data []byte) error {
+	var records []exportRecord
+	var unknown []string
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var r exportRecord
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.UseNumber()
+		if er := decoder.Decode(&r); er != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "cluster %s invalid export record:%s\n", c.Config.Cluster, er)
+			selfMetrics.Add(metricExportRecords, metricTypeCounter, 1, "cluster", c.Config.Cluster, "status", "failed")
+			continue
+		}
+		if _, ok := c.ExportItems.Load(r.ItemId.String()); !ok {
+			unknown = append(unknown, r.ItemId.String())
+		}
+		records = append(records, r)
+	}
+	if er := c.Api.loadExportItems(ctx, unknown); er != nil {
+		return er
+	}
+	for _, r := range records {
+		status := "processed"
+		if ok, er := c.processExportRecord(r); er != nil {
+			_, _ = fmt.Fprintln(os.Stderr, er.Error())
+			status = "failed"
+		} else if !ok {
+			status = "skipped"
+		}
+		selfMetrics.Add(metricExportRecords, metricTypeCounter, 1, "cluster", c.Config.Cluster, "status", status)
+	}
+	return nil
+}
+
+// loadExportItems 查询 key_ 及label需要的item信息, 只查询一次. 不匹配 --acceptKeys 或已删除的item缓存为空, 不再输出
+func (z *ZabbixApi) loadExportItems(ctx context.Context, itemIds []string) error {
+	seen := map[string]struct{}{}
+	var ids []string
+	for _, id := range itemIds {
+		if _, ok := seen[id]; !ok {
+			seen[id] = struct{}{}
+			ids = append(ids, id)
+		}
+	}
+	for start := 0; start < len(ids); start += exportItemBatch {
+		end := start + exportItemBatch
+		if end > len(ids) {
+			end = len(ids)
+		}
+		params := z.itemParams(map[string]interface{}{
+			"output":  []string{"itemid", "key_", "hostid", "value_type"},
+			"itemids": ids[start:end],
+		})
+		z.Cluster.ItemLabelConfig.ItemParams(*z.Version, params)
+		z.Cluster.lldParams(params)
+		z.Cluster.metadataParams(*z.Version, params)
+		result, er := z.request(ctx, "item.get", params)
+		if er != nil {
+			return er
+		}
+		items, _ := result.([]interface{})
+		z.loadPrototypes(ctx, items)
+		z.loadValueMaps(ctx, items)
+		for _, v := range items {
+			item := v.(map[string]interface{})
+			z.Cluster.ExportItems.Store(fmt.Sprint(item["itemid"]), item)
+		}
+		for _, id := range ids[start:end] {
+			if _, ok := z.Cluster.ExportItems.Load(id); !ok {
+				z.Cluster.ExportItems.Store(id, map[string]interface{}(nil))
+			}
+		}
+	}
+	return nil
+}
+
+// processExportRecord 与 item.get 的结果合并后按 processMetric 处理. 主机不在同步范围或item不需要输出时返回 false
+func (c *Cluster) processExportRecord(r exportRecord) (bool, error) {
+	v, _ := c.ExportItems.Load(r.ItemId.String())
+	cached, _ := v.(map[string]interface{})
+	if len(cached) == 0 {
+		return false, nil
+	}
+	hostId, ok := c.Hosts.Id(r.hostName())
+	if !ok || hostId != fmt.Sprint(cached["hostid"]) {
+		return false, nil
+	}
+	item := make(map[string]interface{}, len(cached)+6)
+	for k, v := range cached {
+		item[k] = v
+	}
+	item["lastvalue"] = fmt.Sprint(r.Value)
+	item["lastclock"] = r.Clock.String()
+	item["ns"] = r.Ns.String()
+	if r.Type != "" {
+		item["value_type"] = r.Type.String()
+	}
+	if item["value_type"] == valueTypeLog {
+		item["source"], item["severity"], item["logeventid"] = r.Source, r.Severity.String(), r.EventId.String()
+	}
+	if !c.exported(item) {
+		return false, nil
+	}
+	// 值作为label输出时(_info, 值映射)需要记录上次的序列
+	c.ItemStates.LoadOrStore(r.ItemId.String(), &itemState{HostId: hostId, Key: fmt.Sprint(item["key_"]), Clock: r.Clock.String()})
+	return true, c.processMetric(item, true)
+}
@@ -0,0 +1,8 @@
+package main
+
+import "os"
+
+// fileInode windows 上没有inode, 只能通过文件变小识别轮转
+func fileInode(os.FileInfo) uint64 {
+	return 0
+}
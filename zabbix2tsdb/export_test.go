@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestReadExportFileOversizedLine 超过 exportReadSize 的行跳过, 之后的行继续读取, 未写完的行不读取
+func TestReadExportFileOversizedLine(t *testing.T) {
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: "http://127.0.0.1"})
+	if er != nil {
+		t.Fatal(er)
+	}
+	// 不在同步范围内的item, 不需要查询api
+	c.ExportItems.Store("1", map[string]interface{}(nil))
+	record := `{"host":"web01","itemid":1,"clock":1690892492,"ns":0,"value":1.5,"type":0}` + "\n"
+	oversized := `{"host":"web01","itemid":1,"clock":1690892492,"ns":0,"value":"` + strings.Repeat("x", exportReadSize+10) + `","type":4}` + "\n"
+	partial := `{"host":"web01","itemid":1,`
+	complete := record + oversized + record + record
+	path := filepath.Join(t.TempDir(), "history-history-syncer-1.ndjson")
+	if er := ioutil.WriteFile(path, []byte(complete+partial), 0644); er != nil {
+		t.Fatal(er)
+	}
+	n, er := c.readExportFile(context.Background(), path, 0)
+	if er != nil {
+		t.Fatal(er)
+	}
+	if n != int64(len(complete)) {
+		t.Errorf("read %d bytes, want %d", n, len(complete))
+	}
+	// 超长的行尚未写完时等待
+	if er := ioutil.WriteFile(path, []byte(record+oversized[:len(oversized)-10]), 0644); er != nil {
+		t.Fatal(er)
+	}
+	if n, er := c.readExportFile(context.Background(), path, 0); er != nil || n != int64(len(record)) {
+		t.Errorf("read %d bytes, %v, want %d", n, er, len(record))
+	}
+}
+
+// TestReadExport 没有checkpoint时从文件末尾开始; 轮转后先读完 .old 中剩余的数据再从头读取新文件.
+// 4.0 的 host 为主机名称, 5.0 起为对象; 不在同步范围内的主机不输出
+func TestReadExport(t *testing.T) {
+	defer func(s Sinks) { sinks = s }(sinks)
+	records := &recordWriter{}
+	sinks = Sinks{NewSink("record", records, 0)}
+	server := fakeZabbix(t, map[string]interface{}{
+		"apiinfo.version": "6.0.0",
+		"user.login":      "session",
+		"item.get": []interface{}{map[string]interface{}{
+			"itemid": "23000", "key_": "system.cpu.load[all,avg1]", "hostid": "10084", "value_type": "0",
+		}},
+	})
+	dir := t.TempDir()
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: server.URL, ExportDir: dir})
+	if er != nil {
+		t.Fatal(er)
+	}
+	if er := c.Api.Login(); er != nil {
+		t.Fatal(er)
+	}
+	c.HostIdHost.Store("10084", "web01")
+	c.Hosts.SetNames(map[string]string{"web01": "10084"})
+	line := func(host string, clock int) string {
+		return fmt.Sprintf(`{"host":%s,"itemid":23000,"clock":%d,"ns":0,"value":%d.5,"type":0}`+"\n", host, clock, clock%100)
+	}
+	path := filepath.Join(dir, "history-history-syncer-1.ndjson")
+	write := func(path, data string) {
+		f, er := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if er != nil {
+			t.Fatal(er)
+		}
+		_, _ = f.WriteString(data)
+		_ = f.Close()
+	}
+	values := func() []float64 {
+		if er := sinks.Flush(true); er != nil {
+			t.Fatal(er)
+		}
+		var res []float64
+		for _, s := range records.samples {
+			res = append(res, s.Value)
+		}
+		records.samples = nil
+		return res
+	}
+	write(path, line(`"web01"`, 1690892401))
+	positions := map[string]exportPosition{}
+	if !c.readExport(context.Background(), positions, true) {
+		t.Error("first read should record the position")
+	}
+	if got := values(); len(got) != 0 {
+		t.Errorf("existing data should be skipped, got %v", got)
+	}
+	write(path, line(`{"host":"web01","name":"Web 01"}`, 1690892402)+line(`"db01"`, 1690892403))
+	c.readExport(context.Background(), positions, false)
+	if got := values(); fmt.Sprint(got) != "[2.5]" {
+		t.Errorf("got %v, want [2.5]", got)
+	}
+	// 轮转: 写入 .old 的剩余数据后重命名, 新文件从头读取
+	write(path, line(`"web01"`, 1690892404))
+	if er := os.Rename(path, path+exportRotatedSuffix); er != nil {
+		t.Fatal(er)
+	}
+	write(path, line(`"web01"`, 1690892405))
+	c.readExport(context.Background(), positions, false)
+	if got := values(); fmt.Sprint(got) != "[4.5 5.5]" {
+		t.Errorf("got %v, want [4.5 5.5]", got)
+	}
+	fi, _ := os.Stat(path)
+	if pos := positions[filepath.Base(path)]; pos.Offset != fi.Size() || pos.Inode != fileInode(fi) {
+		t.Errorf("got position %+v, want offset %d", pos, fi.Size())
+	}
+	if c.readExport(context.Background(), positions, false) {
+		t.Error("no new data should not change the position")
+	}
+}
+
+// TestSyncExportFlushFailed 写入失败时不保存checkpoint, 下次从上次保存的位置重新读取
+func TestSyncExportFlushFailed(t *testing.T) {
+	defer func(s Sinks) { sinks = s }(sinks)
+	records := &recordWriter{}
+	sinks = Sinks{NewSink("record", records, 0)}
+	dir := t.TempDir()
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: "http://127.0.0.1", ExportDir: dir})
+	if er != nil {
+		t.Fatal(er)
+	}
+	c.HostIdHost.Store("10084", "web01")
+	c.Hosts.SetNames(map[string]string{"web01": "10084"})
+	c.ExportItems.Store("23000", map[string]interface{}{
+		"itemid": "23000", "key_": "system.cpu.load[all,avg1]", "hostid": "10084", "value_type": "0",
+	})
+	path := filepath.Join(dir, "history-history-syncer-1.ndjson")
+	record := `{"host":"web01","itemid":23000,"clock":1690892401,"ns":0,"value":1.5,"type":0}` + "\n"
+	if er := ioutil.WriteFile(path, []byte(record), 0644); er != nil {
+		t.Fatal(er)
+	}
+	checkpoint := filepath.Join(dir, "export.checkpoint")
+	positions, ok := c.syncExport(context.Background(), checkpoint, map[string]exportPosition{}, true)
+	if !ok {
+		t.Fatal("first sync failed")
+	}
+	saved, _ := ioutil.ReadFile(checkpoint)
+
+	f, er := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if er != nil {
+		t.Fatal(er)
+	}
+	_, _ = f.WriteString(record)
+	_ = f.Close()
+	records.flushErr = fmt.Errorf("remote write failed")
+	next, ok := c.syncExport(context.Background(), checkpoint, positions, false)
+	if ok || !reflect.DeepEqual(next, positions) {
+		t.Errorf("got %+v %v, want the last positions %+v", next, ok, positions)
+	}
+	if data, _ := ioutil.ReadFile(checkpoint); string(data) != string(saved) {
+		t.Errorf("checkpoint changed to %s, want %s", data, saved)
+	}
+
+	records.flushErr = nil
+	records.samples = nil
+	if _, ok := c.syncExport(context.Background(), checkpoint, next, false); !ok {
+		t.Fatal("sync failed")
+	}
+	if len(records.samples) != 1 {
+		t.Errorf("got %d samples, want the record read again", len(records.samples))
+	}
+	if data, _ := ioutil.ReadFile(checkpoint); string(data) == string(saved) {
+		t.Error("checkpoint should be saved after the records are written")
+	}
+}
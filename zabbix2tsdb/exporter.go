@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+// MetricStore 保存每个序列的最新值, 按集群及 hostId 分组, 便于删除已失效主机的数据
+type MetricStore struct {
+	Locker sync.RWMutex
+	// cluster -> hostId -> series -> sample
+	Clusters map[string]map[string]map[string]Sample
+}
+
+func NewMetricStore() *MetricStore {
+	return &MetricStore{Clusters: map[string]map[string]map[string]Sample{}}
+}
+
+func (m *MetricStore) Write(cluster, hostId string, samples []Sample) error {
+	m.Locker.Lock()
+	defer m.Locker.Unlock()
+	hosts, ok := m.Clusters[cluster]
+	if !ok {
+		hosts = map[string]map[string]Sample{}
+		m.Clusters[cluster] = hosts
+	}
+	series, ok := hosts[hostId]
+	if !ok {
+		series = map[string]Sample{}
+		hosts[hostId] = series
+	}
+	for _, s := range samples {
+		series[s.Series()] = s
+	}
+	return nil
+}
+
+// Delete 删除这些数据对应的序列
+func (m *MetricStore) Delete(cluster, hostId string, samples []Sample) error {
+	m.Locker.Lock()
+	defer m.Locker.Unlock()
+	series := m.Clusters[cluster][hostId]
+	for _, s := range samples {
+		delete(series, s.Series())
+	}
+	return nil
+}
+
+// Retain 删除该集群中不在 hostIds 中的主机对应的序列
+func (m *MetricStore) Retain(cluster string, hostIds []string) {
+	alive := make(map[string]struct{}, len(hostIds))
+	for _, hostId := range hostIds {
+		alive[hostId] = struct{}{}
+	}
+	m.Locker.Lock()
+	defer m.Locker.Unlock()
+	for hostId := range m.Clusters[cluster] {
+		if _, ok := alive[hostId]; !ok {
+			delete(m.Clusters[cluster], hostId)
+		}
+	}
+}
+
+// Flush 数据已在 Write 时更新
+func (m *MetricStore) Flush() error {
+	return nil
+}
+
+// ServeHTTP 按 Accept 输出prometheus或openmetrics格式, 同时输出自身指标
+func (m *MetricStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Locker.RLock()
+	var samples []Sample
+	for _, hosts := range m.Clusters {
+		for _, series := range hosts {
+			for _, s := range series {
+				samples = append(samples, s)
+			}
+		}
+	}
+	m.Locker.RUnlock()
+	writeMetrics(w, r, append(groupFamilies(samples, nil), selfMetrics.families()...))
+}
+
+func serveMetrics(listen string, store *MetricStore) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", store)
+	listenAndServe(listen, mux)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestMetricStore 每个序列只保留最新值, 删除的序列及已失效主机的数据不再输出
+func TestMetricStore(t *testing.T) {
+	store := NewMetricStore()
+	labels := func(host string) []Label {
+		return []Label{{Name: "c", Value: "0"}, {Name: "__endpoint__", Value: host}}
+	}
+	_ = store.Write("0", "10084", []Sample{
+		{Name: "system_uptime", Labels: labels("web01"), Value: 100, Timestamp: 1690892492000},
+		{Name: "system_cpu_load", Labels: labels("web01"), Value: 0.5, Timestamp: 1690892492000},
+	})
+	_ = store.Write("0", "10084", []Sample{{Name: "system_uptime", Labels: labels("web01"), Value: 160, Timestamp: 1690892552000}})
+	_ = store.Write("0", "10085", []Sample{{Name: "system_uptime", Labels: labels("web02"), Value: 50, Timestamp: 1690892492000}})
+	_ = store.Write("1", "10084", []Sample{{Name: "system_uptime", Labels: []Label{{Name: "c", Value: "1"}, {Name: "__endpoint__", Value: "db01"}}, Value: 70}})
+
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		store.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+	body := scrape()
+	for _, line := range []string{
+		`system_uptime{c="0",__endpoint__="web01"} 160 1690892552000`,
+		`system_uptime{c="0",__endpoint__="web02"} 50 1690892492000`,
+		`system_uptime{c="1",__endpoint__="db01"} 70`,
+		`system_cpu_load{c="0",__endpoint__="web01"} 0.5 1690892492000`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %s in\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, " 100 ") {
+		t.Errorf("stale value in\n%s", body)
+	}
+
+	_ = store.Delete("0", "10084", []Sample{{Name: "system_cpu_load", Labels: labels("web01")}})
+	store.Retain("0", []string{"10084"})
+	body = scrape()
+	for _, line := range []string{"system_cpu_load", `__endpoint__="web02"`} {
+		if strings.Contains(body, line) {
+			t.Errorf("%s should be removed:\n%s", line, body)
+		}
+	}
+	// Retain 只影响指定的集群
+	if !strings.Contains(body, `__endpoint__="db01"`) || !strings.Contains(body, `__endpoint__="web01"`) {
+		t.Errorf("retained series missing:\n%s", body)
+	}
+}
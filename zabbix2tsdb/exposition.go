@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	formatInfluxdb    = "influxdb"
+	formatPrometheus  = "prometheus"
+	formatOpenMetrics = "openmetrics"
+
+	contentTypePrometheus  = "text/plain; version=0.0.4; charset=utf-8"
+	contentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+	metricInfluxSkipped = "zabbix2tsdb_influx_skipped_total"
+)
+
+// MetricFamily 同名序列及其元数据, summary 的 _sum, _count 属于同一个 family
+type MetricFamily struct {
+	Name string
+	// Type counter, gauge, summary, 为空时输出 untyped(prometheus) 或 unknown(openmetrics)
+	Type    string
+	Help    string
+	Unit    string
+	Samples []Sample
+}
+
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// formatInfluxSample line protocol, 值的 field key 为 {V}, 时间戳为纳秒.
+// 值为空的label不输出, line protocol 不支持空的tag值. 也不支持 NaN 及 ±Inf, 这些值返回 false,
+// 否则influxdb会拒绝整批数据
+func formatInfluxSample(s Sample) (string, bool) {
+	if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+		selfMetrics.Add(metricInfluxSkipped, metricTypeCounter, 1)
+		return "", false
+	}
+	var b strings.Builder
+	b.WriteString(escapeInfluxMeasurement(s.Name))
+	for _, l := range s.Labels {
+		value := escapeInfluxTag(l.Value)
+		if value == "" {
+			continue
+		}
+		b.WriteByte(',')
+		b.WriteString(escapeInfluxTag(l.Name))
+		b.WriteByte('=')
+		b.WriteString(value)
+	}
+	b.WriteByte(' ')
+	b.WriteString(defaultKey)
+	b.WriteByte('=')
+	b.WriteString(formatValue(s.Value))
+	if s.Timestamp != 0 {
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(s.Timestamp*1e6, 10))
+	}
+	return b.String(), true
+}
+
+// formatPrometheusSample prometheus 文本格式, 时间戳为毫秒
+func formatPrometheusSample(s Sample) string {
+	line := s.Series() + " " + formatValue(s.Value)
+	if s.Timestamp != 0 {
+		line += " " + strconv.FormatInt(s.Timestamp, 10)
+	}
+	return line
+}
+
+// formatOpenMetricsSample openmetrics 文本格式, 时间戳为秒
+func formatOpenMetricsSample(s Sample) string {
+	line := s.Series() + " " + formatValue(s.Value)
+	if s.Timestamp != 0 {
+		line += " " + strconv.FormatFloat(float64(s.Timestamp)/1e3, 'f', -1, 64)
+	}
+	return line
+}
+
+// formatSample 按 format 序列化单条数据, 用于逐行输出(stdout, file, http). 格式不支持该值时返回 false
+func formatSample(format string, s Sample) (string, bool) {
+	switch format {
+	case formatPrometheus:
+		return formatPrometheusSample(s), true
+	case formatOpenMetrics:
+		return formatOpenMetricsSample(s), true
+	}
+	return formatInfluxSample(s)
+}
+
+// groupFamilies 按metric名称分组, types 为 metric名称 -> 类型, 为nil时使用各序列的 Meta.
+// 同一family中各序列的类型不一致时(如relabel合并了不同的item)不输出类型, 说明取排序后的第一个, 保证输出稳定
+func groupFamilies(samples []Sample, types map[string]string) []MetricFamily {
+	index := map[string]int{}
+	var families []MetricFamily
+	conflicts := map[int]struct{}{}
+	for _, s := range samples {
+		name, typ := s.Name, types[s.Name]
+		if types == nil && s.Meta != nil {
+			typ = s.Meta.Type
+		}
+		if typ == metricTypeSummary {
+			name = strings.TrimSuffix(strings.TrimSuffix(name, "_sum"), "_count")
+		}
+		i, ok := index[name]
+		if !ok {
+			i = len(families)
+			index[name] = i
+			families = append(families, MetricFamily{Name: name, Type: typ})
+			if s.Meta != nil {
+				families[i].Help, families[i].Unit = s.Meta.Help, s.Meta.Unit
+			}
+		} else if families[i].Type != typ {
+			conflicts[i] = struct{}{}
+		}
+		if ok && s.Meta != nil && (families[i].Help == "" || s.Meta.Help < families[i].Help) {
+			families[i].Help = s.Meta.Help
+		}
+		families[i].Samples = append(families[i].Samples, s)
+	}
+	for i := range conflicts {
+		families[i].Type = ""
+	}
+	return families
+}
+
+// writeFamilies 按名称排序后输出, openMetrics 为true时输出 openmetrics 格式, 不包含 # EOF
+func writeFamilies(w io.Writer, families []MetricFamily, openMetrics bool) {
+	sort.Slice(families, func(i, j int) bool { return families[i].Name < families[j].Name })
+	for _, f := range families {
+		name, typ := f.Name, f.Type
+		if openMetrics {
+			// openmetrics 中counter的family名称不含 _total
+			if typ == metricTypeCounter {
+				name = strings.TrimSuffix(name, "_total")
+			}
+			if typ == "" {
+				typ = "unknown"
+			}
+		} else if typ == "" {
+			typ = "untyped"
+		}
+		lines := make([]string, 0, len(f.Samples))
+		for _, s := range f.Samples {
+			if openMetrics {
+				lines = append(lines, formatOpenMetricsSample(s))
+			} else {
+				lines = append(lines, formatPrometheusSample(s))
+			}
+		}
+		sort.Strings(lines)
+		if f.Help != "" {
+			help := helpReplacer.Replace(f.Help)
+			if openMetrics {
+				help = strings.ReplaceAll(help, `"`, `\"`)
+			}
+			_, _ = fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+		}
+		_, _ = fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+		// openmetrics 要求family名称以unit结尾
+		if openMetrics && f.Unit != "" && strings.HasSuffix(name, "_"+f.Unit) {
+			_, _ = fmt.Fprintf(w, "# UNIT %s %s\n", name, f.Unit)
+		}
+		for _, line := range lines {
+			_, _ = fmt.Fprintln(w, line)
+		}
+	}
+}
+
+// acceptOpenMetrics prometheus 抓取时的 Accept 包含 application/openmetrics-text 时输出 openmetrics 格式
+func acceptOpenMetrics(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+}
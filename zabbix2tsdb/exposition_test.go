@@ -0,0 +1,213 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"math"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "更新 testdata 中的 golden 文件")
+
+// goldenSamples 覆盖需要转义的参数, 末尾的反斜杠, 空label, NaN/±Inf(influxdb 跳过) 及没有时间戳的数据
+func goldenSamples() []Sample {
+	host := []Label{{Name: "c", Value: "0"}, {Name: "__endpoint__", Value: "web_01"}}
+	with := func(labels ...Label) []Label {
+		return append(append([]Label{}, host...), labels...)
+	}
+	return []Sample{
+		{Name: "custom_metric", Labels: with(Label{Name: "p", Value: "a,b=c d\\e\"f\ng"}), Value: 1.5, Timestamp: 1690892492123},
+		{Name: "vfs_file_size", Labels: with(Label{Name: "p", Value: `C:\data\`}), Value: 2048, Timestamp: 1690892492000},
+		{Name: "system_cpu_util", Labels: with(Label{Name: "type", Value: "idle"}, Label{Name: "cpu", Value: ""}), Value: 97.5, Timestamp: 1690892492000},
+		{Name: "zabbix_value", Labels: with(Label{Name: "kind", Value: "nan"}), Value: math.NaN(), Timestamp: 1690892492000},
+		{Name: "zabbix_value", Labels: with(Label{Name: "kind", Value: "inf"}), Value: math.Inf(1), Timestamp: 1690892492000},
+		{Name: "zabbix_value", Labels: with(Label{Name: "kind", Value: "-inf"}), Value: math.Inf(-1), Timestamp: 1690892492000},
+		{Name: "zabbix_host_available", Labels: with(Label{Name: "type", Value: "agent"}), Value: 1},
+	}
+}
+
+// goldenFamilies counter, 带单位及需要转义说明的 gauge, summary 及没有元数据的序列
+func goldenFamilies() []MetricFamily {
+	host := []Label{{Name: "c", Value: "0"}, {Name: "__endpoint__", Value: "web_01"}}
+	counter := &Metadata{Type: metricTypeCounter, Help: "Interface eth0: Bits received", Unit: "bytes"}
+	gauge := &Metadata{Type: metricTypeGauge, Help: "Free disk \"/data\"\nC:\\ drive", Unit: "ratio"}
+	samples := []Sample{
+		{Name: "net_if_in_bytes_total", Labels: append(append([]Label{}, host...), Label{Name: "interface", Value: "eth0"}), Value: 100, Timestamp: 1690892492000, Meta: counter},
+		{Name: "net_if_in_bytes_total", Labels: append(append([]Label{}, host...), Label{Name: "interface", Value: "lo"}), Value: 5, Timestamp: 1690892492000, Meta: counter},
+		{Name: "vfs_fs_size_ratio", Labels: append(append([]Label{}, host...), Label{Name: "fsname", Value: "/data"}), Value: 0.551, Timestamp: 1690892492500, Meta: gauge},
+		{Name: "system_uptime", Labels: host, Value: math.Inf(1), Timestamp: 1690892492000},
+	}
+	families := groupFamilies(samples, nil)
+	summary := []Sample{
+		{Name: metricApiDuration + "_sum", Labels: []Label{{Name: "cluster", Value: "0"}}, Value: 1.25},
+		{Name: metricApiDuration + "_count", Labels: []Label{{Name: "cluster", Value: "0"}}, Value: 3},
+	}
+	types := map[string]string{metricApiDuration + "_sum": metricTypeSummary, metricApiDuration + "_count": metricTypeSummary}
+	return append(families, groupFamilies(summary, types)...)
+}
+
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if er := ioutil.WriteFile(path, []byte(got), 0644); er != nil {
+			t.Fatal(er)
+		}
+	}
+	want, er := ioutil.ReadFile(path)
+	if er != nil {
+		t.Fatal(er)
+	}
+	if got != string(want) {
+		t.Errorf("%s mismatch\n--- got\n%s--- want\n%s", path, got, want)
+	}
+}
+
+// formatAll 按 format 序列化 goldenSamples, 不支持的值不输出
+func formatAll(format string) string {
+	var b strings.Builder
+	for _, s := range goldenSamples() {
+		if line, ok := formatSample(format, s); ok {
+			b.WriteString(line)
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+func TestFormatInfluxSample(t *testing.T) {
+	checkGolden(t, "influx", formatAll(formatInfluxdb))
+}
+
+func TestFormatPrometheusSample(t *testing.T) {
+	checkGolden(t, "prometheus_samples", formatAll(formatPrometheus))
+}
+
+func TestFormatOpenMetricsSample(t *testing.T) {
+	checkGolden(t, "openmetrics_samples", formatAll(formatOpenMetrics))
+}
+
+func TestWriteFamilies(t *testing.T) {
+	for _, tc := range []struct {
+		name, accept, contentType string
+	}{
+		{"prometheus_families", "text/plain", contentTypePrometheus},
+		{"openmetrics_families", "application/openmetrics-text; version=1.0.0,text/plain;q=0.5", contentTypeOpenMetrics},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/metrics", nil)
+			r.Header.Set("Accept", tc.accept)
+			w := httptest.NewRecorder()
+			writeMetrics(w, r, goldenFamilies())
+			if ct := w.Header().Get("Content-Type"); ct != tc.contentType {
+				t.Errorf("content type %q, want %q", ct, tc.contentType)
+			}
+			checkGolden(t, tc.name, w.Body.String())
+		})
+	}
+}
+
+func sameSamples(a, b []Sample) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, y := a[i], b[i]
+		if math.IsNaN(x.Value) && math.IsNaN(y.Value) {
+			x.Value, y.Value = 0, 0
+		}
+		if len(x.Labels) == 0 && len(y.Labels) == 0 {
+			x.Labels, y.Labels = nil, nil
+		}
+		if !reflect.DeepEqual(x, y) {
+			return false
+		}
+	}
+	return true
+}
+
+// TestParseInfluxLine --checkRules 读取 formatInfluxSample 的输出, 转换后需要得到相同的数据
+func TestParseInfluxLine(t *testing.T) {
+	for _, s := range goldenSamples() {
+		want := s
+		// line protocol 不支持的值: 空label不输出, 末尾的反斜杠去掉, 换行替换为空格
+		want.Labels = nil
+		for _, l := range s.Labels {
+			if l.Value == "" {
+				continue
+			}
+			l.Value = strings.TrimRight(strings.ReplaceAll(l.Value, "\n", " "), `\`)
+			want.Labels = append(want.Labels, l)
+		}
+		line, ok := formatInfluxSample(s)
+		if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+			if ok {
+				t.Errorf("non-finite value should be skipped: %q", line)
+			}
+			continue
+		}
+		got, er := parseInfluxLine(line)
+		if er != nil {
+			t.Fatalf("parse %q failed:%s", line, er)
+		}
+		if !sameSamples(got, []Sample{want}) {
+			t.Errorf("round trip %q\n got %+v\nwant %+v", line, got, want)
+		}
+	}
+	// 多个field, 整数后缀, 纳秒时间戳转换为毫秒
+	got, er := parseInfluxLine(`disk,host=a\ b used=1i,free=2u,{V}=3.5 1690892492123456789`)
+	if er != nil {
+		t.Fatal(er)
+	}
+	labels := []Label{{Name: "host", Value: "a b"}}
+	want := []Sample{
+		{Name: "disk_used", Labels: labels, Value: 1, Timestamp: 1690892492123},
+		{Name: "disk_free", Labels: labels, Value: 2, Timestamp: 1690892492123},
+		{Name: "disk", Labels: labels, Value: 3.5, Timestamp: 1690892492123},
+	}
+	if !sameSamples(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+	for _, line := range []string{"metric", "metric v=abc", "metric v=1 abc", "metric line"} {
+		if _, er := parseInfluxLine(line); er == nil {
+			t.Errorf("%q should fail", line)
+		}
+	}
+}
+
+// TestHostSampleValues label值原样保留, 由输出格式转义. 主机名称默认与之前的版本一致替换为 _, --rawHostNames 时原样保留
+func TestHostSampleValues(t *testing.T) {
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: "http://127.0.0.1", HostLabels: []string{"groups", "tag:role"}})
+	if er != nil {
+		t.Fatal(er)
+	}
+	v := Version{Major: 6, Minor: 2}
+	host := map[string]interface{}{
+		"hostid": "10084", "host": "web 01",
+		"hostgroups": []interface{}{map[string]interface{}{"name": "Web"}, map[string]interface{}{"name": "Linux servers"}},
+		"tags":       []interface{}{map[string]interface{}{"tag": "role", "value": "db, cache"}},
+	}
+	c.HostIdHost.Store("10084", "web 01")
+	c.HostIdLabels.Store("10084", c.HostLabelConfig.HostLabels(v, host))
+	s := c.hostSample("zabbix_host_monitored", "10084", nil)
+	s.Value = 1
+	want := `zabbix_host_monitored{c="0",__endpoint__="web_01",groups="Linux servers|Web",role="db, cache"} 1`
+	if got := formatPrometheusSample(s); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	c.Config.RawHostNames = true
+	s = c.hostSample("zabbix_host_monitored", "10084", nil)
+	s.Value = 1
+	want = `zabbix_host_monitored{c="0",__endpoint__="web 01",groups="Linux servers|Web",role="db, cache"} 1`
+	if got := formatPrometheusSample(s); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	want = `zabbix_host_monitored,c=0,__endpoint__=web\ 01,groups=Linux\ servers|Web,role=db\,\ cache {V}=1`
+	if got, _ := formatInfluxSample(s); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -2,4 +2,8 @@ module zabbix
 
 go 1.17
 
-require github.com/spf13/pflag v1.0.5
+require (
+	github.com/golang/snappy v0.0.4
+	github.com/spf13/pflag v1.0.5
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// regexPrefix 以该前缀开头的规则为正则表达式, 否则为通配符(* ?), 不含通配符时完全匹配
+const regexPrefix = "re:"
+
+// HostFilter 由 --groups, --excludeGroups, --hosts, --excludeHosts, --templates, --hostTags 解析
+type HostFilter struct {
+	Groups        []*regexp.Regexp
+	ExcludeGroups []*regexp.Regexp
+	Hosts         []*regexp.Regexp
+	ExcludeHosts  []*regexp.Regexp
+	Templates     []*regexp.Regexp
+	Tags          []tagFilter
+}
+
+// tagFilter <tag> 存在该标签, <tag>=<value> 标签值匹配, <tag>!=<value> 标签值不匹配或不存在该标签
+type tagFilter struct {
+	Name   string
+	Value  *regexp.Regexp
+	Negate bool
+}
+
+// compilePattern re:<正则> 或通配符, 均为完全匹配
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(pattern, regexPrefix) {
+		return regexp.Compile("^(?:" + strings.TrimPrefix(pattern, regexPrefix) + ")$")
+	}
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.ReplaceAll(expr, `\*`, ".*")
+	expr = strings.ReplaceAll(expr, `\?`, ".")
+	return regexp.Compile("^" + expr + "$")
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		re, er := compilePattern(p)
+		if er != nil {
+			return nil, fmt.Errorf("invalid pattern %s:%s", p, er)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+func matchAny(patterns []*regexp.Regexp, s string) bool {
+	for _, p := range patterns {
+		if p.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseHostFilter(c ClusterConfig) (HostFilter, error) {
+	var f HostFilter
+	var er error
+	for _, v := range []struct {
+		patterns []string
+		dst      *[]*regexp.Regexp
+	}{
+		{c.Groups, &f.Groups},
+		{c.ExcludeGroups, &f.ExcludeGroups},
+		{c.Hosts, &f.Hosts},
+		{c.ExcludeHosts, &f.ExcludeHosts},
+		{c.Templates, &f.Templates},
+	} {
+		if *v.dst, er = compilePatterns(v.patterns); er != nil {
+			return f, er
+		}
+	}
+	for _, item := range c.HostTags {
+		t := tagFilter{Name: item}
+		value := ""
+		if i := strings.Index(item, "!="); i >= 0 {
+			t.Name, value, t.Negate = item[:i], item[i+2:], true
+		} else if i := strings.Index(item, "="); i >= 0 {
+			t.Name, value = item[:i], item[i+1:]
+		}
+		if t.Name != item {
+			if t.Value, er = compilePattern(value); er != nil {
+				return f, fmt.Errorf("invalid host tag filter %s:%s", item, er)
+			}
+		}
+		f.Tags = append(f.Tags, t)
+	}
+	return f, nil
+}
+
+// HostParams 在 host.get 请求中加入过滤需要的 select 参数. 主机标签 4.2 起支持, 之前的版本无法按 --hostTags 过滤
+func (f HostFilter) HostParams(v Version, params map[string]interface{}) error {
+	if len(f.Templates) > 0 {
+		params["selectParentTemplates"] = []string{"name"}
+	}
+	if len(f.Tags) > 0 {
+		if !v.AtLeast(4, 2) {
+			return fmt.Errorf("--hostTags 需要 zabbix 4.2 及以上版本, 当前版本为 %s", v)
+		}
+		params["selectTags"] = []string{"tag", "value"}
+	}
+	return nil
+}
+
+// matchNames 返回匹配的名称, 以及没有匹配到任何名称的规则的下标
+func matchNames(names []string, patterns []*regexp.Regexp) ([]string, []int) {
+	var matched []string
+	var unmatched []int
+	hit := make([]bool, len(patterns))
+	for _, name := range names {
+		found := false
+		for i, p := range patterns {
+			if p.MatchString(name) {
+				hit[i], found = true, true
+			}
+		}
+		if found {
+			matched = append(matched, name)
+		}
+	}
+	for i := range patterns {
+		if !hit[i] {
+			unmatched = append(unmatched, i)
+		}
+	}
+	sort.Strings(matched)
+	return matched, unmatched
+}
+
+// Match 按主机名, 模板及标签过滤 host.get 返回的主机
+func (f HostFilter) Match(host map[string]interface{}) bool {
+	name := fmt.Sprint(host["host"])
+	if len(f.Hosts) > 0 && !matchAny(f.Hosts, name) {
+		return false
+	}
+	if matchAny(f.ExcludeHosts, name) {
+		return false
+	}
+	if len(f.Templates) > 0 {
+		templates, _ := host["parentTemplates"].([]interface{})
+		matched := false
+		for _, t := range templates {
+			if matchAny(f.Templates, fmt.Sprint(t.(map[string]interface{})["name"])) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	tags, _ := host["tags"].([]interface{})
+	for _, filter := range f.Tags {
+		found := false
+		for _, t := range tags {
+			tag := t.(map[string]interface{})
+			if fmt.Sprint(tag["tag"]) == filter.Name &&
+				(filter.Value == nil || filter.Value.MatchString(fmt.Sprint(tag["value"]))) {
+				found = true
+				break
+			}
+		}
+		if found == filter.Negate {
+			return false
+		}
+	}
+	return true
+}
+
+// logChange 与上次不同时输出, 避免每次刷新主机都输出相同的日志
+func (c *Cluster) logChange(kind string, msg string) {
+	if last, ok := c.FilterLogs.Load(kind); ok && last.(string) == msg {
+		return
+	}
+	c.FilterLogs.Store(kind, msg)
+	_, _ = fmt.Fprintf(os.Stderr, "cluster %s %s: %s\n", c.Config.Cluster, kind, msg)
+}
+
+// resolveGroups 返回 --groups 匹配的组id, 以及 --excludeGroups 匹配的组id
+func (c *Cluster) resolveGroups() ([]string, []string) {
+	var names []string
+	c.GroupNameId.Range(func(k, _ interface{}) bool {
+		names = append(names, k.(string))
+		return true
+	})
+	ids := func(names []string) []string {
+		var res []string
+		for _, name := range names {
+			if id, ok := c.GroupNameId.Load(name); ok {
+				res = append(res, id.(string))
+			}
+		}
+		return res
+	}
+	included, unmatched := matchNames(names, c.HostFilter.Groups)
+	excluded, _ := matchNames(names, c.HostFilter.ExcludeGroups)
+	msg := fmt.Sprintf("[%s]", strings.Join(included, ", "))
+	if len(excluded) > 0 {
+		msg = fmt.Sprintf("%s, excluded [%s]", msg, strings.Join(excluded, ", "))
+	}
+	for _, i := range unmatched {
+		msg = fmt.Sprintf("%s, no group matches '%s'", msg, c.Config.Groups[i])
+	}
+	c.logChange("groups", msg)
+	return ids(included), ids(excluded)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TestHostFilterParams --hostTags 在 4.2 之前的版本返回错误, 不发送 selectTags
+func TestHostFilterParams(t *testing.T) {
+	f, er := parseHostFilter(ClusterConfig{HostTags: []string{"env=prod"}})
+	if er != nil {
+		t.Fatal(er)
+	}
+	for _, tc := range []struct {
+		version string
+		ok      bool
+	}{{"4.0.30", false}, {"4.2.0", true}, {"6.4.5", true}} {
+		v, er := ParseVersion(tc.version)
+		if er != nil {
+			t.Fatal(er)
+		}
+		params := map[string]interface{}{}
+		er = f.HostParams(v, params)
+		if _, selected := params["selectTags"]; (er == nil) != tc.ok || selected != tc.ok {
+			t.Errorf("%s: error %v, selectTags %v", tc.version, er, selected)
+		}
+	}
+}
+
+// TestCompilePattern 通配符及 re: 正则均为完全匹配, 不含通配符时按原样匹配
+func TestCompilePattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"web*", "web01", true},
+		{"web*", "db-web01", false},
+		{"web0?", "web01", true},
+		{"web0?", "web010", false},
+		{"Linux servers/*", "Linux servers/db", true},
+		{"Linux servers/*", "Linux servers", false},
+		{"web.01", "web.01", true},
+		{"web.01", "webx01", false},
+		{"re:web[0-9]+", "web12", true},
+		{"re:web[0-9]+", "web12-old", false},
+		{"re:db|cache", "cache", true},
+		{"re:db|cache", "cache01", false},
+	} {
+		re, er := compilePattern(tc.pattern)
+		if er != nil {
+			t.Fatal(er)
+		}
+		if got := re.MatchString(tc.name); got != tc.match {
+			t.Errorf("%s %s: got %v, want %v", tc.pattern, tc.name, got, tc.match)
+		}
+	}
+	if _, er := parseHostFilter(ClusterConfig{Hosts: []string{"re:web["}}); er == nil {
+		t.Error("invalid regexp should fail")
+	}
+}
+
+// TestHostFilterMatch 按主机名, 排除的主机, 模板及标签过滤
+func TestHostFilterMatch(t *testing.T) {
+	host := func(name string, templates []string, tags map[string]string) map[string]interface{} {
+		var parents, hostTags []interface{}
+		for _, t := range templates {
+			parents = append(parents, map[string]interface{}{"name": t})
+		}
+		for k, v := range tags {
+			hostTags = append(hostTags, map[string]interface{}{"tag": k, "value": v})
+		}
+		return map[string]interface{}{"hostid": "10084", "host": name, "parentTemplates": parents, "tags": hostTags}
+	}
+	web := host("web01", []string{"Linux by Zabbix agent", "Nginx by HTTP"}, map[string]string{"env": "prod", "role": "web"})
+	db := host("db01", []string{"Linux by Zabbix agent"}, map[string]string{"env": "staging"})
+	bare := host("cache01", nil, nil)
+	for _, tc := range []struct {
+		name   string
+		config ClusterConfig
+		want   []bool
+	}{
+		{"no filter", ClusterConfig{}, []bool{true, true, true}},
+		{"hosts", ClusterConfig{Hosts: []string{"web*", "re:cache[0-9]+"}}, []bool{true, false, true}},
+		{"exclude hosts", ClusterConfig{ExcludeHosts: []string{"db*"}}, []bool{true, false, true}},
+		{"exclude overrides hosts", ClusterConfig{Hosts: []string{"*01"}, ExcludeHosts: []string{"web01"}}, []bool{false, true, true}},
+		{"templates", ClusterConfig{Templates: []string{"Nginx*"}}, []bool{true, false, false}},
+		{"tag exists", ClusterConfig{HostTags: []string{"role"}}, []bool{true, false, false}},
+		{"tag value", ClusterConfig{HostTags: []string{"env=prod"}}, []bool{true, false, false}},
+		{"tag value regexp", ClusterConfig{HostTags: []string{"env=re:prod|staging"}}, []bool{true, true, false}},
+		{"tag not value", ClusterConfig{HostTags: []string{"env!=prod"}}, []bool{false, true, true}},
+		{"all tags", ClusterConfig{HostTags: []string{"env=prod", "role!=db"}}, []bool{true, false, false}},
+	} {
+		f, er := parseHostFilter(tc.config)
+		if er != nil {
+			t.Fatal(er)
+		}
+		got := []bool{f.Match(web), f.Match(db), f.Match(bare)}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestResolveGroups 通配符匹配嵌套的组, --excludeGroups 匹配的组中的主机即使属于 --groups 的组也排除
+func TestResolveGroups(t *testing.T) {
+	groups := map[string]string{"Linux servers": "2", "Linux servers/web": "20", "Linux servers/db": "21", "Windows servers": "3"}
+	hosts := map[string][]interface{}{
+		"20": {map[string]interface{}{"hostid": "10084", "host": "web01"}},
+		"21": {map[string]interface{}{"hostid": "10085", "host": "db01"}},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string `json:"method"`
+			Params struct {
+				GroupIds []string `json:"groupids"`
+			} `json:"params"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		var result interface{}
+		switch req.Method {
+		case "apiinfo.version":
+			result = "6.0.0"
+		case "user.login":
+			result = "session"
+		case "hostgroup.get":
+			var list []interface{}
+			for name, id := range groups {
+				list = append(list, map[string]interface{}{"groupid": id, "name": name})
+			}
+			result = list
+		case "host.get":
+			list := []interface{}{}
+			for _, id := range req.Params.GroupIds {
+				list = append(list, hosts[id]...)
+			}
+			result = list
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "result": result, "id": 1})
+	}))
+	defer server.Close()
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: server.URL,
+		Groups: []string{"Linux servers/*", "Missing"}, ExcludeGroups: []string{"re:.*/db"}})
+	if er != nil {
+		t.Fatal(er)
+	}
+	c.updateGroupAndHost()
+	included, excluded := c.resolveGroups()
+	sort.Strings(included)
+	if fmt.Sprint(included, excluded) != "[20 21] [21]" {
+		t.Errorf("got included %v, excluded %v", included, excluded)
+	}
+	c.Hosts.Locker.RLock()
+	defer c.Hosts.Locker.RUnlock()
+	if !reflect.DeepEqual(c.Hosts.Ids, []string{"10084"}) {
+		t.Errorf("got hosts %v, want [10084]", c.Hosts.Ids)
+	}
+}
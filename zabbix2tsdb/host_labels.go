@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// HostLabelConfig 由 --hostLabels 解析, 决定 host.get 需要额外查询的信息
+type HostLabelConfig struct {
+	Tags      map[string]struct{}
+	AllTags   bool
+	Groups    bool
+	Inventory []string
+	Ip        bool
+	Prefix    string
+}
+
+var (
+	// ReplLabelPattern label名称转换
+	ReplLabelPattern = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+	// reservedLabels 内置的label, 主机label不允许覆盖
+	reservedLabels = map[string]struct{}{"c": {}, "__endpoint__": {}, "p": {}}
+)
+
+// parseHostLabels 支持 tag:<name>, tag:*, groups, inventory:<field>, ip
+func parseHostLabels(items []string, prefix string) HostLabelConfig {
+	c := HostLabelConfig{Tags: map[string]struct{}{}, Prefix: prefix}
+	for _, item := range items {
+		kind, name := item, ""
+		if i := strings.Index(item, ":"); i >= 0 {
+			kind, name = item[:i], item[i+1:]
+		}
+		switch {
+		case kind == "tag" && name == "*":
+			c.AllTags = true
+		case kind == "tag" && name != "":
+			c.Tags[name] = struct{}{}
+		case kind == "inventory" && name != "":
+			c.Inventory = append(c.Inventory, name)
+		case kind == "groups":
+			c.Groups = true
+		case kind == "ip":
+			c.Ip = true
+		default:
+			_, _ = fmt.Fprintf(os.Stderr, "ignore invalid host label:%s\n", item)
+		}
+	}
+	return c
+}
+
+// labelName 转换为合法的label名称并加上前缀
+func labelName(prefix, name string) string {
+	name = prefix + ReplLabelPattern.ReplaceAllString(name, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// HostParams 在 host.get 请求中加入需要的 select 参数
+func (c HostLabelConfig) HostParams(v Version, params map[string]interface{}) {
+	if (c.AllTags || len(c.Tags) > 0) && v.AtLeast(4, 2) {
+		params["selectTags"] = []string{"tag", "value"}
+	}
+	if c.Groups {
+		selectGroups, _ := v.HostGroupsField()
+		params[selectGroups] = []string{"name"}
+	}
+	if len(c.Inventory) > 0 {
+		params["selectInventory"] = c.Inventory
+	}
+	if c.Ip {
+		params["selectInterfaces"] = []string{"ip", "main", "type"}
+	}
+}
+
+// HostLabels 从 host.get 的结果中提取label
+func (c HostLabelConfig) HostLabels(v Version, host map[string]interface{}) []Label {
+	values := map[string]string{}
+	set := func(name, value string) {
+		name = labelName(c.Prefix, name)
+		if _, ok := reservedLabels[name]; ok || name == "" || value == "" {
+			return
+		}
+		values[name] = value
+	}
+	tags, _ := host["tags"].([]interface{})
+	for _, t := range tags {
+		tag := t.(map[string]interface{})
+		name := fmt.Sprint(tag["tag"])
+		if _, ok := c.Tags[name]; ok || c.AllTags {
+			set(name, fmt.Sprint(tag["value"]))
+		}
+	}
+	if c.Groups {
+		_, field := v.HostGroupsField()
+		groups, _ := host[field].([]interface{})
+		var names []string
+		for _, g := range groups {
+			names = append(names, fmt.Sprint(g.(map[string]interface{})["name"]))
+		}
+		sort.Strings(names)
+		set("groups", strings.Join(names, "|"))
+	}
+	// 未开启资产记录时 inventory 为空数组
+	if inventory, ok := host["inventory"].(map[string]interface{}); ok {
+		for _, field := range c.Inventory {
+			if value, ok := inventory[field]; ok {
+				set(field, fmt.Sprint(value))
+			}
+		}
+	}
+	if c.Ip {
+		set("ip", mainInterfaceIp(host))
+	}
+	labels := make([]Label, 0, len(values))
+	for name, value := range values {
+		labels = append(labels, Label{Name: name, Value: value})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	return labels
+}
+
+// mainInterfaceIp 优先使用 agent 的默认接口
+func mainInterfaceIp(host map[string]interface{}) string {
+	interfaces, _ := host["interfaces"].([]interface{})
+	ip := ""
+	for _, i := range interfaces {
+		intf := i.(map[string]interface{})
+		if intf["main"] != "1" {
+			continue
+		}
+		if intf["type"] == "1" {
+			return fmt.Sprint(intf["ip"])
+		}
+		if ip == "" {
+			ip = fmt.Sprint(intf["ip"])
+		}
+	}
+	return ip
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseHostLabels(t *testing.T) {
+	c := parseHostLabels([]string{"tag:env", "tag:*", "groups", "inventory:os", "ip", "tag:", "unknown"}, "zbx_")
+	if !c.AllTags || !c.Groups || !c.Ip || !reflect.DeepEqual(c.Inventory, []string{"os"}) || len(c.Tags) != 1 {
+		t.Errorf("got %+v", c)
+	}
+	v := Version{Major: 6, Minor: 0}
+	params := map[string]interface{}{}
+	c.HostParams(v, params)
+	for _, field := range []string{"selectTags", "selectGroups", "selectInventory", "selectInterfaces"} {
+		if _, ok := params[field]; !ok {
+			t.Errorf("%s missing in %v", field, params)
+		}
+	}
+	// 6.2 起为 selectHostGroups, 4.2 之前不支持主机标签
+	params = map[string]interface{}{}
+	c.HostParams(Version{Major: 6, Minor: 2}, params)
+	if _, ok := params["selectHostGroups"]; !ok {
+		t.Errorf("selectHostGroups missing in %v", params)
+	}
+	params = map[string]interface{}{}
+	c.HostParams(Version{Major: 4, Minor: 0}, params)
+	if _, ok := params["selectTags"]; ok {
+		t.Errorf("selectTags should not be used before 4.2: %v", params)
+	}
+}
+
+func TestHostLabels(t *testing.T) {
+	host := map[string]interface{}{
+		"hostid": "10084",
+		"tags": []interface{}{
+			map[string]interface{}{"tag": "env", "value": "prod"},
+			map[string]interface{}{"tag": "cost-center", "value": "42"},
+			map[string]interface{}{"tag": "c", "value": "reserved"},
+			map[string]interface{}{"tag": "empty", "value": ""},
+		},
+		"groups":    []interface{}{map[string]interface{}{"name": "Web"}, map[string]interface{}{"name": "Linux servers"}},
+		"inventory": map[string]interface{}{"os": "Linux", "serialno_a": "SN1"},
+		"interfaces": []interface{}{
+			map[string]interface{}{"ip": "10.0.0.2", "main": "1", "type": "2"},
+			map[string]interface{}{"ip": "10.0.0.3", "main": "0", "type": "1"},
+			map[string]interface{}{"ip": "10.0.0.1", "main": "1", "type": "1"},
+		},
+	}
+	v := Version{Major: 6, Minor: 0}
+	for _, tc := range []struct {
+		items  []string
+		prefix string
+		want   []Label
+	}{
+		{[]string{"tag:env", "groups", "inventory:os", "inventory:missing", "ip"}, "", []Label{
+			{Name: "env", Value: "prod"}, {Name: "groups", Value: "Linux servers|Web"},
+			{Name: "ip", Value: "10.0.0.1"}, {Name: "os", Value: "Linux"},
+		}},
+		// 标签名转换为合法的label, 与内置label同名及空值的忽略
+		{[]string{"tag:*"}, "", []Label{{Name: "cost_center", Value: "42"}, {Name: "env", Value: "prod"}}},
+		{[]string{"tag:*"}, "host_", []Label{{Name: "host_c", Value: "reserved"}, {Name: "host_cost_center", Value: "42"}, {Name: "host_env", Value: "prod"}}},
+	} {
+		got := parseHostLabels(tc.items, tc.prefix).HostLabels(v, host)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: got %v, want %v", tc.items, got, tc.want)
+		}
+	}
+	// 未开启资产记录时 inventory 为空数组
+	host["inventory"] = []interface{}{}
+	if got := parseHostLabels([]string{"inventory:os"}, "").HostLabels(v, host); len(got) != 0 {
+		t.Errorf("got %v, want no labels", got)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	// hostAvailableMetric 每种接口类型的可用性, 值与zabbix一致: 0 未知, 1 可用, 2 不可用
+	hostAvailableMetric = "zabbix_host_available"
+	// hostMaintenanceMetric 1 维护中
+	hostMaintenanceMetric = "zabbix_host_maintenance"
+	// hostMonitoredMetric 1 已启用, 0 已停用
+	hostMonitoredMetric = "zabbix_host_monitored"
+)
+
+// interfaceTypes hostinterface 的 type, 以及 5.4 之前 host 上对应的可用性字段前缀
+var interfaceTypes = []struct {
+	Type   string
+	Name   string
+	Prefix string
+}{
+	{"1", "agent", ""},
+	{"2", "snmp", "snmp_"},
+	{"3", "ipmi", "ipmi_"},
+	{"4", "jmx", "jmx_"},
+}
+
+// InterfaceAvailability 5.4 起可用性由 host 移到了 hostinterface
+func (v Version) InterfaceAvailability() bool {
+	return v.AtLeast(5, 4)
+}
+
+// hostStatusParams 在 host.get 请求中加入状态及可用性字段
+func hostStatusParams(v Version, params map[string]interface{}) {
+	output := append(params["output"].([]string), "status", "maintenance_status")
+	if !v.InterfaceAvailability() {
+		for _, t := range interfaceTypes {
+			output = append(output, t.Prefix+"available", t.Prefix+"error")
+		}
+		params["output"] = output
+		return
+	}
+	params["output"] = output
+	fields, _ := params["selectInterfaces"].([]string)
+	for _, field := range []string{"type", "main", "available", "error"} {
+		if !containsString(fields, field) {
+			fields = append(fields, field)
+		}
+	}
+	params["selectInterfaces"] = fields
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// outputHostStatus 输出主机的接口可用性, 维护状态及启用状态
+func (c *Cluster) outputHostStatus(v Version, host map[string]interface{}) {
+	hostId := fmt.Sprint(host["hostid"])
+	ts := time.Now().UnixNano() / 1e6
+	var samples []Sample
+	if v.InterfaceAvailability() {
+		// 同一类型有多个接口时使用默认接口
+		interfaces, _ := host["interfaces"].([]interface{})
+		for _, t := range interfaceTypes {
+			for _, i := range interfaces {
+				intf := i.(map[string]interface{})
+				if intf["type"] == t.Type && intf["main"] == "1" {
+					samples = append(samples, c.hostAvailable(hostId, t.Name, intf["available"], intf["error"], ts))
+				}
+			}
+		}
+	} else {
+		for _, t := range interfaceTypes {
+			if available, ok := host[t.Prefix+"available"]; ok {
+				samples = append(samples, c.hostAvailable(hostId, t.Name, available, host[t.Prefix+"error"], ts))
+			}
+		}
+	}
+	c.retainHostAvailable(hostId, samples)
+	maintenance := c.hostSample(hostMaintenanceMetric, hostId, nil)
+	maintenance.Value, _ = parseValue(fmt.Sprint(host["maintenance_status"]))
+	monitored := c.hostSample(hostMonitoredMetric, hostId, nil)
+	if host["status"] == "0" {
+		monitored.Value = 1
+	}
+	maintenance.Timestamp, monitored.Timestamp = ts, ts
+	if er := c.emit(hostId, append(samples, maintenance, monitored)...); er != nil {
+		_, _ = fmt.Fprintln(os.Stderr, er.Error())
+	}
+}
+
+// retainHostAvailable exporter模式下删除该主机上次输出但本次没有的可用性序列, 如错误信息已变化
+func (c *Cluster) retainHostAvailable(hostId string, samples []Sample) {
+	series := make(map[string]Sample, len(samples))
+	for _, s := range samples {
+		series[s.Series()] = s
+	}
+	if last, ok := c.HostAvailable.Load(hostId); ok && sinks.HasStore() {
+		for key, s := range last.(map[string]Sample) {
+			if _, ok := series[key]; !ok {
+				if er := c.delete(hostId, s, false); er != nil {
+					_, _ = fmt.Fprintln(os.Stderr, er.Error())
+				}
+			}
+		}
+	}
+	c.HostAvailable.Store(hostId, series)
+}
+
+func (c *Cluster) hostAvailable(hostId, typeName string, available, errorText interface{}, ts int64) Sample {
+	labels := []Label{{Name: "type", Value: typeName}}
+	if s, _ := errorText.(string); s != "" {
+		labels = append(labels, Label{Name: "error", Value: s})
+	}
+	s := c.hostSample(hostAvailableMetric, hostId, labels)
+	s.Value, _ = parseValue(fmt.Sprint(available))
+	s.Timestamp = ts
+	return s
+}
+
+// endpoint __endpoint__ 的值. 与之前的版本一致, 主机名称中的 `," =` 替换为 _, 开启 --rawHostNames 时原样输出
+func (c *Cluster) endpoint(hostName string) string {
+	if c.Config.RawHostNames {
+		return hostName
+	}
+	return ReplParamsPattern.ReplaceAllString(hostName, "_")
+}
+
+// hostSample 返回 metric{c, __endpoint__, 主机label, labels} 的数据, 值和时间戳由调用方设置.
+// labels 同名时覆盖主机label
+func (c *Cluster) hostSample(metric, hostId string, labels []Label) Sample {
+	s := Sample{Name: metric, Labels: []Label{{Name: "c", Value: c.Config.Cluster}}}
+	if hostName, ok := c.HostIdHost.Load(hostId); ok {
+		s.Labels = append(s.Labels, Label{Name: "__endpoint__", Value: c.endpoint(hostName.(string))})
+	}
+	var hostLabels []Label
+	if l, ok := c.HostIdLabels.Load(hostId); ok {
+		hostLabels = l.([]Label)
+	}
+	s.Labels = append(s.Labels, mergeLabels(hostLabels, labels)...)
+	return s
+}
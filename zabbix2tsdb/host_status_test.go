@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func storeSeries(store *MetricStore, cluster, hostId string) []string {
+	store.Locker.RLock()
+	defer store.Locker.RUnlock()
+	var series []string
+	for _, s := range store.Clusters[cluster][hostId] {
+		series = append(series, s.Series()+" "+formatValue(s.Value))
+	}
+	sort.Strings(series)
+	return series
+}
+
+// TestOutputHostStatus 5.4 起使用默认接口的可用性, 之前的版本使用 host 上的字段; 错误信息变化后删除旧的序列
+func TestOutputHostStatus(t *testing.T) {
+	defer func(s Sinks) { sinks = s }(sinks)
+	store := NewMetricStore()
+	sinks = Sinks{NewSink("exporter", store, 0)}
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: "http://127.0.0.1"})
+	if er != nil {
+		t.Fatal(er)
+	}
+	c.HostIdHost.Store("10084", "web01")
+	host := map[string]interface{}{
+		"hostid": "10084", "status": "0", "maintenance_status": "1",
+		"interfaces": []interface{}{
+			map[string]interface{}{"type": "1", "main": "1", "available": "2", "error": "connection refused"},
+			map[string]interface{}{"type": "1", "main": "0", "available": "1", "error": ""},
+			map[string]interface{}{"type": "2", "main": "1", "available": "1", "error": ""},
+		},
+	}
+	check := func(want []string) {
+		t.Helper()
+		got := storeSeries(store, "0", "10084")
+		if len(got) != len(want) {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("got %s, want %s", got[i], want[i])
+			}
+		}
+	}
+	v := Version{Major: 6, Minor: 0}
+	c.outputHostStatus(v, host)
+	check([]string{
+		`zabbix_host_available{c="0",__endpoint__="web01",error="connection refused",type="agent"} 2`,
+		`zabbix_host_available{c="0",__endpoint__="web01",type="snmp"} 1`,
+		`zabbix_host_maintenance{c="0",__endpoint__="web01"} 1`,
+		`zabbix_host_monitored{c="0",__endpoint__="web01"} 1`,
+	})
+	host["status"], host["maintenance_status"] = "1", "0"
+	host["interfaces"].([]interface{})[0].(map[string]interface{})["available"] = "1"
+	host["interfaces"].([]interface{})[0].(map[string]interface{})["error"] = ""
+	c.outputHostStatus(v, host)
+	check([]string{
+		`zabbix_host_available{c="0",__endpoint__="web01",type="agent"} 1`,
+		`zabbix_host_available{c="0",__endpoint__="web01",type="snmp"} 1`,
+		`zabbix_host_maintenance{c="0",__endpoint__="web01"} 0`,
+		`zabbix_host_monitored{c="0",__endpoint__="web01"} 0`,
+	})
+
+	old := map[string]interface{}{"hostid": "10085", "status": "0", "maintenance_status": "0", "available": "1", "error": "", "ipmi_available": "0", "ipmi_error": ""}
+	c.HostIdHost.Store("10085", "db01")
+	c.outputHostStatus(Version{Major: 5, Minor: 0}, old)
+	got := storeSeries(store, "0", "10085")
+	want := []string{
+		`zabbix_host_available{c="0",__endpoint__="db01",type="agent"} 1`,
+		`zabbix_host_available{c="0",__endpoint__="db01",type="ipmi"} 0`,
+		`zabbix_host_maintenance{c="0",__endpoint__="db01"} 0`,
+		`zabbix_host_monitored{c="0",__endpoint__="db01"} 1`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestHostStatusParams(t *testing.T) {
+	params := map[string]interface{}{"output": []string{"hostid", "host"}, "selectInterfaces": []string{"ip", "main", "type"}}
+	hostStatusParams(Version{Major: 6, Minor: 0}, params)
+	if got := params["selectInterfaces"].([]string); len(got) != 5 {
+		t.Errorf("selectInterfaces %v", got)
+	}
+	params = map[string]interface{}{"output": []string{"hostid", "host"}}
+	hostStatusParams(Version{Major: 5, Minor: 0}, params)
+	if got := params["output"].([]string); !containsString(got, "snmp_available") || !containsString(got, "available") {
+		t.Errorf("output %v", got)
+	}
+}
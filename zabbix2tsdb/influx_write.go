@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type InfluxConfig struct {
+	Url string `yaml:"url"`
+	// v1
+	Database        string `yaml:"database"`
+	RetentionPolicy string `yaml:"retentionPolicy"`
+	User            string `yaml:"user"`
+	Password        string `yaml:"password"`
+	// v2, 配置了 Bucket 即使用 /api/v2/write
+	Org    string `yaml:"org"`
+	Bucket string `yaml:"bucket"`
+	Token  string `yaml:"token"`
+
+	BatchSize     int   `yaml:"batchSize"`
+	FlushInterval int64 `yaml:"flushInterval"`
+}
+
+// InfluxWriter 缓存转换为 line protocol 的数据, 达到 BatchSize 或 FlushInterval 时 gzip 压缩后写入 influxdb
+type InfluxWriter struct {
+	Locker      sync.Mutex
+	FlushLocker sync.Mutex
+	Config      InfluxConfig
+	WriteUrl    string
+	Client      *http.Client
+	Lines       []string
+	// Failed 累计写入失败的行数, dropped 为上次 Flush 之后写入失败的行数, 定时写入失败的也计入
+	Failed  int64
+	dropped int64
+	flushC  chan struct{}
+}
+
+func NewInfluxWriter(c InfluxConfig) *InfluxWriter {
+	query := url.Values{}
+	writeUrl := strings.TrimSuffix(c.Url, "/")
+	if c.Bucket != "" {
+		writeUrl += "/api/v2/write"
+		query.Set("org", c.Org)
+		query.Set("bucket", c.Bucket)
+	} else {
+		writeUrl += "/write"
+		query.Set("db", c.Database)
+		if c.RetentionPolicy != "" {
+			query.Set("rp", c.RetentionPolicy)
+		}
+	}
+	query.Set("precision", "ns")
+	if c.BatchSize <= 0 {
+		c.BatchSize = 5000
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = 10
+	}
+	return &InfluxWriter{
+		Config:   c,
+		WriteUrl: fmt.Sprintf("%s?%s", writeUrl, query.Encode()),
+		Client:   createHTTPClient(),
+		flushC:   make(chan struct{}, 1),
+	}
+}
+
+func (w *InfluxWriter) Write(_, _ string, samples []Sample) error {
+	w.Locker.Lock()
+	for _, s := range samples {
+		if line, ok := formatInfluxSample(s); ok {
+			w.Lines = append(w.Lines, line)
+		}
+	}
+	full := len(w.Lines) >= w.Config.BatchSize
+	w.Locker.Unlock()
+	if full {
+		select {
+		case w.flushC <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Run 定时写入, 缓存达到 BatchSize 时提前写入
+func (w *InfluxWriter) Run() {
+	ticker := time.NewTicker(time.Second * time.Duration(w.Config.FlushInterval))
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.flushC:
+		}
+		w.flush()
+	}
+}
+
+func (w *InfluxWriter) Flush() error {
+	w.flush()
+	w.FlushLocker.Lock()
+	dropped := w.dropped
+	w.dropped = 0
+	w.FlushLocker.Unlock()
+	if dropped > 0 {
+		return fmt.Errorf("dropped %d lines", dropped)
+	}
+	return nil
+}
+
+// flush 写入缓存的全部行
+func (w *InfluxWriter) flush() {
+	w.FlushLocker.Lock()
+	defer w.FlushLocker.Unlock()
+	w.Locker.Lock()
+	lines := w.Lines
+	w.Lines = nil
+	w.Locker.Unlock()
+	for start := 0; start < len(lines); start += w.Config.BatchSize {
+		end := start + w.Config.BatchSize
+		if end > len(lines) {
+			end = len(lines)
+		}
+		if er := w.send(lines[start:end]); er != nil {
+			w.Failed += int64(end - start)
+			w.dropped += int64(end - start)
+			_, _ = fmt.Fprintf(os.Stderr, "influxdb write failed, dropped %d lines (total %d):%s\n",
+				end-start, w.Failed, er)
+		}
+	}
+}
+
+func (w *InfluxWriter) send(lines []string) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	for _, line := range lines {
+		_, _ = gz.Write([]byte(line))
+		_, _ = gz.Write([]byte{'\n'})
+	}
+	if er := gz.Close(); er != nil {
+		return er
+	}
+	body := buf.Bytes()
+	return pushWithRetry(w.Client, func() (*http.Request, error) {
+		req, er := http.NewRequest("POST", w.WriteUrl, bytes.NewReader(body))
+		if er != nil {
+			return nil, er
+		}
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		if w.Config.Token != "" {
+			req.Header.Set("Authorization", "Token "+w.Config.Token)
+		} else if w.Config.User != "" {
+			req.SetBasicAuth(w.Config.User, w.Config.Password)
+		}
+		return req, nil
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestInfluxWriteUrl(t *testing.T) {
+	for _, tc := range []struct {
+		config InfluxConfig
+		want   string
+	}{
+		{InfluxConfig{Url: "http://influx:8086/", Database: "zabbix", RetentionPolicy: "30d"},
+			"http://influx:8086/write?db=zabbix&precision=ns&rp=30d"},
+		{InfluxConfig{Url: "http://influx:8086", Database: "zabbix"},
+			"http://influx:8086/write?db=zabbix&precision=ns"},
+		{InfluxConfig{Url: "http://influx:8086", Org: "ops", Bucket: "zabbix", Database: "ignored"},
+			"http://influx:8086/api/v2/write?bucket=zabbix&org=ops&precision=ns"},
+	} {
+		if got := NewInfluxWriter(tc.config).WriteUrl; got != tc.want {
+			t.Errorf("got %s, want %s", got, tc.want)
+		}
+	}
+}
+
+// TestInfluxWriter 按 BatchSize 分批 gzip 写入, 不支持的值不写入, 写入失败时 Flush 返回丢弃的行数
+func TestInfluxWriter(t *testing.T) {
+	var locker sync.Mutex
+	var batches [][]string
+	var auth []string
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		locker.Lock()
+		defer locker.Unlock()
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("unexpected encoding %q", r.Header.Get("Content-Encoding"))
+		}
+		gz, er := gzip.NewReader(r.Body)
+		if er != nil {
+			t.Fatal(er)
+		}
+		body, _ := io.ReadAll(gz)
+		batches = append(batches, strings.Split(strings.TrimSuffix(string(body), "\n"), "\n"))
+		auth = append(auth, r.Header.Get("Authorization"))
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	writer := NewInfluxWriter(InfluxConfig{Url: server.URL, Org: "ops", Bucket: "zabbix", Token: "secret", BatchSize: 2})
+	labels := []Label{{Name: "c", Value: "0"}, {Name: "__endpoint__", Value: "web01"}}
+	_ = writer.Write("0", "10084", []Sample{
+		{Name: "system_uptime", Labels: labels, Value: 1, Timestamp: 1690892492000},
+		{Name: "system_uptime", Labels: labels, Value: math.NaN(), Timestamp: 1690892493000},
+		{Name: "system_uptime", Labels: labels, Value: 2, Timestamp: 1690892494000},
+		{Name: "system_uptime", Labels: labels, Value: 3, Timestamp: 1690892495000},
+	})
+	if er := writer.Flush(); er != nil {
+		t.Fatal(er)
+	}
+	if len(batches) != 2 || len(batches[0]) != 2 || len(batches[1]) != 1 {
+		t.Fatalf("got batches %q, want 2+1 lines", batches)
+	}
+	if want := "system_uptime,c=0,__endpoint__=web01 {V}=1 1690892492000000000"; batches[0][0] != want {
+		t.Errorf("got %s, want %s", batches[0][0], want)
+	}
+	if auth[0] != "Token secret" {
+		t.Errorf("got authorization %q", auth[0])
+	}
+
+	status = http.StatusBadRequest
+	_ = writer.Write("0", "10084", []Sample{{Name: "system_uptime", Labels: labels, Value: 4}})
+	if er := writer.Flush(); er == nil || writer.Failed != 1 {
+		t.Errorf("flush should fail with 1 dropped line, got %v %d", er, writer.Failed)
+	}
+}
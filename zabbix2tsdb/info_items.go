@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	valueTypeFloat    = "0"
+	valueTypeChar     = "1"
+	valueTypeLog      = "2"
+	valueTypeUnsigned = "3"
+	valueTypeText     = "4"
+
+	// infoSuffix 字符及文本类型的item输出为 <metric>_info{value="..."} 1
+	infoSuffix     = "_info"
+	infoValueLabel = "value"
+)
+
+// Event 日志类型item的一条日志, 以JSON lines输出到 events 输出
+type Event struct {
+	Timestamp string            `json:"timestamp"`
+	Cluster   string            `json:"cluster"`
+	HostId    string            `json:"hostid"`
+	Host      string            `json:"host,omitempty"`
+	ItemId    string            `json:"itemid,omitempty"`
+	Key       string            `json:"key"`
+	Value     string            `json:"value"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	// Source, Severity, LogEventId 只有 windows eventlog 有值, 仅 backfill 的 history.get 返回
+	Source     string `json:"source,omitempty"`
+	Severity   string `json:"severity,omitempty"`
+	LogEventId string `json:"logeventid,omitempty"`
+}
+
+func numericItem(item map[string]interface{}) bool {
+	return item["value_type"] == valueTypeFloat || item["value_type"] == valueTypeUnsigned
+}
+
+func infoItem(item map[string]interface{}) bool {
+	return item["value_type"] == valueTypeChar || item["value_type"] == valueTypeText
+}
+
+// exported 数值类型, 匹配 --infoKeys 的字符及文本类型, 以及配置了 events 输出时的日志类型会输出
+func (c *Cluster) exported(item map[string]interface{}) bool {
+	switch {
+	case numericItem(item):
+		return true
+	case infoItem(item):
+		return matchAny(c.InfoKeys, fmt.Sprint(item["key_"]))
+	case item["value_type"] == valueTypeLog:
+		return sinks.HasEvents()
+	}
+	return false
+}
+
+// truncate 按字符截断, 避免label值过长
+func truncate(s string, max int) string {
+	if max <= 0 {
+		return s
+	}
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max])
+}
+
+// processInfo 输出 <metric>_info{value="..."} 1
+func (c *Cluster) processInfo(item map[string]interface{}, wait bool) error {
+	if !matchAny(c.InfoKeys, fmt.Sprint(item["key_"])) {
+		return nil
+	}
+	value, ok := item["lastvalue"]
+	if !ok {
+		return nil
+	}
+	// 映射的名称原样输出, 不加 _info 后缀
+	mapping := metricMappings.Match(fmt.Sprint(item["key_"]))
+	s, ok, er := c.itemSample(item, mapping)
+	if !ok || er != nil {
+		return er
+	}
+	if mapping == nil {
+		s.Name += infoSuffix
+	}
+	// 同名的label(如参数)被值覆盖
+	labels := make([]Label, 0, len(s.Labels)+1)
+	for _, l := range s.Labels {
+		if l.Name != infoValueLabel {
+			labels = append(labels, l)
+		}
+	}
+	s.Labels = append(labels, Label{Name: infoValueLabel, Value: truncate(fmt.Sprint(value), c.Config.InfoMaxLength)})
+	s.Value = 1
+	if c.Config.Metadata {
+		key, _ := ParseKey(fmt.Sprint(item["key_"]))
+		s.Meta = &Metadata{Type: metricTypeGauge, Help: itemHelp(item, key)}
+	}
+	return c.emitLabeled(item, s, wait)
+}
+
+// emitLabeled 输出值作为label的序列, 值变化后从exporter中删除之前的序列
+func (c *Cluster) emitLabeled(item map[string]interface{}, s Sample, wait bool) error {
+	hostId := item["hostid"].(string)
+	if v, ok := c.ItemStates.Load(item["itemid"]); ok {
+		state := v.(*itemState)
+		// 删除旧序列和输出新序列需要在同一个锁内, 避免并发时删除刚输出的序列
+		state.Locker.Lock()
+		defer state.Locker.Unlock()
+		if state.Labeled != nil && state.Labeled.Series() != s.Series() {
+			if er := c.delete(hostId, *state.Labeled, false); er != nil {
+				_, _ = fmt.Fprintln(os.Stderr, er.Error())
+			}
+		}
+		state.Labeled = &s
+	}
+	return c.output(hostId, wait, []Sample{s})
+}
+
+// processLog 日志类型的item以事件输出, 只写入 events 输出
+func (c *Cluster) processLog(item map[string]interface{}, wait bool) error {
+	value, ok := item["lastvalue"]
+	if !ok {
+		return nil
+	}
+	clock, er := strconv.ParseInt(fmt.Sprint(item["lastclock"]), 10, 64)
+	if er != nil || clock == 0 {
+		return nil
+	}
+	ns, _ := strconv.ParseInt(fmt.Sprint(item["ns"]), 10, 64)
+	hostId := item["hostid"].(string)
+	e := Event{
+		Timestamp: time.Unix(clock, ns).UTC().Format(time.RFC3339Nano),
+		Cluster:   c.Config.Cluster,
+		HostId:    hostId,
+		Key:       fmt.Sprint(item["key_"]),
+		Value:     fmt.Sprint(value),
+	}
+	if id, ok := item["itemid"].(string); ok {
+		e.ItemId = id
+	}
+	if hostName, ok := c.HostIdHost.Load(hostId); ok {
+		e.Host = hostName.(string)
+	}
+	for field, dst := range map[string]*string{"source": &e.Source, "severity": &e.Severity, "logeventid": &e.LogEventId} {
+		if v, ok := item[field].(string); ok && v != "" && v != "0" {
+			*dst = v
+		}
+	}
+	var hostLabels []Label
+	if labels, ok := c.HostIdLabels.Load(hostId); ok {
+		hostLabels = labels.([]Label)
+	}
+	for _, l := range mergeLabels(hostLabels, c.ItemLabelConfig.ItemLabels(item)) {
+		if e.Labels == nil {
+			e.Labels = map[string]string{}
+		}
+		e.Labels[l.Name] = l.Value
+	}
+	if wait {
+		return sinks.WriteEventsWait([]Event{e})
+	}
+	return sinks.WriteEvents([]Event{e})
+}
+
+// eventLines 每个事件一行JSON
+func eventLines(events []Event) ([]string, error) {
+	lines := make([]string, 0, len(events))
+	for _, e := range events {
+		data, er := json.Marshal(e)
+		if er != nil {
+			return nil, er
+		}
+		lines = append(lines, string(data))
+	}
+	return lines, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// eventRecorder 记录写入的事件
+type eventRecorder struct {
+	recordWriter
+	locker sync.Mutex
+	events []Event
+}
+
+func (e *eventRecorder) WriteEvents(events []Event) error {
+	e.locker.Lock()
+	e.events = append(e.events, events...)
+	e.locker.Unlock()
+	return nil
+}
+
+// TestProcessInfo 字符类型输出为 _info 序列, 值截断; 值变化后从exporter中删除旧序列
+func TestProcessInfo(t *testing.T) {
+	defer func(s Sinks) { sinks = s }(sinks)
+	store := NewMetricStore()
+	sinks = Sinks{NewSink("exporter", store, 0)}
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: "http://127.0.0.1", InfoKeys: []string{"system.uname", "agent.*"}, InfoMaxLength: 8})
+	if er != nil {
+		t.Fatal(er)
+	}
+	c.HostIdHost.Store("10084", "web01")
+	item := map[string]interface{}{"itemid": "23000", "hostid": "10084", "key_": "agent.version", "value_type": "1", "lastvalue": "6.0.20", "lastclock": "1690892492"}
+	for _, value := range []string{"6.0.20", "6.0.21 (revision 1a2b3c)"} {
+		item["lastvalue"] = value
+		if c.changed(item) {
+			if er := c.processMetric(item, false); er != nil {
+				t.Fatal(er)
+			}
+		}
+	}
+	got := storeSeries(store, "0", "10084")
+	want := []string{`agent_version_info{c="0",__endpoint__="web01",value="6.0.21 ("} 1`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// 未匹配 --infoKeys 的不输出
+	other := map[string]interface{}{"itemid": "23001", "hostid": "10084", "key_": "vfs.file.contents[/etc/motd]", "value_type": "4", "lastvalue": "hello", "lastclock": "1690892492"}
+	if er := c.processMetric(other, false); er != nil {
+		t.Fatal(er)
+	}
+	if got := storeSeries(store, "0", "10084"); len(got) != 1 {
+		t.Errorf("got %q, want only agent_version_info", got)
+	}
+}
+
+// TestProcessLog 日志类型只写入事件输出
+func TestProcessLog(t *testing.T) {
+	defer func(s Sinks) { sinks = s }(sinks)
+	data, events := &recordWriter{}, &eventRecorder{}
+	eventSink := NewSink("events", events, 0)
+	eventSink.Events = true
+	sinks = Sinks{NewSink("data", data, 0), eventSink}
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: "http://127.0.0.1", ItemLabels: []string{"tag:*"}})
+	if er != nil {
+		t.Fatal(er)
+	}
+	c.HostIdHost.Store("10084", "web01")
+	c.HostIdLabels.Store("10084", []Label{{Name: "env", Value: "prod"}})
+	item := map[string]interface{}{
+		"itemid": "23000", "hostid": "10084", "key_": "eventlog[System]", "value_type": "2",
+		"lastvalue": "The service started", "lastclock": "1690892492", "ns": "123000000",
+		"source": "Service Control Manager", "severity": "1", "logeventid": "7036",
+		"tags": []interface{}{map[string]interface{}{"tag": "component", "value": "os"}},
+	}
+	if !c.exported(item) {
+		t.Fatal("log item should be exported when there is an events sink")
+	}
+	if er := c.processMetric(item, false); er != nil {
+		t.Fatal(er)
+	}
+	if er := sinks.Flush(true); er != nil {
+		t.Fatal(er)
+	}
+	want := []Event{{
+		Timestamp: "2023-08-01T12:21:32.123Z", Cluster: "0", HostId: "10084", Host: "web01", ItemId: "23000",
+		Key: "eventlog[System]", Value: "The service started", Labels: map[string]string{"component": "os", "env": "prod"},
+		Source: "Service Control Manager", Severity: "1", LogEventId: "7036",
+	}}
+	if !reflect.DeepEqual(events.events, want) {
+		t.Errorf("got %+v, want %+v", events.events, want)
+	}
+	if len(data.samples) != 0 {
+		t.Errorf("data sink got %v", data.samples)
+	}
+	lines, _ := eventLines(want[:1])
+	if lines[0] != `{"timestamp":"2023-08-01T12:21:32.123Z","cluster":"0","hostid":"10084","host":"web01","itemid":"23000","key":"eventlog[System]","value":"The service started","labels":{"component":"os","env":"prod"},"source":"Service Control Manager","severity":"1","logeventid":"7036"}` {
+		t.Errorf("got %s", lines[0])
+	}
+}
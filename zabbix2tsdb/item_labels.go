@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ItemLabelConfig 由 --itemLabels 解析, 5.4+ 使用采集项标签, 之前的版本使用应用集
+type ItemLabelConfig struct {
+	Tags         map[string]struct{}
+	AllTags      bool
+	Applications bool
+	Prefix       string
+}
+
+// parseItemLabels 支持 tag:<name>, tag:*, application
+func parseItemLabels(items []string, prefix string) ItemLabelConfig {
+	c := ItemLabelConfig{Tags: map[string]struct{}{}, Prefix: prefix}
+	for _, item := range items {
+		switch {
+		case item == "tag:*":
+			c.AllTags = true
+		case strings.HasPrefix(item, "tag:") && len(item) > len("tag:"):
+			c.Tags[strings.TrimPrefix(item, "tag:")] = struct{}{}
+		case item == "application":
+			c.Applications = true
+		default:
+			_, _ = fmt.Fprintf(os.Stderr, "ignore invalid item label:%s\n", item)
+		}
+	}
+	return c
+}
+
+// ItemParams 在 item.get 请求中加入需要的 select 参数
+func (c ItemLabelConfig) ItemParams(v Version, params map[string]interface{}) {
+	if v.ItemTagsSupported() {
+		if c.AllTags || len(c.Tags) > 0 {
+			params["selectTags"] = []string{"tag", "value"}
+		}
+	} else if c.Applications {
+		params["selectApplications"] = []string{"name"}
+	}
+}
+
+// ItemLabels 从 item.get 的结果中提取label. 与内置label(如参数 p)同名的标签加上 tag_ 前缀,
+// 同一个标签名出现多次时, 值以 | 连接
+func (c ItemLabelConfig) ItemLabels(item map[string]interface{}) []Label {
+	values := map[string][]string{}
+	set := func(name, value string) {
+		name = labelName(c.Prefix, name)
+		if _, ok := reservedLabels[name]; ok {
+			name = "tag_" + name
+		}
+		if name == "" || value == "" {
+			return
+		}
+		values[name] = append(values[name], value)
+	}
+	tags, _ := item["tags"].([]interface{})
+	for _, t := range tags {
+		tag := t.(map[string]interface{})
+		name := fmt.Sprint(tag["tag"])
+		if _, ok := c.Tags[name]; ok || c.AllTags {
+			set(name, fmt.Sprint(tag["value"]))
+		}
+	}
+	if c.Applications {
+		applications, _ := item["applications"].([]interface{})
+		for _, a := range applications {
+			set("application", fmt.Sprint(a.(map[string]interface{})["name"]))
+		}
+	}
+	labels := make([]Label, 0, len(values))
+	for name, value := range values {
+		sort.Strings(value)
+		labels = append(labels, Label{Name: name, Value: strings.Join(value, "|")})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	return labels
+}
+
+// mergeLabels 合并主机与采集项的label, 同名时采集项的优先
+func mergeLabels(hostLabels, itemLabels []Label) []Label {
+	if len(itemLabels) == 0 {
+		return hostLabels
+	}
+	override := make(map[string]struct{}, len(itemLabels))
+	for _, l := range itemLabels {
+		override[l.Name] = struct{}{}
+	}
+	labels := make([]Label, 0, len(hostLabels)+len(itemLabels))
+	for _, l := range hostLabels {
+		if _, ok := override[l.Name]; !ok {
+			labels = append(labels, l)
+		}
+	}
+	labels = append(labels, itemLabels...)
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	return labels
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestItemLabels(t *testing.T) {
+	item := map[string]interface{}{
+		"tags": []interface{}{
+			map[string]interface{}{"tag": "component", "value": "network"},
+			map[string]interface{}{"tag": "component", "value": "cpu"},
+			map[string]interface{}{"tag": "p", "value": "reserved"},
+			map[string]interface{}{"tag": "interface", "value": "eth0"},
+			map[string]interface{}{"tag": "empty", "value": ""},
+		},
+		"applications": []interface{}{map[string]interface{}{"name": "Network"}, map[string]interface{}{"name": "CPU"}},
+	}
+	for _, tc := range []struct {
+		items  []string
+		prefix string
+		want   []Label
+	}{
+		{[]string{"tag:component"}, "", []Label{{Name: "component", Value: "cpu|network"}}},
+		// 与内置label同名的加上 tag_ 前缀, 空值不输出
+		{[]string{"tag:*"}, "", []Label{{Name: "component", Value: "cpu|network"}, {Name: "interface", Value: "eth0"}, {Name: "tag_p", Value: "reserved"}}},
+		{[]string{"application"}, "item_", []Label{{Name: "item_application", Value: "CPU|Network"}}},
+	} {
+		got := parseItemLabels(tc.items, tc.prefix).ItemLabels(item)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: got %v, want %v", tc.items, got, tc.want)
+		}
+	}
+}
+
+// TestItemLabelParams 5.4+ 查询采集项标签, 之前的版本查询应用集
+func TestItemLabelParams(t *testing.T) {
+	c := parseItemLabels([]string{"tag:*", "application"}, "")
+	params := map[string]interface{}{}
+	c.ItemParams(Version{Major: 6, Minor: 0}, params)
+	if _, ok := params["selectTags"]; !ok || params["selectApplications"] != nil {
+		t.Errorf("6.0 params %v", params)
+	}
+	params = map[string]interface{}{}
+	c.ItemParams(Version{Major: 5, Minor: 0}, params)
+	if _, ok := params["selectApplications"]; !ok || params["selectTags"] != nil {
+		t.Errorf("5.0 params %v", params)
+	}
+}
+
+// TestItemSampleLabels 采集项label与主机label同名时采集项的优先, 参数label优先于采集项label
+func TestItemSampleLabels(t *testing.T) {
+	defer func(r KeyRules, s Sinks) { keyRules, sinks = r, s }(keyRules, sinks)
+	keyRules = KeyRules{Exact: map[string]KeyRule{}}
+	keyRules.Add(builtinKeyRules)
+	store := NewMetricStore()
+	sinks = Sinks{NewSink("exporter", store, 0)}
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: "http://127.0.0.1", ItemLabels: []string{"tag:*"}})
+	if er != nil {
+		t.Fatal(er)
+	}
+	c.HostIdHost.Store("10084", "web01")
+	c.HostIdLabels.Store("10084", []Label{{Name: "component", Value: "host"}, {Name: "env", Value: "prod"}})
+	item := map[string]interface{}{
+		"key_": "net.if.in[eth0,bytes]", "hostid": "10084", "value_type": "3", "lastvalue": "1024", "lastclock": "1690892492",
+		"tags": []interface{}{
+			map[string]interface{}{"tag": "component", "value": "network"},
+			map[string]interface{}{"tag": "interface", "value": "from-tag"},
+		},
+	}
+	if er := c.processMetric(item, false); er != nil {
+		t.Fatal(er)
+	}
+	var got []string
+	for series := range store.Clusters["0"]["10084"] {
+		got = append(got, series)
+	}
+	want := []string{`net_if_in{c="0",__endpoint__="web01",component="network",env="prod",interface="eth0",mode="bytes"}`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
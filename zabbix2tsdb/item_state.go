@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// staleMetric lastclock 连续多个同步周期未更新的item输出该metric, 值为1, 恢复更新后输出一次0
+const staleMetric = "zabbix_item_stale"
+
+// itemState 记录item上次输出的 lastclock, 只输出 lastclock 有更新的数据
+type itemState struct {
+	HostId string
+	Key    string
+	Clock  string
+	// Unchanged lastclock 连续未更新的同步周期数
+	Unchanged int
+	// Labeled 上次输出的值作为label的序列(_info 序列及值映射的 state), 值变化时需要从exporter中删除.
+	// trapper 的每个连接并发处理, 由 Locker 保护
+	Labeled *Sample
+	Locker  sync.Mutex
+}
+
+func (s *itemState) stale(staleIntervals int) bool {
+	return staleIntervals > 0 && s.Unchanged >= staleIntervals
+}
+
+// changed 判断item的 lastclock 是否比上次输出的新, 同时更新stale状态.
+// 字符及文本类型每个周期都输出, 便于与其他数据关联; 只有数值类型会输出stale状态
+func (c *Cluster) changed(item map[string]interface{}) bool {
+	itemId, _ := item["itemid"].(string)
+	clock, _ := item["lastclock"].(string)
+	if itemId == "" || !c.exported(item) {
+		return true
+	}
+	v, ok := c.ItemStates.Load(itemId)
+	if !ok {
+		c.ItemStates.Store(itemId, &itemState{
+			HostId: fmt.Sprint(item["hostid"]), Key: fmt.Sprint(item["key_"]), Clock: clock})
+		return true
+	}
+	state := v.(*itemState)
+	if infoItem(item) {
+		return true
+	}
+	numeric := numericItem(item)
+	if clock == state.Clock {
+		state.Unchanged++
+		if numeric && state.stale(c.Config.StaleIntervals) {
+			c.outputStale(state, 1)
+		}
+		return false
+	}
+	if numeric && state.stale(c.Config.StaleIntervals) {
+		c.outputStale(state, 0)
+	}
+	state.Clock = clock
+	state.Unchanged = 0
+	return true
+}
+
+// outputStale 输出 zabbix_item_stale{c,__endpoint__,key}
+func (c *Cluster) outputStale(state *itemState, value float64) {
+	s := Sample{Name: staleMetric, Labels: []Label{{Name: "c", Value: c.Config.Cluster}}}
+	if hostName, ok := c.HostIdHost.Load(state.HostId); ok {
+		s.Labels = append(s.Labels, Label{Name: "__endpoint__", Value: c.endpoint(hostName.(string))})
+	}
+	s.Labels = append(s.Labels, Label{Name: "key", Value: state.Key})
+	s.Value, s.Timestamp = value, time.Now().UnixNano()/1e6
+	if er := c.emit(state.HostId, s); er != nil {
+		_, _ = fmt.Fprintln(os.Stderr, er.Error())
+	}
+}
+
+// retainItemStates 删除已不再同步的主机的item状态
+func (c *Cluster) retainItemStates(hostIds []string) {
+	alive := make(map[string]struct{}, len(hostIds))
+	for _, hostId := range hostIds {
+		alive[hostId] = struct{}{}
+	}
+	c.ItemStates.Range(func(k, v interface{}) bool {
+		if _, ok := alive[v.(*itemState).HostId]; !ok {
+			c.ItemStates.Delete(k)
+		}
+		return true
+	})
+}
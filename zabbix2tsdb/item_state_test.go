@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestChanged lastclock 未更新时不输出, 连续 --staleIntervals 个周期未更新输出stale, 恢复后输出一次0
+func TestChanged(t *testing.T) {
+	defer func(s Sinks) { sinks = s }(sinks)
+	store := NewMetricStore()
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: "http://127.0.0.1", StaleIntervals: 2})
+	if er != nil {
+		t.Fatal(er)
+	}
+	c.HostIdHost.Store("10084", "web01")
+	// stale 输出的序列
+	staled := func() []float64 {
+		var values []float64
+		for series, s := range store.Clusters["0"]["10084"] {
+			if s.Name != staleMetric || series != `zabbix_item_stale{c="0",__endpoint__="web01",key="system.uptime"}` {
+				t.Errorf("unexpected sample %s", series)
+			}
+			values = append(values, s.Value)
+		}
+		return values
+	}
+	item := map[string]interface{}{"itemid": "23000", "hostid": "10084", "key_": "system.uptime", "value_type": "3", "lastclock": "1690892492"}
+	for i, tc := range []struct {
+		clock   string
+		changed bool
+		stale   []float64
+	}{
+		{"1690892492", true, nil},
+		{"1690892492", false, nil},
+		{"1690892492", false, []float64{1}},
+		{"1690892492", false, []float64{1}},
+		{"1690892552", true, []float64{0}},
+		{"1690892552", false, nil},
+	} {
+		store = NewMetricStore()
+		sinks = Sinks{NewSink("exporter", store, 0)}
+		item["lastclock"] = tc.clock
+		if got := c.changed(item); got != tc.changed {
+			t.Errorf("cycle %d: changed %v, want %v", i, got, tc.changed)
+		}
+		if stale := staled(); len(stale) != len(tc.stale) || (len(stale) > 0 && stale[0] != tc.stale[0]) {
+			t.Errorf("cycle %d: stale %v, want %v", i, stale, tc.stale)
+		}
+	}
+
+	// 字符类型每个周期都输出, 不输出stale
+	info := map[string]interface{}{"itemid": "23001", "hostid": "10084", "key_": "system.uname", "value_type": "1", "lastclock": "1690892492"}
+	store = NewMetricStore()
+	sinks = Sinks{NewSink("exporter", store, 0)}
+	for i := 0; i < 3; i++ {
+		if !c.changed(info) {
+			t.Errorf("info item should always be output")
+		}
+	}
+	if stale := staled(); len(stale) != 0 {
+		t.Errorf("info item should not be stale: %v", stale)
+	}
+
+	c.retainItemStates([]string{"10085"})
+	if _, ok := c.ItemStates.Load("23000"); ok {
+		t.Error("item state of removed host should be deleted")
+	}
+}
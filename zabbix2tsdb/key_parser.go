@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// KeyParam key_ 中的一个参数, 数组参数如 [a,b] 保存在 Array 中
+type KeyParam struct {
+	Value   string
+	Array   []KeyParam
+	IsArray bool
+}
+
+// String 数组参数以逗号连接
+func (p KeyParam) String() string {
+	if !p.IsArray {
+		return p.Value
+	}
+	values := make([]string, len(p.Array))
+	for i, v := range p.Array {
+		values[i] = v.String()
+	}
+	return strings.Join(values, ",")
+}
+
+// Key 解析后的 key_, 如 net.if.in[eth0,bytes]
+type Key struct {
+	Name   string
+	Params []KeyParam
+	// RawParams 方括号内的原始内容
+	RawParams string
+}
+
+// ParseKey 按 zabbix item key 语法解析: 参数以逗号分隔, 支持双引号引用(\" 转义)以及数组参数
+func ParseKey(key string) (*Key, error) {
+	i := strings.IndexByte(key, '[')
+	if i < 0 {
+		if !isKeyName(key) {
+			return nil, fmt.Errorf("invalid key:%s", key)
+		}
+		return &Key{Name: key}, nil
+	}
+	if !isKeyName(key[:i]) || !strings.HasSuffix(key, "]") {
+		return nil, fmt.Errorf("invalid key:%s", key)
+	}
+	k := &Key{Name: key[:i], RawParams: key[i+1 : len(key)-1]}
+	p := keyParser{s: key, pos: i + 1}
+	params, er := p.params(']')
+	if er != nil {
+		return nil, fmt.Errorf("invalid key:%s, %s", key, er)
+	}
+	if p.pos != len(key) {
+		return nil, fmt.Errorf("invalid key:%s, unexpected data after ']'", key)
+	}
+	k.Params = params
+	return k, nil
+}
+
+func isKeyName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+type keyParser struct {
+	s   string
+	pos int
+}
+
+// params 解析到 end 为止的参数列表, 结束后 pos 指向 end 之后
+func (p *keyParser) params(end byte) ([]KeyParam, error) {
+	var params []KeyParam
+	for {
+		param, er := p.param(end)
+		if er != nil {
+			return nil, er
+		}
+		params = append(params, param)
+		if p.pos >= len(p.s) {
+			return nil, fmt.Errorf("missing '%c'", end)
+		}
+		c := p.s[p.pos]
+		p.pos++
+		if c == end {
+			return params, nil
+		}
+		if c != ',' {
+			return nil, fmt.Errorf("unexpected '%c' at %d", c, p.pos-1)
+		}
+	}
+}
+
+func (p *keyParser) param(end byte) (KeyParam, error) {
+	// 参数前的空格忽略
+	p.skipSpaces()
+	if p.pos >= len(p.s) {
+		return KeyParam{}, fmt.Errorf("missing '%c'", end)
+	}
+	switch p.s[p.pos] {
+	case '"':
+		p.pos++
+		var b strings.Builder
+		for p.pos < len(p.s) {
+			c := p.s[p.pos]
+			if c == '\\' && p.pos+1 < len(p.s) && p.s[p.pos+1] == '"' {
+				b.WriteByte('"')
+				p.pos += 2
+				continue
+			}
+			p.pos++
+			if c == '"' {
+				p.skipSpaces()
+				return KeyParam{Value: b.String()}, nil
+			}
+			b.WriteByte(c)
+		}
+		return KeyParam{}, fmt.Errorf("unterminated quoted parameter")
+	case '[':
+		p.pos++
+		array, er := p.params(']')
+		if er != nil {
+			return KeyParam{}, er
+		}
+		p.skipSpaces()
+		return KeyParam{Array: array, IsArray: true}, nil
+	}
+	start := p.pos
+	for p.pos < len(p.s) && p.s[p.pos] != ',' && p.s[p.pos] != end {
+		p.pos++
+	}
+	return KeyParam{Value: p.s[start:p.pos]}, nil
+}
+
+func (p *keyParser) skipSpaces() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
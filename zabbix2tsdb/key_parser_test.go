@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseKey(t *testing.T) {
+	for _, tc := range []struct {
+		key    string
+		name   string
+		params []string
+		raw    string
+	}{
+		{"system.uptime", "system.uptime", nil, ""},
+		{"net.if.in[eth0,bytes]", "net.if.in", []string{"eth0", "bytes"}, "eth0,bytes"},
+		{"system.cpu.util[,idle]", "system.cpu.util", []string{"", "idle"}, ",idle"},
+		{"custom[]", "custom", []string{""}, ""},
+		{"custom[a,,]", "custom", []string{"a", "", ""}, "a,,"},
+		{`vfs.fs.size["C:\data, x",pfree]`, "vfs.fs.size", []string{`C:\data, x`, "pfree"}, `"C:\data, x",pfree`},
+		{`custom["a\"b",c]`, "custom", []string{`a"b`, "c"}, `"a\"b",c`},
+		{`custom["a]b"]`, "custom", []string{"a]b"}, `"a]b"`},
+		{`custom[ a, "b" ,c ]`, "custom", []string{"a", "b", "c "}, ` a, "b" ,c `},
+		{"custom[[a,b],c]", "custom", []string{"a,b", "c"}, "[a,b],c"},
+		{`custom[[a,"b,c"],[]]`, "custom", []string{"a,b,c", ""}, `[a,"b,c"],[]`},
+		{"proc.num[,,run]", "proc.num", []string{"", "", "run"}, ",,run"},
+	} {
+		k, er := ParseKey(tc.key)
+		if er != nil {
+			t.Errorf("ParseKey(%s) failed:%s", tc.key, er)
+			continue
+		}
+		var params []string
+		for _, p := range k.Params {
+			params = append(params, p.String())
+		}
+		if k.Name != tc.name || !reflect.DeepEqual(params, tc.params) || k.RawParams != tc.raw {
+			t.Errorf("ParseKey(%s) = %s %q %q, want %s %q %q", tc.key, k.Name, params, k.RawParams, tc.name, tc.params, tc.raw)
+		}
+	}
+}
+
+func TestParseKeyArray(t *testing.T) {
+	k, er := ParseKey(`custom[[a,"b,c"],d]`)
+	if er != nil {
+		t.Fatal(er)
+	}
+	want := []KeyParam{
+		{Array: []KeyParam{{Value: "a"}, {Value: "b,c"}}, IsArray: true},
+		{Value: "d"},
+	}
+	if !reflect.DeepEqual(k.Params, want) {
+		t.Errorf("got %+v, want %+v", k.Params, want)
+	}
+}
+
+func TestParseKeyInvalid(t *testing.T) {
+	for _, key := range []string{
+		"",
+		"bad key",
+		"custom[a",
+		`custom["a]`,
+		"custom[a]b",
+		`custom["a"b]`,
+		"custom[[a,b]",
+		"[a]",
+		"custom(a)",
+	} {
+		if k, er := ParseKey(key); er == nil {
+			t.Errorf("ParseKey(%q) = %+v, want error", key, k)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// KeyRule 将 key_ 中的位置参数映射为label, 如 net.if.in[eth0,bytes] -> interface="eth0",mode="bytes".
+// Params 中为空的位置不输出
+type KeyRule struct {
+	// Key key_ 的名称(不含参数), 支持通配符(*)
+	Key    string   `yaml:"key"`
+	Params []string `yaml:"params"`
+}
+
+type KeyRules struct {
+	// Exact 不含通配符的规则, 通配符规则按配置顺序匹配
+	Exact    map[string]KeyRule
+	Wildcard []KeyRule
+}
+
+// builtinKeyRules zabbix agent 常用key的参数名称
+var builtinKeyRules = []KeyRule{
+	{Key: "net.if.in", Params: []string{"interface", "mode"}},
+	{Key: "net.if.out", Params: []string{"interface", "mode"}},
+	{Key: "net.if.total", Params: []string{"interface", "mode"}},
+	{Key: "net.if.collisions", Params: []string{"interface"}},
+	{Key: "net.tcp.listen", Params: []string{"port"}},
+	{Key: "net.tcp.port", Params: []string{"ip", "port"}},
+	{Key: "net.tcp.service", Params: []string{"service", "ip", "port"}},
+	{Key: "net.tcp.service.perf", Params: []string{"service", "ip", "port"}},
+	{Key: "net.udp.listen", Params: []string{"port"}},
+	{Key: "net.udp.service", Params: []string{"service", "ip", "port"}},
+	{Key: "net.udp.service.perf", Params: []string{"service", "ip", "port"}},
+	{Key: "proc.cpu.util", Params: []string{"name", "user", "type", "cmdline", "mode", "zone"}},
+	{Key: "proc.mem", Params: []string{"name", "user", "mode", "cmdline", "memtype"}},
+	{Key: "proc.num", Params: []string{"name", "user", "state", "cmdline", "zone"}},
+	{Key: "sensor", Params: []string{"device", "sensor", "mode"}},
+	{Key: "system.cpu.load", Params: []string{"cpu", "mode"}},
+	{Key: "system.cpu.num", Params: []string{"type"}},
+	{Key: "system.cpu.util", Params: []string{"cpu", "type", "mode", "logical_or_physical"}},
+	{Key: "system.hw.cpu", Params: []string{"cpu", "info"}},
+	{Key: "system.stat", Params: []string{"resource", "type"}},
+	{Key: "system.swap.in", Params: []string{"device", "type"}},
+	{Key: "system.swap.out", Params: []string{"device", "type"}},
+	{Key: "system.swap.size", Params: []string{"device", "type"}},
+	{Key: "vfs.dev.read", Params: []string{"device", "type", "mode"}},
+	{Key: "vfs.dev.write", Params: []string{"device", "type", "mode"}},
+	{Key: "vfs.file.size", Params: []string{"file", "mode"}},
+	{Key: "vfs.fs.inode", Params: []string{"fsname", "mode"}},
+	{Key: "vfs.fs.size", Params: []string{"fsname", "mode"}},
+	{Key: "vm.memory.size", Params: []string{"mode"}},
+	{Key: "icmpping", Params: []string{"target", "packets", "interval", "size", "timeout"}},
+	{Key: "icmppingloss", Params: []string{"target", "packets", "interval", "size", "timeout"}},
+	{Key: "icmppingsec", Params: []string{"target", "packets", "interval", "size", "timeout", "mode"}},
+	{Key: "perf_counter", Params: []string{"counter", "interval"}},
+	{Key: "perf_counter_en", Params: []string{"counter", "interval"}},
+	{Key: "service.info", Params: []string{"service", "param"}},
+}
+
+var keyRules = KeyRules{Exact: map[string]KeyRule{}}
+
+// Add 后添加的规则覆盖之前同名的规则
+func (r *KeyRules) Add(rules []KeyRule) {
+	for _, rule := range rules {
+		rule.Params = paramNames("key rule "+rule.Key, rule.Params)
+		if strings.Contains(rule.Key, "*") {
+			r.Wildcard = append(r.Wildcard, rule)
+		} else {
+			r.Exact[rule.Key] = rule
+		}
+	}
+}
+
+// paramNames 转换为合法的label名称, 保留的label名称忽略(输出为空)
+func paramNames(source string, params []string) []string {
+	valid := params[:0:0]
+	for _, name := range params {
+		if name != "" {
+			name = labelName("", name)
+		}
+		if _, ok := reservedLabels[name]; ok {
+			_, _ = fmt.Fprintf(os.Stderr, "%s: label %s is reserved, ignored\n", source, name)
+			name = ""
+		}
+		valid = append(valid, name)
+	}
+	return valid
+}
+
+func loadKeyRules(file string) ([]KeyRule, error) {
+	data, er := ioutil.ReadFile(file)
+	if er != nil {
+		return nil, er
+	}
+	var rules []KeyRule
+	if er := yaml.Unmarshal(data, &rules); er != nil {
+		return nil, fmt.Errorf("parse %s failed:%s", file, er)
+	}
+	return rules, nil
+}
+
+func (r *KeyRules) Match(name string) (KeyRule, bool) {
+	if rule, ok := r.Exact[name]; ok {
+		return rule, true
+	}
+	for _, rule := range r.Wildcard {
+		if ok, _ := path.Match(rule.Key, name); ok {
+			return rule, true
+		}
+	}
+	return KeyRule{}, false
+}
+
+// ParamLabels 按规则将参数转换为label, 规则中没有名称的位置输出为 p<位置>.
+// macros 为自动发现原型中各位置的宏名称, 优先于规则.
+// 没有匹配到规则且没有宏时返回 false, 由调用方按原方式输出 p
+func (r *KeyRules) ParamLabels(key *Key, macros []string) ([]Label, bool) {
+	rule, ok := r.Match(key.Name)
+	return rule.paramLabels(key, ok, macros)
+}
+
+// paramLabels ok 为 false 时rule为空, 只按宏及位置输出
+func (rule KeyRule) paramLabels(key *Key, ok bool, macros []string) ([]Label, bool) {
+	if !ok && len(macros) == 0 {
+		return nil, false
+	}
+	var labels []Label
+	for i, param := range key.Params {
+		value := param.String()
+		if value == "" {
+			continue
+		}
+		name := fmt.Sprintf("p%d", i+1)
+		switch {
+		case i < len(macros) && macros[i] != "":
+			// 自动发现的宏优先于规则
+			name = macros[i]
+		case ok && i < len(rule.Params):
+			if rule.Params[i] == "" {
+				continue
+			}
+			name = rule.Params[i]
+		}
+		labels = append(labels, Label{Name: name, Value: value})
+	}
+	return labels, true
+}
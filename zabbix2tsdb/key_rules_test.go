@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeyRulesParamLabels(t *testing.T) {
+	rules := KeyRules{Exact: map[string]KeyRule{}}
+	rules.Add(builtinKeyRules)
+	rules.Add([]KeyRule{
+		{Key: "custom.*", Params: []string{"name", "", "type"}},
+		{Key: "custom.exact", Params: []string{"exact"}},
+		{Key: "reserved", Params: []string{"p", "c", "my-label"}},
+		// 后添加的规则覆盖同名规则
+		{Key: "vm.memory.size", Params: []string{"kind"}},
+	})
+	for _, tc := range []struct {
+		key    string
+		macros []string
+		want   []Label
+		ok     bool
+	}{
+		{"net.if.in[eth0,bytes]", nil, []Label{{Name: "interface", Value: "eth0"}, {Name: "mode", Value: "bytes"}}, true},
+		// 空参数不输出
+		{"system.cpu.util[,idle]", nil, []Label{{Name: "type", Value: "idle"}}, true},
+		// 规则中没有的位置输出为 p<位置>
+		{"vm.memory.size[available,x]", nil, []Label{{Name: "kind", Value: "available"}, {Name: "p2", Value: "x"}}, true},
+		// 通配符规则, 名称为空的位置不输出
+		{"custom.metric[a,b,c,d]", nil, []Label{{Name: "name", Value: "a"}, {Name: "type", Value: "c"}, {Name: "p4", Value: "d"}}, true},
+		// 不含通配符的规则优先
+		{"custom.exact[a]", nil, []Label{{Name: "exact", Value: "a"}}, true},
+		// 保留的label名称忽略, 名称转换为合法的label
+		{"reserved[a,b,c]", nil, []Label{{Name: "my_label", Value: "c"}}, true},
+		{`vfs.fs.size["/data, x",pfree]`, nil, []Label{{Name: "fsname", Value: "/data, x"}, {Name: "mode", Value: "pfree"}}, true},
+		// 自动发现的宏优先于规则
+		{"vfs.fs.size[/,pfree]", []string{"fsname_macro", ""}, []Label{{Name: "fsname_macro", Value: "/"}, {Name: "mode", Value: "pfree"}}, true},
+		{"unknown.key[a]", []string{"macro"}, []Label{{Name: "macro", Value: "a"}}, true},
+		// 没有规则及宏时由调用方输出 p
+		{"unknown.key[a,b]", nil, nil, false},
+	} {
+		key, er := ParseKey(tc.key)
+		if er != nil {
+			t.Fatal(er)
+		}
+		got, ok := rules.ParamLabels(key, tc.macros)
+		if ok != tc.ok || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParamLabels(%s) = %v %v, want %v %v", tc.key, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+// TestItemSampleParams 未开启 --builtinKeyRules 时, 没有规则的key仍将全部参数输出为 p
+func TestItemSampleParams(t *testing.T) {
+	defer func(r KeyRules) { keyRules = r }(keyRules)
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: "http://127.0.0.1"})
+	if er != nil {
+		t.Fatal(er)
+	}
+	c.HostIdHost.Store("10084", "web01")
+	item := map[string]interface{}{"key_": "system.cpu.util[,idle]", "hostid": "10084", "lastclock": "1690892492"}
+	for _, tc := range []struct {
+		rules []KeyRule
+		want  string
+	}{
+		{nil, `system_cpu_util{c="0",__endpoint__="web01",p=",idle"}`},
+		{builtinKeyRules, `system_cpu_util{c="0",__endpoint__="web01",type="idle"}`},
+	} {
+		keyRules = KeyRules{Exact: map[string]KeyRule{}}
+		keyRules.Add(tc.rules)
+		s, ok, er := c.itemSample(item, nil)
+		if !ok || er != nil {
+			t.Fatalf("itemSample failed: %v %v", ok, er)
+		}
+		if got := s.Series(); got != tc.want {
+			t.Errorf("got %s, want %s", got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// LldMacroPattern 整个参数为一个LLD宏, 如 {#FSNAME}
+var LldMacroPattern = regexp.MustCompile(`^\{#([A-Za-z0-9_.]+)\}$`)
+
+// lldParamNames 按位置返回原型 key_ 参数中的LLD宏对应的label名称, 不是宏的位置为空.
+// 没有任何位置是宏时返回nil, 按普通item输出
+func lldParamNames(prototypeKey string) []string {
+	key, er := ParseKey(prototypeKey)
+	if er != nil {
+		return nil
+	}
+	found := false
+	names := make([]string, len(key.Params))
+	for i, param := range key.Params {
+		m := LldMacroPattern.FindStringSubmatch(param.Value)
+		if param.IsArray || m == nil {
+			continue
+		}
+		name := labelName("", strings.ToLower(m[1]))
+		if _, ok := reservedLabels[name]; ok {
+			continue
+		}
+		names[i] = name
+		found = true
+	}
+	if !found {
+		return nil
+	}
+	return names
+}
+
+// lldParams 开启 --lldLabels 时在 item.get 请求中查询自动发现的原型
+func (c *Cluster) lldParams(params map[string]interface{}) {
+	if c.Config.LldLabels {
+		params["selectItemDiscovery"] = []string{"parent_itemid"}
+	}
+}
+
+// prototypeId 自动发现的item返回原型的itemid, 其他item的 itemDiscovery 为空数组
+func prototypeId(item map[string]interface{}) string {
+	discovery, ok := item["itemDiscovery"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	id, _ := discovery["parent_itemid"].(string)
+	return id
+}
+
+// loadPrototypes 查询尚未缓存的原型, 缓存原型 key_ 中各位置的宏
+func (z *ZabbixApi) loadPrototypes(ctx context.Context, items []interface{}) {
+	if !z.Cluster.Config.LldLabels {
+		return
+	}
+	var ids []string
+	seen := map[string]struct{}{}
+	for _, v := range items {
+		id := prototypeId(v.(map[string]interface{}))
+		if id == "" {
+			continue
+		}
+		if _, ok := z.Cluster.Prototypes.Load(id); ok {
+			continue
+		}
+		if _, ok := seen[id]; !ok {
+			seen[id] = struct{}{}
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	result, er := z.request(ctx, "itemprototype.get", map[string]interface{}{
+		"output":  []string{"itemid", "key_"},
+		"itemids": ids,
+	})
+	if er != nil {
+		// 查询失败时按普通item输出, 下次再查询
+		_, _ = fmt.Fprintf(os.Stderr, "cluster %s update item prototypes failed:%s\n", z.Cluster.Config.Cluster, er)
+		return
+	}
+	prototypes, _ := result.([]interface{})
+	for _, v := range prototypes {
+		prototype := v.(map[string]interface{})
+		z.Cluster.Prototypes.Store(fmt.Sprint(prototype["itemid"]), lldParamNames(fmt.Sprint(prototype["key_"])))
+	}
+}
+
+// lldNames item对应原型的宏名称, 非自动发现的item返回nil
+func (c *Cluster) lldNames(item map[string]interface{}) []string {
+	id := prototypeId(item)
+	if id == "" {
+		return nil
+	}
+	if names, ok := c.Prototypes.Load(id); ok {
+		return names.([]string)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestLldParamNames 只有整个参数为LLD宏时使用宏名称
+func TestLldParamNames(t *testing.T) {
+	for _, tc := range []struct {
+		key  string
+		want []string
+	}{
+		{"vfs.fs.size[{#FSNAME},pfree]", []string{"fsname", ""}},
+		{"net.if.in[{#IFNAME},{#MODE}]", []string{"ifname", "mode"}},
+		{`net.if.in["{#IFNAME}",bytes]`, []string{"ifname", ""}},
+		{"custom.metric[{#FS.NAME},prefix_{#X},[{#Y}],{#C}]", []string{"fs_name", "", "", ""}},
+		// 宏只是参数的一部分时不作为label
+		{"custom.if[{#IFNAME}_x,foo]", nil},
+		{"custom.if[{#IFNAME}_x,{#DEV}]", []string{"", "dev"}},
+		{"system.uptime", nil},
+		{"custom[[{#A}],b]", nil},
+	} {
+		if got := lldParamNames(tc.key); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("lldParamNames(%s) = %q, want %q", tc.key, got, tc.want)
+		}
+	}
+}
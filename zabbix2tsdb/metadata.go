@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// zabbix 预处理步骤类型
+	preprocessingChangePerSec = "9"
+	preprocessingSimpleChange = "10"
+
+	// valueMapLabel 开启 --valueMapLabels 时值映射的结果
+	valueMapLabel = "state"
+)
+
+// Metadata metric的类型, 单位及说明, 由 --metadata 从item定义生成, 在exporter中输出为 # HELP, # TYPE, # UNIT
+type Metadata struct {
+	Type string
+	Help string
+	Unit string
+}
+
+// unitConversion zabbix 单位 -> 基本单位的metric后缀及换算系数
+type unitConversion struct {
+	Suffix string
+	Scale  float64
+}
+
+// zabbixUnits 只转换能确定基本单位的, 其他单位保持原名称
+var zabbixUnits = map[string]unitConversion{
+	"B":        {"bytes", 1},
+	"Bps":      {"bytes_per_second", 1},
+	"bps":      {"bits_per_second", 1},
+	"s":        {"seconds", 1},
+	"ms":       {"seconds", 1e-3},
+	"uptime":   {"seconds", 1},
+	"unixtime": {"timestamp_seconds", 1},
+	"%":        {"ratio", 1e-2},
+}
+
+// builtinCounterKeys 没有"每秒变化"或"简单变化"预处理时为单调递增计数器的 zabbix agent key
+var builtinCounterKeys = []string{
+	"net.if.in", "net.if.out", "net.if.total",
+	"vfs.dev.read", "vfs.dev.write",
+	"system.cpu.switches", "system.cpu.intr",
+	"system.swap.in", "system.swap.out",
+}
+
+var itemNameParamPattern = regexp.MustCompile(`\$[1-9]`)
+
+// metadataParams 开启 --metadata 时在 item.get 请求中加入item定义, 值映射及预处理步骤
+func (c *Cluster) metadataParams(v Version, params map[string]interface{}) {
+	if !c.Config.Metadata && !c.Config.ValueMapLabels {
+		return
+	}
+	output := params["output"].([]string)
+	if c.Config.Metadata {
+		output = append(output, "name", "units", "description")
+		params["selectPreprocessing"] = []string{"type", "params"}
+	}
+	if c.Config.ValueMapLabels {
+		if v.ItemValueMaps() {
+			params["selectValueMap"] = []string{"mappings"}
+		} else {
+			output = append(output, "valuemapid")
+		}
+	}
+	params["output"] = output
+}
+
+// ItemValueMaps 5.4 起值映射属于模板或主机, 通过 item.get 的 selectValueMap 查询, 之前为全局的 valuemap.get
+func (v Version) ItemValueMaps() bool {
+	return v.AtLeast(5, 4)
+}
+
+// loadValueMaps 5.4 之前查询尚未缓存的值映射
+func (z *ZabbixApi) loadValueMaps(ctx context.Context, items []interface{}) {
+	if !z.Cluster.Config.ValueMapLabels || z.Version.ItemValueMaps() {
+		return
+	}
+	var ids []string
+	seen := map[string]struct{}{}
+	for _, v := range items {
+		id, _ := v.(map[string]interface{})["valuemapid"].(string)
+		if id == "" || id == "0" {
+			continue
+		}
+		if _, ok := z.Cluster.ValueMaps.Load(id); ok {
+			continue
+		}
+		if _, ok := seen[id]; !ok {
+			seen[id] = struct{}{}
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	result, er := z.request(ctx, "valuemap.get", map[string]interface{}{
+		"output":         []string{"valuemapid"},
+		"valuemapids":    ids,
+		"selectMappings": []string{"value", "newvalue"},
+	})
+	if er != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "cluster %s update value maps failed:%s\n", z.Cluster.Config.Cluster, er)
+		return
+	}
+	valueMaps, _ := result.([]interface{})
+	for _, v := range valueMaps {
+		valueMap := v.(map[string]interface{})
+		z.Cluster.ValueMaps.Store(fmt.Sprint(valueMap["valuemapid"]), parseMappings(valueMap["mappings"]))
+	}
+}
+
+// parseMappings 只使用精确匹配的映射(6.0 起支持的范围, 正则等类型忽略)
+func parseMappings(v interface{}) map[string]string {
+	res := map[string]string{}
+	mappings, _ := v.([]interface{})
+	for _, m := range mappings {
+		mapping := m.(map[string]interface{})
+		if t, ok := mapping["type"]; ok && t != "0" {
+			continue
+		}
+		res[fmt.Sprint(mapping["value"])] = fmt.Sprint(mapping["newvalue"])
+	}
+	return res
+}
+
+// mappedValue 返回值映射的结果, 没有映射时返回空
+func (c *Cluster) mappedValue(item map[string]interface{}, value string) string {
+	var mappings map[string]string
+	if valueMap, ok := item["valuemap"].(map[string]interface{}); ok {
+		mappings = parseMappings(valueMap["mappings"])
+	} else if id, ok := item["valuemapid"].(string); ok {
+		if v, ok := c.ValueMaps.Load(id); ok {
+			mappings = v.(map[string]string)
+		}
+	}
+	return mappings[value]
+}
+
+func hasPreprocessing(item map[string]interface{}, types ...string) bool {
+	steps, _ := item["preprocessing"].([]interface{})
+	for _, s := range steps {
+		step := s.(map[string]interface{})
+		for _, t := range types {
+			if fmt.Sprint(step["type"]) == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// counterItem 没有变化率预处理且为已知计数器或匹配 --counterKeys 的item
+func (c *Cluster) counterItem(item map[string]interface{}, key *Key) bool {
+	if hasPreprocessing(item, preprocessingChangePerSec, preprocessingSimpleChange) {
+		return false
+	}
+	name := fmt.Sprint(item["key_"])
+	if key != nil {
+		name = key.Name
+		for _, k := range builtinCounterKeys {
+			if k == key.Name {
+				return true
+			}
+		}
+	}
+	return matchAny(c.CounterKeys, name) || matchAny(c.CounterKeys, fmt.Sprint(item["key_"]))
+}
+
+// itemHelp item名称中的 $1..$9 替换为key参数, 有描述时附加描述的第一行
+func itemHelp(item map[string]interface{}, key *Key) string {
+	help, _ := item["name"].(string)
+	if key != nil {
+		help = itemNameParamPattern.ReplaceAllStringFunc(help, func(s string) string {
+			i, _ := strconv.Atoi(s[1:])
+			if i <= len(key.Params) {
+				return key.Params[i-1].String()
+			}
+			return ""
+		})
+	}
+	if description, _ := item["description"].(string); description != "" {
+		help = fmt.Sprintf("%s: %s", help, strings.SplitN(strings.TrimSpace(description), "\n", 2)[0])
+	}
+	return help
+}
+
+// applyMetadata 按item定义设置类型, 说明, 单位, 单位不是基本单位时换算值, 并按prometheus惯例修改metric名称:
+// <metric>_<单位>, counter 以 _total 结尾. trends 数据不是计数器. mapped 为 --metricNames 映射的名称, 不修改名称和值
+func (c *Cluster) applyMetadata(item map[string]interface{}, s *Sample, trends, mapped bool) float64 {
+	if !c.Config.Metadata {
+		return 1
+	}
+	key, _ := ParseKey(fmt.Sprint(item["key_"]))
+	meta := &Metadata{Type: metricTypeGauge, Help: itemHelp(item, key)}
+	if !trends && c.counterItem(item, key) {
+		meta.Type = metricTypeCounter
+	}
+	s.Meta = meta
+	if mapped {
+		return 1
+	}
+	scale := 1.0
+	if conversion, ok := zabbixUnits[fmt.Sprint(item["units"])]; ok {
+		meta.Unit = conversion.Suffix
+		scale = conversion.Scale
+		if !strings.HasSuffix(s.Name, "_"+conversion.Suffix) {
+			s.Name += "_" + conversion.Suffix
+		}
+	}
+	if meta.Type == metricTypeCounter && !strings.HasSuffix(s.Name, "_total") {
+		s.Name += "_total"
+	}
+	return scale
+}
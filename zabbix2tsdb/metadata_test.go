@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyMetadata(t *testing.T) {
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: "http://127.0.0.1", Metadata: true, CounterKeys: []string{"app.requests"}})
+	if er != nil {
+		t.Fatal(er)
+	}
+	changePerSec := []interface{}{map[string]interface{}{"type": preprocessingChangePerSec, "params": ""}}
+	for _, tc := range []struct {
+		item   map[string]interface{}
+		name   string
+		trends bool
+		mapped bool
+		want   string
+		meta   Metadata
+		scale  float64
+	}{
+		{map[string]interface{}{"key_": "net.if.in[eth0]", "units": "bps", "name": "Interface $1: Bits received"}, "net_if_in", false, false,
+			"net_if_in_bits_per_second_total", Metadata{Type: metricTypeCounter, Help: "Interface eth0: Bits received", Unit: "bits_per_second"}, 1},
+		// 有"每秒变化"预处理时为 gauge
+		{map[string]interface{}{"key_": "net.if.in[eth0]", "units": "bps", "name": "Bits", "preprocessing": changePerSec}, "net_if_in", false, false,
+			"net_if_in_bits_per_second", Metadata{Type: metricTypeGauge, Help: "Bits", Unit: "bits_per_second"}, 1},
+		// trends 的 _min/_avg/_max 不是counter
+		{map[string]interface{}{"key_": "net.if.in[eth0]", "units": "bps", "name": "Bits"}, "net_if_in_avg", true, false,
+			"net_if_in_avg_bits_per_second", Metadata{Type: metricTypeGauge, Help: "Bits", Unit: "bits_per_second"}, 1},
+		{map[string]interface{}{"key_": "system.cpu.util[,idle]", "units": "%", "name": "CPU idle time", "description": "The time the CPU has spent doing nothing.\nSecond line"}, "system_cpu_util", false, false,
+			"system_cpu_util_ratio", Metadata{Type: metricTypeGauge, Help: "CPU idle time: The time the CPU has spent doing nothing.", Unit: "ratio"}, 0.01},
+		{map[string]interface{}{"key_": "icmppingsec", "units": "ms", "name": "Ping"}, "icmppingsec", false, false,
+			"icmppingsec_seconds", Metadata{Type: metricTypeGauge, Help: "Ping", Unit: "seconds"}, 1e-3},
+		{map[string]interface{}{"key_": "app.requests", "units": "rps", "name": "Requests"}, "app_requests", false, false,
+			"app_requests_total", Metadata{Type: metricTypeCounter, Help: "Requests"}, 1},
+		// 已有单位后缀时不重复添加
+		{map[string]interface{}{"key_": "vm.memory.size[total]", "units": "B", "name": "Total memory"}, "vm_memory_size_bytes", false, false,
+			"vm_memory_size_bytes", Metadata{Type: metricTypeGauge, Help: "Total memory", Unit: "bytes"}, 1},
+		// --metricNames 映射的名称不修改名称和值
+		{map[string]interface{}{"key_": "net.if.in[eth0]", "units": "bps", "name": "Bits"}, "node_network_receive", false, true,
+			"node_network_receive", Metadata{Type: metricTypeCounter, Help: "Bits"}, 1},
+	} {
+		s := Sample{Name: tc.name}
+		scale := c.applyMetadata(tc.item, &s, tc.trends, tc.mapped)
+		if s.Name != tc.want || s.Meta == nil || *s.Meta != tc.meta || scale != tc.scale {
+			t.Errorf("%s: got %s %+v %v, want %s %+v %v", tc.item["key_"], s.Name, s.Meta, scale, tc.want, tc.meta, tc.scale)
+		}
+	}
+}
+
+// TestMetadataParams 开启 --metadata 及 --valueMapLabels 时 item.get 查询的字段随版本变化
+func TestMetadataParams(t *testing.T) {
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: "http://127.0.0.1", Metadata: true, ValueMapLabels: true})
+	if er != nil {
+		t.Fatal(er)
+	}
+	params := map[string]interface{}{"output": []string{"itemid"}}
+	c.metadataParams(Version{Major: 6, Minor: 0}, params)
+	if !reflect.DeepEqual(params["output"], []string{"itemid", "name", "units", "description"}) || params["selectValueMap"] == nil || params["selectPreprocessing"] == nil {
+		t.Errorf("6.0 params %v", params)
+	}
+	params = map[string]interface{}{"output": []string{"itemid"}}
+	c.metadataParams(Version{Major: 5, Minor: 0}, params)
+	if !reflect.DeepEqual(params["output"], []string{"itemid", "name", "units", "description", "valuemapid"}) || params["selectValueMap"] != nil {
+		t.Errorf("5.0 params %v", params)
+	}
+}
+
+// TestValueMapLabels 值映射结果作为 state label, 只使用精确匹配的映射
+func TestValueMapLabels(t *testing.T) {
+	defer func(s Sinks) { sinks = s }(sinks)
+	store := NewMetricStore()
+	sinks = Sinks{NewSink("exporter", store, 0)}
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: "http://127.0.0.1", ValueMapLabels: true})
+	if er != nil {
+		t.Fatal(er)
+	}
+	c.HostIdHost.Store("10084", "web01")
+	item := map[string]interface{}{
+		"itemid": "23000", "hostid": "10084", "key_": "net.if.status[eth0]", "value_type": "3", "lastvalue": "1", "lastclock": "1690892492",
+		"valuemap": map[string]interface{}{"mappings": []interface{}{
+			map[string]interface{}{"type": "0", "value": "1", "newvalue": "up"},
+			map[string]interface{}{"type": "0", "value": "2", "newvalue": "down"},
+			map[string]interface{}{"type": "2", "value": "1-9", "newvalue": "range"},
+		}},
+	}
+	for _, value := range []string{"1", "2", "7"} {
+		item["lastvalue"] = value
+		c.changed(item)
+		if er := c.processMetric(item, false); er != nil {
+			t.Fatal(er)
+		}
+	}
+	// 映射结果变化后删除旧的序列, 没有映射时不输出 state
+	got := storeSeries(store, "0", "10084")
+	want := []string{`net_if_status{c="0",__endpoint__="web01",p="eth0"} 7`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	c.ValueMaps.Store("15", map[string]string{"0": "down"})
+	if got := c.mappedValue(map[string]interface{}{"valuemapid": "15"}, "0"); got != "down" {
+		t.Errorf("got %q, want down", got)
+	}
+}
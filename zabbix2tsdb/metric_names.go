@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// MetricMapping 按完整的 key_ 指定metric名称, 匹配时不再由 key_ 名称自动生成.
+// 如 vm.memory.size[available] -> node_memory_MemAvailable_bytes
+type MetricMapping struct {
+	// Key 完整的 key_(含参数), 支持通配符(*, ?)及正则(re:<正则>)
+	Key  string `yaml:"key"`
+	Name string `yaml:"name"`
+	// Labels 固定输出的label, 覆盖同名的item及参数label
+	Labels map[string]string `yaml:"labels"`
+	// Params 参数位置对应的label名称, 为空的位置不输出. 未配置时按 --keyRules 输出
+	Params []string `yaml:"params"`
+	// Scale 值的换算系数, 如 KB -> bytes 为 1024. 0为不换算
+	Scale float64 `yaml:"scale"`
+
+	pattern *regexp.Regexp
+	labels  []Label
+}
+
+type MetricMappings []*MetricMapping
+
+// builtinMetricMappings zabbix agent 常用key对应的 node_exporter metric, 只包含含义一致的gauge.
+// 模板中按"每秒变化"采集的网络, 磁盘io等与 node_exporter 的counter含义不同, 不做映射
+var builtinMetricMappings = []MetricMapping{
+	{Key: "vm.memory.size[total]", Name: "node_memory_MemTotal_bytes", Params: []string{""}},
+	{Key: "vm.memory.size", Name: "node_memory_MemTotal_bytes"},
+	{Key: "vm.memory.size[available]", Name: "node_memory_MemAvailable_bytes", Params: []string{""}},
+	{Key: "vm.memory.size[free]", Name: "node_memory_MemFree_bytes", Params: []string{""}},
+	{Key: "vm.memory.size[buffers]", Name: "node_memory_Buffers_bytes", Params: []string{""}},
+	{Key: "vm.memory.size[cached]", Name: "node_memory_Cached_bytes", Params: []string{""}},
+	{Key: "vm.memory.size[shared]", Name: "node_memory_Shmem_bytes", Params: []string{""}},
+	{Key: "system.swap.size[,total]", Name: "node_memory_SwapTotal_bytes", Params: []string{"", ""}},
+	{Key: "system.swap.size[,free]", Name: "node_memory_SwapFree_bytes", Params: []string{"", ""}},
+	{Key: `re:system\.cpu\.load(\[(all)?(,avg1)?\])?`, Name: "node_load1", Params: []string{"", ""}},
+	{Key: `re:system\.cpu\.load\[(all)?,avg5\]`, Name: "node_load5", Params: []string{"", ""}},
+	{Key: `re:system\.cpu\.load\[(all)?,avg15\]`, Name: "node_load15", Params: []string{"", ""}},
+	{Key: "system.boottime", Name: "node_boot_time_seconds"},
+	{Key: `re:system\.localtime(\[(utc)?\])?`, Name: "node_time_seconds", Params: []string{""}},
+	{Key: "kernel.maxfiles", Name: "node_filefd_maximum"},
+	{Key: "vfs.fs.size[*,total]", Name: "node_filesystem_size_bytes", Params: []string{"mountpoint", ""}},
+	{Key: "vfs.fs.size[*,free]", Name: "node_filesystem_avail_bytes", Params: []string{"mountpoint", ""}},
+	{Key: "vfs.fs.inode[*,total]", Name: "node_filesystem_files", Params: []string{"mountpoint", ""}},
+	{Key: "vfs.fs.inode[*,free]", Name: "node_filesystem_files_free", Params: []string{"mountpoint", ""}},
+}
+
+var metricMappings MetricMappings
+
+// Add 按添加顺序匹配, 第一个匹配的映射生效
+func (m *MetricMappings) Add(mappings []MetricMapping) error {
+	for _, mapping := range mappings {
+		mapping := mapping
+		if mapping.Name == "" || ReplMetricPattern.MatchString(mapping.Name) ||
+			(mapping.Name[0] >= '0' && mapping.Name[0] <= '9') {
+			return fmt.Errorf("metric mapping %s: invalid name %q", mapping.Key, mapping.Name)
+		}
+		re, er := compilePattern(mapping.Key)
+		if er != nil {
+			return fmt.Errorf("metric mapping %s:%s", mapping.Key, er)
+		}
+		mapping.pattern = re
+		if mapping.Params != nil {
+			mapping.Params = paramNames("metric mapping "+mapping.Key, mapping.Params)
+		}
+		for name, value := range mapping.Labels {
+			name = labelName("", name)
+			if _, ok := reservedLabels[name]; ok {
+				return fmt.Errorf("metric mapping %s: label %s is reserved", mapping.Key, name)
+			}
+			mapping.labels = append(mapping.labels, Label{Name: name, Value: value})
+		}
+		sort.Slice(mapping.labels, func(i, j int) bool { return mapping.labels[i].Name < mapping.labels[j].Name })
+		*m = append(*m, &mapping)
+	}
+	return nil
+}
+
+func loadMetricMappings(file string) ([]MetricMapping, error) {
+	data, er := ioutil.ReadFile(file)
+	if er != nil {
+		return nil, er
+	}
+	var mappings []MetricMapping
+	if er := yaml.Unmarshal(data, &mappings); er != nil {
+		return nil, fmt.Errorf("parse %s failed:%s", file, er)
+	}
+	return mappings, nil
+}
+
+// Match 没有匹配的映射时返回nil
+func (m MetricMappings) Match(key string) *MetricMapping {
+	for _, mapping := range m {
+		if mapping.pattern.MatchString(key) {
+			return mapping
+		}
+	}
+	return nil
+}
+
+// scale 未配置时为1
+func (m *MetricMapping) scale() float64 {
+	if m == nil || m.Scale == 0 {
+		return 1
+	}
+	return m.Scale
+}
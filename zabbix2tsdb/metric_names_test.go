@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMetricMappingsAdd(t *testing.T) {
+	for _, mapping := range []MetricMapping{
+		{Key: "system.uptime", Name: ""},
+		{Key: "system.uptime", Name: "system-uptime"},
+		{Key: "system.uptime", Name: "1uptime"},
+		{Key: "re:(", Name: "uptime"},
+		{Key: "system.uptime", Name: "uptime", Labels: map[string]string{"__endpoint__": "x"}},
+	} {
+		var m MetricMappings
+		if er := m.Add([]MetricMapping{mapping}); er == nil {
+			t.Errorf("%+v should fail", mapping)
+		}
+	}
+	var m MetricMappings
+	if er := m.Add(builtinMetricMappings); er != nil {
+		t.Fatal(er)
+	}
+	for key, want := range map[string]string{
+		"vm.memory.size[available]":    "node_memory_MemAvailable_bytes",
+		"vm.memory.size":               "node_memory_MemTotal_bytes",
+		"system.cpu.load":              "node_load1",
+		"system.cpu.load[all,avg1]":    "node_load1",
+		"system.cpu.load[,avg5]":       "node_load5",
+		"system.cpu.load[percpu,avg1]": "",
+		"vfs.fs.size[/data,free]":      "node_filesystem_avail_bytes",
+		"vfs.fs.size[/data,pfree]":     "",
+		"system.localtime[utc]":        "node_time_seconds",
+	} {
+		name := ""
+		if mapping := m.Match(key); mapping != nil {
+			name = mapping.Name
+		}
+		if name != want {
+			t.Errorf("%s: got %q, want %q", key, name, want)
+		}
+	}
+}
+
+// TestMetricMappingsOutput 映射的名称, 固定label, 参数名称及换算系数; 按文件中的顺序匹配
+func TestMetricMappingsOutput(t *testing.T) {
+	defer func(m MetricMappings, s Sinks) { metricMappings, sinks = m, s }(metricMappings, sinks)
+	path := filepath.Join(t.TempDir(), "metric_names.yaml")
+	data := `
+- key: system.cpu.util[,idle]
+  name: cpu_idle_ratio
+  scale: 0.01
+  labels:
+    source: zabbix
+- key: re:vm\.memory\.size\[(available|total)\]
+  name: memory_bytes
+  params: [kind]
+- key: vm.memory.size[*]
+  name: ignored
+- key: vfs.fs.size[*,*]
+  name: filesystem_kilobytes
+  scale: 1024
+  params: ["", unit]
+`
+	if er := ioutil.WriteFile(path, []byte(data), 0644); er != nil {
+		t.Fatal(er)
+	}
+	mappings, er := loadMetricMappings(path)
+	if er != nil {
+		t.Fatal(er)
+	}
+	metricMappings = nil
+	if er := metricMappings.Add(mappings); er != nil {
+		t.Fatal(er)
+	}
+	store := NewMetricStore()
+	sinks = Sinks{NewSink("exporter", store, 0)}
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: "http://127.0.0.1"})
+	if er != nil {
+		t.Fatal(er)
+	}
+	c.HostIdHost.Store("10084", "web01")
+	for i, item := range []map[string]interface{}{
+		{"key_": "system.cpu.util[,idle]", "lastvalue": "97.5"},
+		{"key_": "vm.memory.size[available]", "lastvalue": "1024"},
+		{"key_": "vm.memory.size[free]", "lastvalue": "512"},
+		{"key_": "vfs.fs.size[/,used]", "lastvalue": "2"},
+	} {
+		item["itemid"], item["hostid"], item["value_type"], item["lastclock"] = fmt.Sprint(23000+i), "10084", "0", "1690892492"
+		if er := c.processMetric(item, false); er != nil {
+			t.Fatal(er)
+		}
+	}
+	got := storeSeries(store, "0", "10084")
+	want := []string{
+		`cpu_idle_ratio{c="0",__endpoint__="web01",p=",idle",source="zabbix"} 0.975`,
+		`filesystem_kilobytes{c="0",__endpoint__="web01",unit="used"} 2048`,
+		`ignored{c="0",__endpoint__="web01",p="free"} 512`,
+		`memory_bytes{c="0",__endpoint__="web01",kind="available"} 1024`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q\nwant %q", got, want)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// alertsMetric 与prometheus的 ALERTS 一致, 每个未恢复的问题输出一条, 值为1
+const alertsMetric = "ALERTS"
+
+// severityNames zabbix 触发器严重性
+var severityNames = map[string]string{
+	"0": "not_classified",
+	"1": "information",
+	"2": "warning",
+	"3": "average",
+	"4": "high",
+	"5": "disaster",
+}
+
+// activeProblem 上次输出的问题, 恢复后需要删除或输出0
+type activeProblem struct {
+	HostId string
+	Sample Sample
+}
+
+// Problems 通过 problem.get 查询主机未恢复的问题, trigger.get 查询问题对应的主机
+func (z *ZabbixApi) Problems(ctx context.Context, hostIds []string) error {
+	result, er := z.request(ctx, "problem.get", map[string]interface{}{
+		"output":     []string{"eventid", "objectid", "name", "severity", "acknowledged"},
+		"hostids":    hostIds,
+		"source":     0,
+		"object":     0,
+		"selectTags": []string{"tag", "value"},
+	})
+	if er != nil {
+		return er
+	}
+	problems, _ := result.([]interface{})
+	triggerIds := make([]string, 0, len(problems))
+	for _, p := range problems {
+		triggerIds = append(triggerIds, fmt.Sprint(p.(map[string]interface{})["objectid"]))
+	}
+	// 涉及多个主机的触发器只输出同步中的主机
+	selected := make(map[string]struct{}, len(hostIds))
+	for _, hostId := range hostIds {
+		selected[hostId] = struct{}{}
+	}
+	triggerHosts := map[string][]string{}
+	if len(triggerIds) > 0 {
+		result, er := z.request(ctx, "trigger.get", map[string]interface{}{
+			"output":      []string{"triggerid"},
+			"triggerids":  triggerIds,
+			"selectHosts": []string{"hostid"},
+		})
+		if er != nil {
+			return er
+		}
+		triggers, _ := result.([]interface{})
+		for _, t := range triggers {
+			trigger := t.(map[string]interface{})
+			hosts, _ := trigger["hosts"].([]interface{})
+			for _, h := range hosts {
+				hostId := fmt.Sprint(h.(map[string]interface{})["hostid"])
+				if _, ok := selected[hostId]; !ok {
+					continue
+				}
+				triggerId := fmt.Sprint(trigger["triggerid"])
+				triggerHosts[triggerId] = append(triggerHosts[triggerId], hostId)
+			}
+		}
+	}
+	ts := time.Now().UnixNano() / 1e6
+	active := map[string]activeProblem{}
+	for _, p := range problems {
+		problem := p.(map[string]interface{})
+		for _, hostId := range triggerHosts[fmt.Sprint(problem["objectid"])] {
+			s := z.Cluster.problemSample(hostId, problem)
+			s.Value, s.Timestamp = 1, ts
+			active[s.Series()] = activeProblem{HostId: hostId, Sample: s}
+			if er := z.Cluster.emit(hostId, s); er != nil {
+				_, _ = fmt.Fprintln(os.Stderr, er.Error())
+			}
+		}
+	}
+	// 已恢复的问题: exporter删除该序列, 其他输出方式输出一次0
+	for series, problem := range z.Cluster.ActiveProblems {
+		if _, ok := active[series]; ok {
+			continue
+		}
+		s := problem.Sample
+		s.Value, s.Timestamp = 0, ts
+		if er := z.Cluster.delete(problem.HostId, s, true); er != nil {
+			_, _ = fmt.Fprintln(os.Stderr, er.Error())
+		}
+	}
+	z.Cluster.ActiveProblems = active
+	return nil
+}
+
+// alertLabels ALERTS 的内置label, 同名的问题标签忽略
+var alertLabels = map[string]struct{}{"alertname": {}, "alertstate": {}, "severity": {}, "acknowledged": {}}
+
+// problemSample ALERTS{c,__endpoint__,alertname,alertstate,severity,acknowledged,主机label,问题标签}.
+// 同一个标签名出现多次时(如模板中的多个 scope 标签), 值以 | 连接
+func (c *Cluster) problemSample(hostId string, problem map[string]interface{}) Sample {
+	values := map[string][]string{}
+	tags, _ := problem["tags"].([]interface{})
+	for _, t := range tags {
+		tag := t.(map[string]interface{})
+		name := labelName("", fmt.Sprint(tag["tag"]))
+		if _, ok := reservedLabels[name]; ok || name == "" {
+			continue
+		}
+		if _, ok := alertLabels[name]; ok {
+			continue
+		}
+		values[name] = append(values[name], fmt.Sprint(tag["value"]))
+	}
+	tagLabels := make([]Label, 0, len(values))
+	for name, value := range values {
+		sort.Strings(value)
+		tagLabels = append(tagLabels, Label{Name: name, Value: strings.Join(value, "|")})
+	}
+	severity, ok := severityNames[fmt.Sprint(problem["severity"])]
+	if !ok {
+		severity = fmt.Sprint(problem["severity"])
+	}
+	return c.hostSample(alertsMetric, hostId, mergeLabels(tagLabels, []Label{
+		{Name: "alertname", Value: fmt.Sprint(problem["name"])},
+		{Name: "alertstate", Value: "firing"},
+		{Name: "severity", Value: severity},
+		{Name: "acknowledged", Value: fmt.Sprint(problem["acknowledged"])},
+	}))
+}
+
+// delete 执行relabel后从exporter中删除该序列, resolve 为true时其他输出方式输出该数据
+func (c *Cluster) delete(hostId string, s Sample, resolve bool) error {
+	samples := []Sample{s}
+	if relabelConfigs != nil {
+		samples = relabelSamples(samples)
+	}
+	if resolve {
+		return sinks.Resolve(c.Config.Cluster, hostId, samples)
+	}
+	return sinks.Delete(c.Config.Cluster, hostId, samples)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// TestProblemSample 问题标签转换为label, 同名标签的值合并, 不允许覆盖内置label
+func TestProblemSample(t *testing.T) {
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: "http://127.0.0.1"})
+	if er != nil {
+		t.Fatal(er)
+	}
+	c.HostIdHost.Store("10084", "web 01")
+	c.HostIdLabels.Store("10084", []Label{{Name: "env", Value: "prod"}})
+	problem := map[string]interface{}{
+		"eventid": "1001", "objectid": "13000", "name": "High CPU utilization", "severity": "2", "acknowledged": "0",
+		"tags": []interface{}{
+			map[string]interface{}{"tag": "scope", "value": "performance"},
+			map[string]interface{}{"tag": "scope", "value": "capacity"},
+			map[string]interface{}{"tag": "component", "value": "cpu"},
+			map[string]interface{}{"tag": "severity", "value": "custom"},
+			map[string]interface{}{"tag": "alertname", "value": "custom"},
+			map[string]interface{}{"tag": "c", "value": "custom"},
+		},
+	}
+	s := c.problemSample("10084", problem)
+	want := []Label{
+		{Name: "c", Value: "0"},
+		{Name: "__endpoint__", Value: "web_01"},
+		{Name: "acknowledged", Value: "0"},
+		{Name: "alertname", Value: "High CPU utilization"},
+		{Name: "alertstate", Value: "firing"},
+		{Name: "component", Value: "cpu"},
+		{Name: "env", Value: "prod"},
+		{Name: "scope", Value: "capacity|performance"},
+		{Name: "severity", Value: "warning"},
+	}
+	if s.Name != alertsMetric || !reflect.DeepEqual(s.Labels, want) {
+		t.Errorf("got %s %v, want %v", s.Name, s.Labels, want)
+	}
+}
+
+// TestProblemsResolved 已恢复的问题从exporter中删除
+func TestProblemsResolved(t *testing.T) {
+	results := map[string]interface{}{
+		"apiinfo.version": "6.0.0",
+		"user.login":      "session",
+		"problem.get": []interface{}{map[string]interface{}{
+			"eventid": "1001", "objectid": "13000", "name": "Zabbix agent is not available", "severity": "3", "acknowledged": "0",
+		}},
+		"trigger.get": []interface{}{map[string]interface{}{
+			"triggerid": "13000", "hosts": []interface{}{map[string]interface{}{"hostid": "10084"}},
+		}},
+	}
+	server := fakeZabbix(t, results)
+	defer func(s Sinks) { sinks = s }(sinks)
+	store := NewMetricStore()
+	sinks = Sinks{NewSink("exporter", store, 0)}
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: server.URL})
+	if er != nil {
+		t.Fatal(er)
+	}
+	c.HostIdHost.Store("10084", "web01")
+	if er := c.Api.Login(); er != nil {
+		t.Fatal(er)
+	}
+	if er := c.Api.Problems(context.Background(), []string{"10084"}); er != nil {
+		t.Fatal(er)
+	}
+	if n := len(store.Clusters["0"]["10084"]); n != 1 {
+		t.Fatalf("got %d series, want 1", n)
+	}
+	results["problem.get"] = []interface{}{}
+	if er := c.Api.Problems(context.Background(), []string{"10084"}); er != nil {
+		t.Fatal(er)
+	}
+	if n := len(store.Clusters["0"]["10084"]); n != 0 {
+		t.Errorf("got %d series after recovery, want 0", n)
+	}
+}
+
+// TestProblemsSelectedHosts 涉及多个主机的触发器只输出同步中的主机
+func TestProblemsSelectedHosts(t *testing.T) {
+	server := fakeZabbix(t, map[string]interface{}{
+		"apiinfo.version": "6.0.0",
+		"user.login":      "session",
+		"problem.get": []interface{}{map[string]interface{}{
+			"eventid": "1001", "objectid": "13000", "name": "Replication lag", "severity": "4", "acknowledged": "0",
+		}},
+		"trigger.get": []interface{}{map[string]interface{}{
+			"triggerid": "13000", "hosts": []interface{}{
+				map[string]interface{}{"hostid": "10084"}, map[string]interface{}{"hostid": "10085"},
+			},
+		}},
+	})
+	store := NewMetricStore()
+	defer func(s Sinks) { sinks = s }(sinks)
+	sinks = Sinks{NewSink("exporter", store, 0)}
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: server.URL})
+	if er != nil {
+		t.Fatal(er)
+	}
+	if er := c.Api.Login(); er != nil {
+		t.Fatal(er)
+	}
+	if er := c.Api.Problems(context.Background(), []string{"10084"}); er != nil {
+		t.Fatal(er)
+	}
+	if n := len(store.Clusters["0"]["10084"]); n != 1 {
+		t.Errorf("got %d series for the selected host, want 1", n)
+	}
+	if n := len(store.Clusters["0"]["10085"]); n != 0 {
+		t.Errorf("got %d series for the unselected host, want 0", n)
+	}
+}
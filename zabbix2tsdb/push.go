@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	pushRetries = 3
+	pushBackoff = 500 * time.Millisecond
+)
+
+// pushWithRetry 发送请求, 网络错误、5xx 及 429 时按指数退避重试
+func pushWithRetry(client *http.Client, newRequest func() (*http.Request, error)) error {
+	backoff := pushBackoff
+	var er error
+	for i := 0; i <= pushRetries; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var retry bool
+		retry, er = push(client, newRequest)
+		if er == nil || !retry {
+			return er
+		}
+	}
+	return er
+}
+
+// push 返回的 bool 表示失败后是否可以重试
+func push(client *http.Client, newRequest func() (*http.Request, error)) (bool, error) {
+	req, er := newRequest()
+	if er != nil {
+		return false, er
+	}
+	resp, er := client.Do(req)
+	if er != nil {
+		return true, er
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	er = fmt.Errorf("server returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	// 4xx 为数据本身的问题, 重试无意义
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, er
+}
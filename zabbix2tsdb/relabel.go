@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RelabelConfig 与 prometheus 的 relabel_config 一致, __name__ 为metric名称
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    *string  `yaml:"separator"`
+	Regex        *string  `yaml:"regex"`
+	Modulus      uint64   `yaml:"modulus"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  *string  `yaml:"replacement"`
+	Action       string   `yaml:"action"`
+
+	regex       *regexp.Regexp
+	separator   string
+	replacement string
+}
+
+const (
+	RelabelReplace   = "replace"
+	RelabelKeep      = "keep"
+	RelabelDrop      = "drop"
+	RelabelHashMod   = "hashmod"
+	RelabelLabelMap  = "labelmap"
+	RelabelLabelDrop = "labeldrop"
+	RelabelLabelKeep = "labelkeep"
+
+	// tmpLabelPrefix 以该前缀开头的label只在relabel过程中使用, 不会输出
+	tmpLabelPrefix  = "__tmp"
+	metricNameLabel = "__name__"
+)
+
+// relabelConfigs 开启 --relabelConfig 时, processMetric 生成的每条数据输出前都要经过这些规则
+var relabelConfigs []*RelabelConfig
+
+func loadRelabelConfigs(file string) ([]*RelabelConfig, error) {
+	data, er := ioutil.ReadFile(file)
+	if er != nil {
+		return nil, er
+	}
+	var configs []*RelabelConfig
+	if er := yaml.Unmarshal(data, &configs); er != nil {
+		return nil, fmt.Errorf("parse %s failed:%s", file, er)
+	}
+	for i, c := range configs {
+		if er := c.compile(); er != nil {
+			return nil, fmt.Errorf("relabel config %d:%s", i, er)
+		}
+	}
+	return configs, nil
+}
+
+func (c *RelabelConfig) compile() error {
+	if c.Action == "" {
+		c.Action = RelabelReplace
+	}
+	c.separator = ";"
+	if c.Separator != nil {
+		c.separator = *c.Separator
+	}
+	c.replacement = "$1"
+	if c.Replacement != nil {
+		c.replacement = *c.Replacement
+	}
+	regex := "(.*)"
+	if c.Regex != nil {
+		regex = *c.Regex
+	}
+	var er error
+	if c.regex, er = regexp.Compile("^(?:" + regex + ")$"); er != nil {
+		return er
+	}
+	switch c.Action {
+	case RelabelReplace:
+		if c.TargetLabel == "" {
+			return fmt.Errorf("replace requires target_label")
+		}
+	case RelabelHashMod:
+		if c.TargetLabel == "" || c.Modulus == 0 {
+			return fmt.Errorf("hashmod requires target_label and modulus")
+		}
+	case RelabelKeep, RelabelDrop:
+		if len(c.SourceLabels) == 0 {
+			return fmt.Errorf("%s requires source_labels", c.Action)
+		}
+	case RelabelLabelMap, RelabelLabelDrop, RelabelLabelKeep:
+	default:
+		return fmt.Errorf("unknown action:%s", c.Action)
+	}
+	return nil
+}
+
+// relabel 依次执行规则, 返回 false 表示该数据被丢弃
+func relabel(s Sample, configs []*RelabelConfig) (Sample, bool) {
+	labels := make([]Label, 0, len(s.Labels)+1)
+	labels = append(labels, Label{Name: metricNameLabel, Value: s.Name})
+	labels = append(labels, s.Labels...)
+	for _, c := range configs {
+		var ok bool
+		if labels, ok = c.apply(labels); !ok {
+			return s, false
+		}
+	}
+	s.Name = ""
+	s.Labels = make([]Label, 0, len(labels))
+	for _, l := range labels {
+		switch {
+		case l.Name == metricNameLabel:
+			s.Name = l.Value
+		case strings.HasPrefix(l.Name, tmpLabelPrefix):
+		default:
+			s.Labels = append(s.Labels, l)
+		}
+	}
+	return s, s.Name != ""
+}
+
+func getLabel(labels []Label, name string) string {
+	for _, l := range labels {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+// setLabel 值为空时删除该label
+func setLabel(labels []Label, name, value string) []Label {
+	for i, l := range labels {
+		if l.Name == name {
+			if value == "" {
+				return append(labels[:i], labels[i+1:]...)
+			}
+			labels[i].Value = value
+			return labels
+		}
+	}
+	if value == "" {
+		return labels
+	}
+	return append(labels, Label{Name: name, Value: value})
+}
+
+func (c *RelabelConfig) apply(labels []Label) ([]Label, bool) {
+	values := make([]string, len(c.SourceLabels))
+	for i, name := range c.SourceLabels {
+		values[i] = getLabel(labels, name)
+	}
+	val := strings.Join(values, c.separator)
+	switch c.Action {
+	case RelabelDrop:
+		return labels, !c.regex.MatchString(val)
+	case RelabelKeep:
+		return labels, c.regex.MatchString(val)
+	case RelabelReplace:
+		indexes := c.regex.FindStringSubmatchIndex(val)
+		if indexes == nil {
+			return labels, true
+		}
+		target := string(c.regex.ExpandString(nil, c.TargetLabel, val, indexes))
+		value := string(c.regex.ExpandString(nil, c.replacement, val, indexes))
+		return setLabel(labels, target, value), true
+	case RelabelHashMod:
+		sum := md5.Sum([]byte(val))
+		mod := binary.BigEndian.Uint64(sum[8:]) % c.Modulus
+		return setLabel(labels, c.TargetLabel, fmt.Sprint(mod)), true
+	case RelabelLabelMap:
+		mapped := append([]Label{}, labels...)
+		for _, l := range labels {
+			if c.regex.MatchString(l.Name) {
+				mapped = setLabel(mapped, c.regex.ReplaceAllString(l.Name, c.replacement), l.Value)
+			}
+		}
+		return mapped, true
+	case RelabelLabelDrop, RelabelLabelKeep:
+		kept := labels[:0]
+		for _, l := range labels {
+			// metric名称不受 labeldrop/labelkeep 影响
+			if l.Name == metricNameLabel || c.regex.MatchString(l.Name) == (c.Action == RelabelLabelKeep) {
+				kept = append(kept, l)
+			}
+		}
+		return kept, true
+	}
+	return labels, true
+}
+
+// relabelSamples 对每条数据执行relabel, 返回保留下来的数据
+func relabelSamples(samples []Sample) []Sample {
+	kept := make([]Sample, 0, len(samples))
+	for _, s := range samples {
+		if s, ok := relabel(s, relabelConfigs); ok {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// parsePrometheusLine 解析 metric{label="value"} value [timestamp], 时间戳为毫秒
+func parsePrometheusLine(line string) (Sample, error) {
+	var s Sample
+	i := strings.IndexAny(line, "{ ")
+	if i < 0 {
+		return s, fmt.Errorf("invalid line: %s", line)
+	}
+	s.Name = line[:i]
+	rest := line[i:]
+	if rest[0] == '{' {
+		rest = rest[1:]
+		for {
+			rest = strings.TrimLeft(rest, ", ")
+			if strings.HasPrefix(rest, "}") {
+				rest = rest[1:]
+				break
+			}
+			eq := strings.Index(rest, `="`)
+			if eq < 0 {
+				return s, fmt.Errorf("invalid line: %s", line)
+			}
+			name := strings.TrimSpace(rest[:eq])
+			rest = rest[eq+2:]
+			var value strings.Builder
+			closed := false
+			for len(rest) > 0 && !closed {
+				c := rest[0]
+				rest = rest[1:]
+				switch {
+				case c == '\\' && len(rest) > 0:
+					if rest[0] == 'n' {
+						value.WriteByte('\n')
+					} else {
+						value.WriteByte(rest[0])
+					}
+					rest = rest[1:]
+				case c == '"':
+					closed = true
+				default:
+					value.WriteByte(c)
+				}
+			}
+			if !closed {
+				return s, fmt.Errorf("invalid line: %s", line)
+			}
+			s.Labels = append(s.Labels, Label{Name: name, Value: value.String()})
+		}
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return s, fmt.Errorf("invalid line: %s", line)
+	}
+	value, er := parseValue(fields[0])
+	if er != nil {
+		return s, fmt.Errorf("invalid value: %s", fields[0])
+	}
+	s.Value = value
+	if len(fields) > 1 {
+		if _, er := fmt.Sscan(fields[1], &s.Timestamp); er != nil {
+			return s, fmt.Errorf("invalid timestamp: %s", fields[1])
+		}
+		// 兼容之前版本输出的纳秒时间戳
+		if s.Timestamp >= 1e15 {
+			s.Timestamp /= 1e6
+		}
+	}
+	return s, nil
+}
+
+// checkRules 对输入的每行数据(influxdb 或 prometheus 格式)执行relabel并输出结果, 用于验证规则
+func checkRules(r io.Reader, w io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var samples []Sample
+		var er error
+		if i := strings.IndexAny(line, "{ "); i >= 0 && line[i] == '{' {
+			var s Sample
+			s, er = parsePrometheusLine(line)
+			samples = []Sample{s}
+		} else {
+			samples, er = parseInfluxLine(line)
+		}
+		if er != nil {
+			_, _ = fmt.Fprintf(w, "# error: %s\n", er)
+			continue
+		}
+		for _, s := range samples {
+			_, _ = fmt.Fprintf(w, "# input:  %s %s\n", s.Series(), formatValue(s.Value))
+			s, ok := relabel(s, relabelConfigs)
+			if !ok {
+				_, _ = fmt.Fprintln(w, "# dropped")
+				continue
+			}
+			line, ok := formatSample(zabbixConfig.DataFormat, s)
+			if !ok {
+				_, _ = fmt.Fprintln(w, "# skipped: unsupported value")
+				continue
+			}
+			_, _ = fmt.Fprintln(w, line)
+		}
+	}
+	return scanner.Err()
+}
+
+// runCheckRules --checkRules 的输入文件, "-" 为标准输入
+func runCheckRules(file string) error {
+	r := os.Stdin
+	if file != "-" {
+		f, er := os.Open(file)
+		if er != nil {
+			return er
+		}
+		defer f.Close()
+		r = f
+	}
+	return checkRules(r, os.Stdout)
+}
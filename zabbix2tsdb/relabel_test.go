@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func loadTestRelabel(t *testing.T, data string) []*RelabelConfig {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "relabel.yaml")
+	if er := ioutil.WriteFile(path, []byte(data), 0644); er != nil {
+		t.Fatal(er)
+	}
+	configs, er := loadRelabelConfigs(path)
+	if er != nil {
+		t.Fatal(er)
+	}
+	return configs
+}
+
+func TestRelabel(t *testing.T) {
+	configs := loadTestRelabel(t, `
+- source_labels: [__name__]
+  regex: system_swap_.*
+  action: drop
+- source_labels: [c]
+  regex: "0|1"
+  action: keep
+- source_labels: [__endpoint__]
+  regex: "([^.]+)\\..*"
+  target_label: instance
+- source_labels: [__endpoint__]
+  target_label: __tmp_shard
+- source_labels: [__tmp_shard]
+  modulus: 4
+  target_label: shard
+  action: hashmod
+- regex: "tag_(.+)"
+  replacement: "zbx_$1"
+  action: labelmap
+- regex: "tag_.*|p"
+  action: labeldrop
+- source_labels: [__name__]
+  regex: "(.*)_util"
+  target_label: __name__
+  replacement: "${1}_utilization"
+`)
+	labels := []Label{{Name: "c", Value: "0"}, {Name: "__endpoint__", Value: "web01.example.com"}, {Name: "tag_env", Value: "prod"}, {Name: "p", Value: ",idle"}}
+	for _, tc := range []struct {
+		in   Sample
+		want *Sample
+	}{
+		{Sample{Name: "system_cpu_util", Labels: labels, Value: 1}, &Sample{Name: "system_cpu_utilization", Labels: []Label{
+			{Name: "c", Value: "0"}, {Name: "__endpoint__", Value: "web01.example.com"},
+			{Name: "instance", Value: "web01"}, {Name: "shard", Value: "1"}, {Name: "zbx_env", Value: "prod"},
+		}, Value: 1}},
+		{Sample{Name: "system_swap_size", Labels: labels}, nil},
+		{Sample{Name: "system_cpu_util", Labels: []Label{{Name: "c", Value: "2"}}}, nil},
+	} {
+		in := tc.in
+		in.Labels = append([]Label{}, tc.in.Labels...)
+		got, ok := relabel(in, configs)
+		if tc.want == nil {
+			if ok {
+				t.Errorf("%s should be dropped, got %+v", tc.in.Series(), got)
+			}
+			continue
+		}
+		if !ok || !reflect.DeepEqual(got, *tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.in.Series(), got, *tc.want)
+		}
+	}
+	// labelkeep 不影响metric名称, replace 为空值时删除label
+	configs = loadTestRelabel(t, `
+- regex: "c|__endpoint__"
+  action: labelkeep
+- source_labels: [missing]
+  target_label: c
+  replacement: ""
+`)
+	got, ok := relabel(Sample{Name: "system_uptime", Labels: append([]Label{}, labels...)}, configs)
+	want := []Label{{Name: "__endpoint__", Value: "web01.example.com"}}
+	if !ok || got.Name != "system_uptime" || !reflect.DeepEqual(got.Labels, want) {
+		t.Errorf("got %+v, want system_uptime %v", got, want)
+	}
+}
+
+func TestRelabelConfigInvalid(t *testing.T) {
+	for _, data := range []string{
+		`- action: replace`,
+		`- action: hashmod
+  target_label: shard`,
+		`- action: keep`,
+		`- action: unknown`,
+		`- regex: "("
+  action: labeldrop`,
+	} {
+		path := filepath.Join(t.TempDir(), "relabel.yaml")
+		if er := ioutil.WriteFile(path, []byte(data), 0644); er != nil {
+			t.Fatal(er)
+		}
+		if _, er := loadRelabelConfigs(path); er == nil {
+			t.Errorf("%q should fail", data)
+		}
+	}
+}
+
+// TestCheckRules 读取prometheus及influxdb格式的数据, 输出relabel后的结果
+func TestCheckRules(t *testing.T) {
+	defer func(c []*RelabelConfig, format string) { relabelConfigs, zabbixConfig.DataFormat = c, format }(relabelConfigs, zabbixConfig.DataFormat)
+	relabelConfigs = loadTestRelabel(t, `
+- source_labels: [__name__]
+  regex: system_swap_.*
+  action: drop
+- regex: p
+  action: labeldrop
+`)
+	zabbixConfig.DataFormat = formatPrometheus
+	input := `# comment
+system_cpu_util{c="0",__endpoint__="web 01",p=",idle"} 97.5 1690892492000
+system_swap_size{c="0"} 1
+system_uptime,c=0,__endpoint__=web\ 01 {V}=3600 1690892492000000000
+invalid line
+`
+	var out strings.Builder
+	if er := checkRules(strings.NewReader(input), &out); er != nil {
+		t.Fatal(er)
+	}
+	want := `# input:  system_cpu_util{c="0",__endpoint__="web 01",p=",idle"} 97.5
+system_cpu_util{c="0",__endpoint__="web 01"} 97.5 1690892492000
+# input:  system_swap_size{c="0"} 1
+# dropped
+# input:  system_uptime{c="0",__endpoint__="web 01"} 3600
+system_uptime{c="0",__endpoint__="web 01"} 3600 1690892492000
+# error: invalid line: invalid line
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
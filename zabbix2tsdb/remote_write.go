@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+const (
+	// remoteWriteBatch 单次请求最多发送的序列数
+	remoteWriteBatch = 5000
+)
+
+// RemoteWriter 按 SmartItems 周期缓存数据, 周期结束后通过 prometheus remote_write 协议发送
+type RemoteWriter struct {
+	Locker  sync.Mutex
+	Url     string
+	Client  *http.Client
+	Samples []Sample
+	// Failed 累计发送失败的数据条数, dropped 为上次 Flush 之后发送失败的条数
+	Failed  int64
+	dropped int64
+}
+
+func NewRemoteWriter(url string) *RemoteWriter {
+	return &RemoteWriter{Url: url, Client: createHTTPClient()}
+}
+
+func (r *RemoteWriter) Write(_, _ string, samples []Sample) error {
+	r.Locker.Lock()
+	r.Samples = append(r.Samples, samples...)
+	full := len(r.Samples) >= remoteWriteBatch
+	r.Locker.Unlock()
+	// 达到单次请求的最大序列数时立即发送, 不等待周期结束
+	if full {
+		r.flush()
+	}
+	return nil
+}
+
+func (r *RemoteWriter) Flush() error {
+	r.flush()
+	r.Locker.Lock()
+	dropped := r.dropped
+	r.dropped = 0
+	r.Locker.Unlock()
+	if dropped > 0 {
+		return fmt.Errorf("dropped %d samples", dropped)
+	}
+	return nil
+}
+
+// flush 发送缓存的全部数据
+func (r *RemoteWriter) flush() {
+	r.Locker.Lock()
+	samples := r.Samples
+	r.Samples = nil
+	r.Locker.Unlock()
+	for start := 0; start < len(samples); start += remoteWriteBatch {
+		end := start + remoteWriteBatch
+		if end > len(samples) {
+			end = len(samples)
+		}
+		if er := r.send(encodeWriteRequest(samples[start:end])); er != nil {
+			// 多个集群可能同时 Flush
+			r.Locker.Lock()
+			r.Failed += int64(end - start)
+			r.dropped += int64(end - start)
+			failed := r.Failed
+			r.Locker.Unlock()
+			_, _ = fmt.Fprintf(os.Stderr, "remote write failed, dropped %d samples (total %d):%s\n",
+				end-start, failed, er)
+		}
+	}
+}
+
+func (r *RemoteWriter) send(data []byte) error {
+	body := snappy.Encode(nil, data)
+	return pushWithRetry(r.Client, func() (*http.Request, error) {
+		req, er := http.NewRequest("POST", r.Url, bytes.NewReader(body))
+		if er != nil {
+			return nil, er
+		}
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+		return req, nil
+	})
+}
+
+// encodeWriteRequest 按 prometheus prompb.WriteRequest 编码:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(samples []Sample) []byte {
+	var buf, ts, tmp []byte
+	for _, s := range samples {
+		labels := append([]Label{{Name: "__name__", Value: s.Name}}, s.Labels...)
+		sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+		ts = ts[:0]
+		for _, l := range labels {
+			tmp = tmp[:0]
+			tmp = appendBytesField(tmp, 1, []byte(l.Name))
+			tmp = appendBytesField(tmp, 2, []byte(l.Value))
+			ts = appendBytesField(ts, 1, tmp)
+		}
+		tmp = tmp[:0]
+		tmp = appendTag(tmp, 1, 1)
+		var fixed [8]byte
+		binary.LittleEndian.PutUint64(fixed[:], math.Float64bits(s.Value))
+		tmp = append(tmp, fixed[:]...)
+		tmp = appendTag(tmp, 2, 0)
+		tmp = appendUvarint(tmp, uint64(s.Timestamp))
+		ts = appendBytesField(ts, 2, tmp)
+		buf = appendBytesField(buf, 1, ts)
+	}
+	return buf
+}
+
+func appendTag(b []byte, field int, wireType int) []byte {
+	return appendUvarint(b, uint64(field<<3|wireType))
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(b, tmp[:n]...)
+}
+
+func appendBytesField(b []byte, field int, data []byte) []byte {
+	b = appendTag(b, field, 2)
+	b = appendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+// protoFields 解析一层protobuf消息, 返回 field -> 原始值(varint, fixed64 按 uint64, bytes 按 []byte)
+func protoFields(t *testing.T, b []byte) map[int][]interface{} {
+	t.Helper()
+	fields := map[int][]interface{}{}
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("invalid tag")
+		}
+		b = b[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			b = b[n:]
+			fields[field] = append(fields[field], v)
+		case 1:
+			fields[field] = append(fields[field], binary.LittleEndian.Uint64(b))
+			b = b[8:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			b = b[n:]
+			fields[field] = append(fields[field], b[:size])
+			b = b[size:]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+	}
+	return fields
+}
+
+// decodeWriteRequest 解析 encodeWriteRequest 的结果, __name__ 作为 Name
+func decodeWriteRequest(t *testing.T, b []byte) []Sample {
+	var samples []Sample
+	for _, ts := range protoFields(t, b)[1] {
+		fields := protoFields(t, ts.([]byte))
+		var s Sample
+		for _, l := range fields[1] {
+			label := protoFields(t, l.([]byte))
+			name, value := string(label[1][0].([]byte)), string(label[2][0].([]byte))
+			if name == "__name__" {
+				s.Name = value
+				continue
+			}
+			s.Labels = append(s.Labels, Label{Name: name, Value: value})
+		}
+		sample := protoFields(t, fields[2][0].([]byte))
+		s.Value = math.Float64frombits(sample[1][0].(uint64))
+		s.Timestamp = int64(sample[2][0].(uint64))
+		samples = append(samples, s)
+	}
+	return samples
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	samples := []Sample{
+		{Name: "system_cpu_util", Labels: []Label{{Name: "c", Value: "0"}, {Name: "__endpoint__", Value: "web 01"}, {Name: "type", Value: "idle"}}, Value: 97.5, Timestamp: 1690892492000},
+		{Name: "system_uptime", Labels: []Label{{Name: "c", Value: "0"}}, Value: 3600, Timestamp: 1690892492123},
+	}
+	got := decodeWriteRequest(t, encodeWriteRequest(samples))
+	// remote_write 要求label按名称排序
+	want := []Sample{
+		{Name: "system_cpu_util", Labels: []Label{{Name: "__endpoint__", Value: "web 01"}, {Name: "c", Value: "0"}, {Name: "type", Value: "idle"}}, Value: 97.5, Timestamp: 1690892492000},
+		{Name: "system_uptime", Labels: []Label{{Name: "c", Value: "0"}}, Value: 3600, Timestamp: 1690892492123},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
+
+// TestRemoteWriter 缓存的数据在 Flush 时发送, 4xx 不重试且 Flush 返回丢弃的条数
+func TestRemoteWriter(t *testing.T) {
+	var locker sync.Mutex
+	var received []Sample
+	status := http.StatusNoContent
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		locker.Lock()
+		defer locker.Unlock()
+		requests++
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" ||
+			r.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		body, _ := io.ReadAll(r.Body)
+		data, er := snappy.Decode(nil, body)
+		if er != nil {
+			t.Errorf("snappy decode failed:%s", er)
+		}
+		received = append(received, decodeWriteRequest(t, data)...)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	writer := NewRemoteWriter(server.URL)
+	s := Sample{Name: "system_uptime", Labels: []Label{{Name: "c", Value: "0"}}, Value: 1, Timestamp: 1690892492000}
+	_ = writer.Write("0", "10084", []Sample{s, s})
+	if requests != 0 {
+		t.Errorf("got %d requests before flush", requests)
+	}
+	if er := writer.Flush(); er != nil {
+		t.Fatal(er)
+	}
+	if requests != 1 || len(received) != 2 {
+		t.Errorf("got %d requests %d samples, want 1 request 2 samples", requests, len(received))
+	}
+
+	status = http.StatusBadRequest
+	_ = writer.Write("0", "10084", []Sample{s})
+	if er := writer.Flush(); er == nil {
+		t.Error("flush should report dropped samples")
+	}
+	if requests != 2 || writer.Failed != 1 {
+		t.Errorf("got %d requests %d failed, want 2 requests 1 failed", requests, writer.Failed)
+	}
+	// 丢弃的条数只报告一次
+	if er := writer.Flush(); er != nil {
+		t.Errorf("empty flush failed:%s", er)
+	}
+}
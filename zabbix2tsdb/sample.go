@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample 一条转换后的数据, 由 processMetric 等生成后经过relabel, 再由各输出方式序列化. Timestamp 单位为毫秒
+type Sample struct {
+	Name      string
+	Labels    []Label
+	Value     float64
+	Timestamp int64
+	// Meta 开启 --metadata 时item的类型, 单位及说明, 其他为空
+	Meta *Metadata
+}
+
+// splitEscaped 按未转义的分隔符切分, 保留转义符, 交由 unescapeInflux 处理
+func splitEscaped(s string, sep byte, n int) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if n > 0 && len(parts) == n-1 {
+			break
+		}
+		if s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] == sep {
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+var (
+	influxMeasurementReplacer = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagReplacer         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// escapeInfluxMeasurement 按 line protocol 转义 measurement
+func escapeInfluxMeasurement(s string) string {
+	return influxMeasurementReplacer.Replace(s)
+}
+
+// escapeInfluxTag 按 line protocol 转义 tag key, tag value 以及 field key.
+// line protocol 无法表示以反斜杠结尾的值(会转义其后的分隔符), 去掉末尾的反斜杠
+func escapeInfluxTag(s string) string {
+	return influxTagReplacer.Replace(strings.TrimRight(strings.ReplaceAll(s, "\n", " "), `\`))
+}
+
+// unescapeInflux 与 influxdb 一致, 只还原被转义的逗号、等号和空格, 其它反斜杠原样保留
+func unescapeInflux(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(", =", s[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// parseInfluxLine 解析 influxdb line protocol, 每个 field 对应一条 Sample, 时间戳由纳秒转换为毫秒
+func parseInfluxLine(line string) ([]Sample, error) {
+	sections := splitEscaped(strings.TrimSpace(line), ' ', 0)
+	if len(sections) < 2 {
+		return nil, fmt.Errorf("invalid line: %s", line)
+	}
+	measurementTagSet := splitEscaped(sections[0], ',', 0)
+	measurement := unescapeInflux(measurementTagSet[0])
+	var labels []Label
+	for _, tag := range measurementTagSet[1:] {
+		t := splitEscaped(tag, '=', 2)
+		if len(t) == 2 {
+			labels = append(labels, Label{Name: unescapeInflux(t[0]), Value: unescapeInflux(t[1])})
+		}
+	}
+	var timestamp int64
+	if len(sections) >= 3 {
+		if _, er := fmt.Sscan(sections[2], &timestamp); er != nil {
+			return nil, fmt.Errorf("invalid timestamp: %s", sections[2])
+		}
+		timestamp /= 1e6
+	}
+	var samples []Sample
+	for _, field := range splitEscaped(sections[1], ',', 0) {
+		t := splitEscaped(field, '=', 2)
+		if len(t) != 2 {
+			return nil, fmt.Errorf("invalid line: %s", line)
+		}
+		name := measurement
+		if key := unescapeInflux(t[0]); key != defaultKey {
+			name = fmt.Sprintf("%s_%s", measurement, key)
+		}
+		value, er := parseValue(strings.TrimSuffix(strings.TrimSuffix(t[1], "i"), "u"))
+		if er != nil {
+			return nil, fmt.Errorf("invalid value %s of %s", t[1], name)
+		}
+		samples = append(samples, Sample{Name: name, Labels: labels, Value: value, Timestamp: timestamp})
+	}
+	return samples, nil
+}
+
+// parseValue 支持 prometheus 的 NaN, +Inf, -Inf
+func parseValue(s string) (float64, error) {
+	return strconv.ParseFloat(s, 64)
+}
+
+// formatValue 整数不输出小数及指数, 与 prometheus 一致输出 NaN, +Inf, -Inf
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+var promLabelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Series 返回 prometheus 格式的 metric{labels}, 可作为序列的唯一标识
+func (s Sample) Series() string {
+	var b strings.Builder
+	b.WriteString(s.Name)
+	b.WriteByte('{')
+	for i, l := range s.Labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l.Name)
+		b.WriteString(`="`)
+		b.WriteString(promLabelValueReplacer.Replace(l.Value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
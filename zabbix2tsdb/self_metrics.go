@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	metricApiRequests     = "zabbix2tsdb_api_requests_total"
+	metricApiDuration     = "zabbix2tsdb_api_request_duration_seconds"
+	metricLogins          = "zabbix2tsdb_logins_total"
+	metricItemsProcessed  = "zabbix2tsdb_items_processed_total"
+	metricItemsDropped    = "zabbix2tsdb_items_dropped_total"
+	metricBatchFailures   = "zabbix2tsdb_batch_failures_total"
+	metricLastSuccess     = "zabbix2tsdb_last_success_timestamp_seconds"
+	metricFailedCycles    = "zabbix2tsdb_consecutive_failed_cycles"
+	metricHostsTracked    = "zabbix2tsdb_hosts"
+	metricBreakerOpens    = "zabbix2tsdb_circuit_breaker_opens_total"
+	metricTypeCounter     = "counter"
+	metricTypeGauge       = "gauge"
+	metricTypeSummary     = "summary"
+	statusOk, statusError = "ok", "error"
+)
+
+// SelfMetrics zabbix2tsdb 自身的运行指标
+type SelfMetrics struct {
+	Locker sync.Mutex
+	// Types metric名称 -> 类型
+	Types map[string]string
+	// Values series -> sample
+	Values map[string]*Sample
+	// FailedCycles cluster -> 连续失败的同步周期数, 超过 --readyFailures 时 /readyz 返回503
+	FailedCycles map[string]int
+	// Succeeded cluster -> 是否有过成功的同步周期
+	Succeeded map[string]bool
+}
+
+var selfMetrics = &SelfMetrics{
+	Types:        map[string]string{},
+	Values:       map[string]*Sample{},
+	FailedCycles: map[string]int{},
+	Succeeded:    map[string]bool{},
+}
+
+// sample 获取或创建序列, labels 为 name, value 交替
+func (m *SelfMetrics) sample(name, typ string, labels ...string) *Sample {
+	s := Sample{Name: name}
+	for i := 0; i+1 < len(labels); i += 2 {
+		s.Labels = append(s.Labels, Label{Name: labels[i], Value: labels[i+1]})
+	}
+	key := s.Series()
+	if v, ok := m.Values[key]; ok {
+		return v
+	}
+	m.Values[key] = &s
+	m.Types[name] = typ
+	return &s
+}
+
+func (m *SelfMetrics) Add(name, typ string, value float64, labels ...string) {
+	m.Locker.Lock()
+	defer m.Locker.Unlock()
+	m.sample(name, typ, labels...).Value += value
+}
+
+func (m *SelfMetrics) Set(name string, value float64, labels ...string) {
+	m.Locker.Lock()
+	defer m.Locker.Unlock()
+	m.sample(name, metricTypeGauge, labels...).Value = value
+}
+
+// ApiRequest 记录一次api请求的结果及耗时
+func (m *SelfMetrics) ApiRequest(cluster, method string, start time.Time, er error) {
+	status := statusOk
+	if er != nil {
+		status = statusError
+	}
+	m.Add(metricApiRequests, metricTypeCounter, 1, "cluster", cluster, "method", method, "status", status)
+	m.Add(metricApiDuration+"_sum", metricTypeSummary, time.Since(start).Seconds(), "cluster", cluster, "method", method)
+	m.Add(metricApiDuration+"_count", metricTypeSummary, 1, "cluster", cluster, "method", method)
+}
+
+// Cycle 记录一个同步周期的结果
+func (m *SelfMetrics) Cycle(cluster string, failedBatches int) {
+	if failedBatches > 0 {
+		m.Add(metricBatchFailures, metricTypeCounter, float64(failedBatches), "cluster", cluster)
+	}
+	m.Locker.Lock()
+	if failedBatches > 0 {
+		m.FailedCycles[cluster]++
+	} else {
+		m.FailedCycles[cluster] = 0
+		m.Succeeded[cluster] = true
+	}
+	failed := m.FailedCycles[cluster]
+	m.Locker.Unlock()
+	m.Set(metricFailedCycles, float64(failed), "cluster", cluster)
+	if failedBatches == 0 {
+		m.Set(metricLastSuccess, float64(time.Now().Unix()), "cluster", cluster)
+	}
+}
+
+// Ready 所有集群都有过成功的同步周期, 且连续失败次数未超过 --readyFailures
+func (m *SelfMetrics) Ready() error {
+	m.Locker.Lock()
+	defer m.Locker.Unlock()
+	for _, c := range clusters {
+		name := c.Config.Cluster
+		if !m.Succeeded[name] {
+			return fmt.Errorf("cluster %s has no successful cycle", name)
+		}
+		if m.FailedCycles[name] >= zabbixConfig.ReadyFailures {
+			return fmt.Errorf("cluster %s failed %d cycles", name, m.FailedCycles[name])
+		}
+	}
+	return nil
+}
+
+// families 当前的自身指标
+func (m *SelfMetrics) families() []MetricFamily {
+	m.Locker.Lock()
+	defer m.Locker.Unlock()
+	samples := make([]Sample, 0, len(m.Values))
+	for _, s := range m.Values {
+		samples = append(samples, *s)
+	}
+	return groupFamilies(samples, m.Types)
+}
+
+func (m *SelfMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeMetrics(w, r, m.families())
+}
+
+// writeMetrics 按 Accept 输出prometheus或openmetrics格式
+func writeMetrics(w http.ResponseWriter, r *http.Request, families []MetricFamily) {
+	openMetrics := acceptOpenMetrics(r)
+	if openMetrics {
+		w.Header().Set("Content-Type", contentTypeOpenMetrics)
+	} else {
+		w.Header().Set("Content-Type", contentTypePrometheus)
+	}
+	bw := bufio.NewWriter(w)
+	writeFamilies(bw, families, openMetrics)
+	if openMetrics {
+		_, _ = fmt.Fprintln(bw, "# EOF")
+	}
+	_ = bw.Flush()
+}
+
+func healthz(w http.ResponseWriter, _ *http.Request) {
+	_, _ = fmt.Fprintln(w, "ok")
+}
+
+func readyz(w http.ResponseWriter, _ *http.Request) {
+	if er := selfMetrics.Ready(); er != nil {
+		http.Error(w, er.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = fmt.Fprintln(w, "ok")
+}
+
+// listenAndServe 注册 /healthz, /readyz 后启动http服务
+func listenAndServe(listen string, mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", readyz)
+	go func() {
+		if er := http.ListenAndServe(listen, mux); er != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "listen %s failed:%s\n", listen, er)
+			os.Exit(1)
+		}
+	}()
+}
+
+// serveStatus 非exporter模式下通过 --statusListen 输出自身指标
+func serveStatus(listen string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", selfMetrics)
+	listenAndServe(listen, mux)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSelfMetrics() *SelfMetrics {
+	return &SelfMetrics{Types: map[string]string{}, Values: map[string]*Sample{}, FailedCycles: map[string]int{}, Succeeded: map[string]bool{}}
+}
+
+func TestSelfMetrics(t *testing.T) {
+	m := newSelfMetrics()
+	m.ApiRequest("0", "item.get", time.Now(), nil)
+	m.ApiRequest("0", "item.get", time.Now(), errors.New("timeout"))
+	m.ApiRequest("0", "item.get", time.Now(), nil)
+	m.Add(metricItemsProcessed, metricTypeCounter, 10, "cluster", "0")
+	m.Add(metricItemsProcessed, metricTypeCounter, 5, "cluster", "0")
+	m.Set(metricHostsTracked, 3, "cluster", "0")
+	m.Set(metricHostsTracked, 2, "cluster", "0")
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE zabbix2tsdb_api_requests_total counter",
+		`zabbix2tsdb_api_requests_total{cluster="0",method="item.get",status="ok"} 2`,
+		`zabbix2tsdb_api_requests_total{cluster="0",method="item.get",status="error"} 1`,
+		"# TYPE zabbix2tsdb_api_request_duration_seconds summary",
+		`zabbix2tsdb_api_request_duration_seconds_count{cluster="0",method="item.get"} 3`,
+		`zabbix2tsdb_items_processed_total{cluster="0"} 15`,
+		"# TYPE zabbix2tsdb_hosts gauge",
+		`zabbix2tsdb_hosts{cluster="0"} 2`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %s in\n%s", line, body)
+		}
+	}
+}
+
+// TestSelfMetricsReady 所有集群都成功过一次才就绪, 连续失败 --readyFailures 个周期后不再就绪
+func TestSelfMetricsReady(t *testing.T) {
+	defer func(cs []*Cluster, n int) { clusters, zabbixConfig.ReadyFailures = cs, n }(clusters, zabbixConfig.ReadyFailures)
+	zabbixConfig.ReadyFailures = 2
+	clusters = nil
+	for _, name := range []string{"0", "1"} {
+		c, er := NewCluster(ClusterConfig{Cluster: name, Address: "http://127.0.0.1"})
+		if er != nil {
+			t.Fatal(er)
+		}
+		clusters = append(clusters, c)
+	}
+	m := newSelfMetrics()
+	m.Cycle("0", 0)
+	if er := m.Ready(); er == nil {
+		t.Error("cluster 1 has no successful cycle")
+	}
+	m.Cycle("1", 0)
+	if er := m.Ready(); er != nil {
+		t.Error(er)
+	}
+	m.Cycle("1", 3)
+	if er := m.Ready(); er != nil {
+		t.Errorf("one failed cycle should still be ready: %s", er)
+	}
+	m.Cycle("1", 1)
+	if er := m.Ready(); er == nil {
+		t.Error("2 failed cycles should not be ready")
+	}
+	if v := m.Values[`zabbix2tsdb_batch_failures_total{cluster="1"}`].Value; v != 4 {
+		t.Errorf("got %v batch failures, want 4", v)
+	}
+	if v := m.Values[`zabbix2tsdb_consecutive_failed_cycles{cluster="1"}`].Value; v != 2 {
+		t.Errorf("got %v failed cycles, want 2", v)
+	}
+	m.Cycle("1", 0)
+	if er := m.Ready(); er != nil {
+		t.Error(er)
+	}
+}
+
+// TestGetItemsNoHosts 主机列表查询成功但没有匹配的主机时记录成功的周期, 查询失败时不记录
+func TestGetItemsNoHosts(t *testing.T) {
+	defer func(m *SelfMetrics) { selfMetrics = m }(selfMetrics)
+	selfMetrics = newSelfMetrics()
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: "http://127.0.0.1", Interval: 60})
+	if er != nil {
+		t.Fatal(er)
+	}
+	c.GetItems(context.Background())
+	if selfMetrics.Succeeded["0"] {
+		t.Error("hosts not loaded should not record a cycle")
+	}
+	c.Hosts.Set(map[string]struct{}{})
+	c.GetItems(context.Background())
+	if !selfMetrics.Succeeded["0"] {
+		t.Error("no matched hosts should record a successful cycle")
+	}
+}
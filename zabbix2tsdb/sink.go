@@ -0,0 +1,576 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	metricSinkDropped = "zabbix2tsdb_sink_dropped_total"
+	metricSinkQueue   = "zabbix2tsdb_sink_queue_length"
+	// defaultSinkBuffer 每个输出缓存的最大写入次数(每个item一次), 超过时丢弃新数据
+	defaultSinkBuffer = 100000
+	// defaultHttpBatch http输出单次请求最多发送的行数
+	defaultHttpBatch = 5000
+)
+
+// SinkConfig --config 中 sinks 的配置, 每个输出独立缓存, 写入失败或阻塞不影响其他输出及同步
+type SinkConfig struct {
+	// Name 默认为 Type, 同类型的输出有多个时需要指定
+	Name string `yaml:"name"`
+	// Type stdout, file, http, remoteWrite, influx, exporter
+	Type string `yaml:"type"`
+	// Format stdout, file, http 的格式: influxdb, prometheus 或 openmetrics(不含元数据), 默认为 --dataFormat
+	Format string `yaml:"format"`
+	// Path file 的路径, 追加写入
+	Path string `yaml:"path"`
+	// Url http, remoteWrite 的地址
+	Url string `yaml:"url"`
+	// Headers http 请求头, 如 Authorization
+	Headers map[string]string `yaml:"headers"`
+	// BatchSize http 单次请求最多发送的行数
+	BatchSize int `yaml:"batchSize"`
+	// Listen exporter 的地址
+	Listen string       `yaml:"listen"`
+	Influx InfluxConfig `yaml:"influx"`
+	// Buffer 缓存的最大写入次数, 默认为 --sinkBuffer
+	Buffer int `yaml:"buffer"`
+	// Events 只接收日志类型item的事件(JSON lines), 不接收数据, 支持 stdout, file, http
+	Events bool `yaml:"events"`
+}
+
+// SinkWriter 实际的输出方式, 由 Sink 的goroutine依次调用, 不需要考虑并发
+type SinkWriter interface {
+	Write(cluster, hostId string, samples []Sample) error
+	// Flush 写出缓存的数据, 失败时自行输出错误. 上次 Flush 之后有数据写入失败时返回错误
+	Flush() error
+}
+
+// eventWriter 可以接收日志事件的输出方式
+type eventWriter interface {
+	WriteEvents(events []Event) error
+}
+
+// seriesStore 保存最新数据的输出(exporter), 可以删除序列
+type seriesStore interface {
+	Delete(cluster, hostId string, samples []Sample) error
+	Retain(cluster string, hostIds []string)
+}
+
+type sinkEntry struct {
+	cluster, hostId string
+	samples         []Sample
+	events          []Event
+	// flush 不为nil时为flush请求, 完成后写入结果
+	flush chan error
+}
+
+// Sink 一个输出, Queue 为nil时同步写入(exporter), 否则由单独的goroutine写入
+type Sink struct {
+	Name   string
+	Writer SinkWriter
+	// Events 为true时只接收日志事件
+	Events bool
+	Queue  chan sinkEntry
+	// Dropped 上次flush之后因缓存已满丢弃的数据条数
+	Dropped int64
+}
+
+// Sinks 所有输出, 每行数据写入全部输出
+type Sinks []*Sink
+
+// sinks 由 --listen, --remoteWrite, --influxUrl 及 --config 中的 sinks 创建, 都未配置时输出到标准输出
+var sinks Sinks
+
+func NewSink(name string, writer SinkWriter, buffer int) *Sink {
+	s := &Sink{Name: name, Writer: writer}
+	if _, ok := writer.(seriesStore); ok {
+		return s
+	}
+	if buffer <= 0 {
+		buffer = defaultSinkBuffer
+	}
+	s.Queue = make(chan sinkEntry, buffer)
+	go s.run()
+	return s
+}
+
+func (s *Sink) run() {
+	// failed 上次flush之后写入失败的次数
+	failed := 0
+	for e := range s.Queue {
+		if e.flush == nil {
+			var er error
+			if e.events != nil {
+				er = s.Writer.(eventWriter).WriteEvents(e.events)
+			} else {
+				er = s.Writer.Write(e.cluster, e.hostId, e.samples)
+			}
+			if er != nil {
+				failed++
+				_, _ = fmt.Fprintf(os.Stderr, "sink %s write failed:%s\n", s.Name, er)
+			}
+			continue
+		}
+		var res error
+		if dropped := atomic.SwapInt64(&s.Dropped, 0); dropped > 0 {
+			res = fmt.Errorf("buffer full, dropped %d samples", dropped)
+			_, _ = fmt.Fprintf(os.Stderr, "sink %s %s\n", s.Name, res)
+		}
+		if failed > 0 && res == nil {
+			res = fmt.Errorf("%d writes failed", failed)
+		}
+		failed = 0
+		if er := s.Writer.Flush(); er != nil && res == nil {
+			res = er
+		}
+		e.flush <- res
+	}
+}
+
+// write 缓存已满时丢弃, 不阻塞同步. wait 为true时等待缓存有空间
+func (s *Sink) write(cluster, hostId string, samples []Sample, wait bool) error {
+	if s.Queue == nil {
+		return s.Writer.Write(cluster, hostId, samples)
+	}
+	s.enqueue(sinkEntry{cluster: cluster, hostId: hostId, samples: samples}, len(samples), wait)
+	return nil
+}
+
+func (s *Sink) enqueue(e sinkEntry, n int, wait bool) {
+	if wait {
+		s.Queue <- e
+		return
+	}
+	select {
+	case s.Queue <- e:
+	default:
+		atomic.AddInt64(&s.Dropped, int64(n))
+		selfMetrics.Add(metricSinkDropped, metricTypeCounter, float64(n), "sink", s.Name)
+	}
+}
+
+// flush wait 为true时等待缓存的数据全部写出, 返回上次flush之后是否有数据丢弃或写入失败.
+// 否则缓存已满时放弃本次flush
+func (s *Sink) flush(wait bool) error {
+	if s.Queue == nil {
+		return s.Writer.Flush()
+	}
+	selfMetrics.Set(metricSinkQueue, float64(len(s.Queue)), "sink", s.Name)
+	e := sinkEntry{flush: make(chan error, 1)}
+	if !wait {
+		select {
+		case s.Queue <- e:
+		default:
+		}
+		return nil
+	}
+	s.Queue <- e
+	return <-e.flush
+}
+
+// Write 写入所有数据输出, 只返回同步写入的输出的错误
+func (ss Sinks) Write(cluster, hostId string, samples []Sample) error {
+	return ss.write(cluster, hostId, samples, false)
+}
+
+// WriteWait 缓存已满时等待, 不丢弃数据. 用于实时导出, 保存读取位置前数据需要全部写出
+func (ss Sinks) WriteWait(cluster, hostId string, samples []Sample) error {
+	return ss.write(cluster, hostId, samples, true)
+}
+
+func (ss Sinks) write(cluster, hostId string, samples []Sample, wait bool) error {
+	var res error
+	for _, s := range ss {
+		if s.Events {
+			continue
+		}
+		if er := s.write(cluster, hostId, samples, wait); er != nil && res == nil {
+			res = fmt.Errorf("sink %s:%s", s.Name, er)
+		}
+	}
+	return res
+}
+
+// Delete 从exporter中删除该序列, 其他输出方式忽略
+func (ss Sinks) Delete(cluster, hostId string, samples []Sample) error {
+	for _, s := range ss {
+		if store, ok := s.Writer.(seriesStore); ok {
+			if er := store.Delete(cluster, hostId, samples); er != nil {
+				return er
+			}
+		}
+	}
+	return nil
+}
+
+// Resolve 从exporter中删除这些序列, 其他输出方式输出这些数据(值为0)
+func (ss Sinks) Resolve(cluster, hostId string, samples []Sample) error {
+	for _, s := range ss {
+		if _, ok := s.Writer.(seriesStore); ok || s.Events {
+			continue
+		}
+		if er := s.write(cluster, hostId, samples, false); er != nil {
+			return er
+		}
+	}
+	return ss.Delete(cluster, hostId, samples)
+}
+
+// Retain 删除exporter中该集群不在 hostIds 中的主机的序列
+func (ss Sinks) Retain(cluster string, hostIds []string) {
+	for _, s := range ss {
+		if store, ok := s.Writer.(seriesStore); ok {
+			store.Retain(cluster, hostIds)
+		}
+	}
+}
+
+// WriteEvents 写入所有事件输出
+func (ss Sinks) WriteEvents(events []Event) error {
+	return ss.writeEvents(events, false)
+}
+
+// WriteEventsWait 缓存已满时等待, 同 WriteWait
+func (ss Sinks) WriteEventsWait(events []Event) error {
+	return ss.writeEvents(events, true)
+}
+
+func (ss Sinks) writeEvents(events []Event, wait bool) error {
+	for _, s := range ss {
+		if s.Events {
+			s.enqueue(sinkEntry{events: events}, len(events), wait)
+		}
+	}
+	return nil
+}
+
+// HasEvents 是否有事件输出, 没有时不处理日志类型的item
+func (ss Sinks) HasEvents() bool {
+	for _, s := range ss {
+		if s.Events {
+			return true
+		}
+	}
+	return false
+}
+
+// HasStore 是否有exporter输出
+func (ss Sinks) HasStore() bool {
+	for _, s := range ss {
+		if _, ok := s.Writer.(seriesStore); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Flush 同步周期结束时不等待, backfill 及退出时等待全部写出.
+// wait 为true时返回第一个有数据丢弃或写入失败的输出的错误, backfill 出错时不保存进度
+func (ss Sinks) Flush(wait bool) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(ss))
+	for i, s := range ss {
+		wg.Add(1)
+		go func(i int, s *Sink) {
+			defer wg.Done()
+			errs[i] = s.flush(wait)
+		}(i, s)
+	}
+	wg.Wait()
+	for i, er := range errs {
+		if er != nil {
+			return fmt.Errorf("sink %s:%s", ss[i].Name, er)
+		}
+	}
+	return nil
+}
+
+// TextWriter 逐行输出到标准输出或文件
+type TextWriter struct {
+	Format string
+	Writer *bufio.Writer
+	// Locker 多个输出共用 Writer 时(标准输出)不为nil
+	Locker *sync.Mutex
+}
+
+// stdout 数据及 --logEvents - 都输出到标准输出时共用, 避免行交错
+var (
+	stdout       = bufio.NewWriter(os.Stdout)
+	stdoutLocker sync.Mutex
+)
+
+func NewTextWriter(format string, w io.Writer) *TextWriter {
+	return &TextWriter{Format: format, Writer: bufio.NewWriter(w)}
+}
+
+func NewStdoutWriter(format string) *TextWriter {
+	return &TextWriter{Format: format, Writer: stdout, Locker: &stdoutLocker}
+}
+
+func (t *TextWriter) Write(_, _ string, samples []Sample) error {
+	if t.Locker != nil {
+		t.Locker.Lock()
+		defer t.Locker.Unlock()
+	}
+	for _, s := range samples {
+		line, ok := formatSample(t.Format, s)
+		if !ok {
+			continue
+		}
+		if _, er := fmt.Fprintln(t.Writer, line); er != nil {
+			return er
+		}
+	}
+	return nil
+}
+
+func (t *TextWriter) WriteEvents(events []Event) error {
+	lines, er := eventLines(events)
+	if er != nil {
+		return er
+	}
+	if t.Locker != nil {
+		t.Locker.Lock()
+		defer t.Locker.Unlock()
+	}
+	for _, line := range lines {
+		if _, er := fmt.Fprintln(t.Writer, line); er != nil {
+			return er
+		}
+	}
+	return nil
+}
+
+func (t *TextWriter) Flush() error {
+	if t.Locker != nil {
+		t.Locker.Lock()
+		defer t.Locker.Unlock()
+	}
+	er := t.Writer.Flush()
+	if er != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "flush output failed:%s\n", er)
+	}
+	return er
+}
+
+// HttpWriter 以文本格式批量POST到 Url, 如 victoriametrics 的 /api/v1/import/prometheus 或 /write
+type HttpWriter struct {
+	Url    string
+	Format string
+	// ContentType 事件输出为 application/x-ndjson
+	ContentType string
+	Headers     map[string]string
+	BatchSize   int
+	Client      *http.Client
+	Lines       []string
+	// Failed 累计发送失败的行数, dropped 为上次 Flush 之后发送失败的行数
+	Failed  int64
+	dropped int64
+}
+
+func NewHttpWriter(c SinkConfig) *HttpWriter {
+	if c.BatchSize <= 0 {
+		c.BatchSize = defaultHttpBatch
+	}
+	contentType := "text/plain; charset=utf-8"
+	if c.Events {
+		contentType = "application/x-ndjson"
+	}
+	return &HttpWriter{Url: c.Url, Format: c.Format, ContentType: contentType, Headers: c.Headers,
+		BatchSize: c.BatchSize, Client: createHTTPClient()}
+}
+
+func (h *HttpWriter) Write(_, _ string, samples []Sample) error {
+	for _, s := range samples {
+		if line, ok := formatSample(h.Format, s); ok {
+			h.Lines = append(h.Lines, line)
+		}
+	}
+	if len(h.Lines) >= h.BatchSize {
+		h.send()
+	}
+	return nil
+}
+
+func (h *HttpWriter) WriteEvents(events []Event) error {
+	lines, er := eventLines(events)
+	if er != nil {
+		return er
+	}
+	h.Lines = append(h.Lines, lines...)
+	if len(h.Lines) >= h.BatchSize {
+		h.send()
+	}
+	return nil
+}
+
+func (h *HttpWriter) Flush() error {
+	h.send()
+	dropped := h.dropped
+	h.dropped = 0
+	if dropped > 0 {
+		return fmt.Errorf("dropped %d lines", dropped)
+	}
+	return nil
+}
+
+// send 发送缓存的全部行
+func (h *HttpWriter) send() {
+	lines := h.Lines
+	h.Lines = nil
+	for start := 0; start < len(lines); start += h.BatchSize {
+		end := start + h.BatchSize
+		if end > len(lines) {
+			end = len(lines)
+		}
+		if er := h.post(lines[start:end]); er != nil {
+			h.Failed += int64(end - start)
+			h.dropped += int64(end - start)
+			_, _ = fmt.Fprintf(os.Stderr, "http push %s failed, dropped %d lines (total %d):%s\n",
+				h.Url, end-start, h.Failed, er)
+		}
+	}
+}
+
+func (h *HttpWriter) post(lines []string) error {
+	body := []byte(strings.Join(lines, "\n") + "\n")
+	return pushWithRetry(h.Client, func() (*http.Request, error) {
+		req, er := http.NewRequest("POST", h.Url, bytes.NewReader(body))
+		if er != nil {
+			return nil, er
+		}
+		req.Header.Set("Content-Type", h.ContentType)
+		for k, v := range h.Headers {
+			req.Header.Set(k, v)
+		}
+		return req, nil
+	})
+}
+
+// newSink 按配置创建输出, exporter 同时启动http服务
+func newSink(c SinkConfig) (*Sink, error) {
+	if c.Name == "" {
+		c.Name = c.Type
+	}
+	if c.Format == "" {
+		c.Format = zabbixConfig.DataFormat
+	}
+	if c.Buffer <= 0 {
+		c.Buffer = zabbixConfig.SinkBuffer
+	}
+	var writer SinkWriter
+	switch c.Type {
+	case "stdout":
+		writer = NewStdoutWriter(c.Format)
+	case "file":
+		if c.Path == "" {
+			return nil, fmt.Errorf("sink %s: path 不能为空", c.Name)
+		}
+		f, er := os.OpenFile(c.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if er != nil {
+			return nil, fmt.Errorf("sink %s:%s", c.Name, er)
+		}
+		writer = NewTextWriter(c.Format, f)
+	case "http":
+		if c.Url == "" {
+			return nil, fmt.Errorf("sink %s: url 不能为空", c.Name)
+		}
+		writer = NewHttpWriter(c)
+	case "remoteWrite":
+		if c.Url == "" {
+			return nil, fmt.Errorf("sink %s: url 不能为空", c.Name)
+		}
+		writer = NewRemoteWriter(c.Url)
+	case "influx":
+		if c.Influx.Url == "" {
+			return nil, fmt.Errorf("sink %s: influx.url 不能为空", c.Name)
+		}
+		w := NewInfluxWriter(c.Influx)
+		go w.Run()
+		writer = w
+	case "exporter":
+		if c.Listen == "" {
+			return nil, fmt.Errorf("sink %s: listen 不能为空", c.Name)
+		}
+		store := NewMetricStore()
+		serveMetrics(c.Listen, store)
+		writer = store
+	default:
+		return nil, fmt.Errorf("sink %s: unknown type %s", c.Name, c.Type)
+	}
+	if _, ok := writer.(eventWriter); c.Events && !ok {
+		return nil, fmt.Errorf("sink %s: %s 不支持 events", c.Name, c.Type)
+	}
+	s := NewSink(c.Name, writer, c.Buffer)
+	s.Events = c.Events
+	return s, nil
+}
+
+// sinkConfigs 命令行参数对应的输出及 --config 中的 sinks
+func sinkConfigs(configs []SinkConfig) []SinkConfig {
+	var res []SinkConfig
+	if zabbixConfig.Listen != "" {
+		res = append(res, SinkConfig{Type: "exporter", Listen: zabbixConfig.Listen})
+	}
+	if zabbixConfig.RemoteWrite != "" {
+		res = append(res, SinkConfig{Type: "remoteWrite", Url: zabbixConfig.RemoteWrite})
+	}
+	if zabbixConfig.Influx.Url != "" {
+		res = append(res, SinkConfig{Type: "influx", Influx: zabbixConfig.Influx})
+	}
+	res = append(res, configs...)
+	events := 0
+	for _, c := range res {
+		if c.Events {
+			events++
+		}
+	}
+	if len(res) == events {
+		res = append(res, SinkConfig{Type: "stdout"})
+	}
+	if zabbixConfig.LogEvents != "" {
+		res = append(res, logEventsSink(zabbixConfig.LogEvents))
+	}
+	return res
+}
+
+// createSinks 名称重复或创建失败时返回错误
+func createSinks(configs []SinkConfig) (Sinks, error) {
+	var res Sinks
+	names := map[string]struct{}{}
+	for _, c := range configs {
+		if c.Name == "" {
+			c.Name = c.Type
+		}
+		if _, ok := names[c.Name]; ok {
+			return nil, fmt.Errorf("duplicate sink name:%s", c.Name)
+		}
+		names[c.Name] = struct{}{}
+		s, er := newSink(c)
+		if er != nil {
+			return nil, er
+		}
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+// logEventsSink --logEvents: '-' 为标准输出, http(s) 地址为POST, 否则为文件
+func logEventsSink(target string) SinkConfig {
+	c := SinkConfig{Name: "events", Type: "file", Path: target, Events: true}
+	switch {
+	case target == "-":
+		c.Type = "stdout"
+	case strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://"):
+		c.Type, c.Url = "http", target
+	}
+	return c
+}
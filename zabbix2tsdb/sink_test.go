@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingWriter 写入时阻塞直到 release 关闭, 模拟写入慢的输出
+type blockingWriter struct {
+	release chan struct{}
+}
+
+func (b *blockingWriter) Write(_, _ string, _ []Sample) error {
+	<-b.release
+	return nil
+}
+
+func (b *blockingWriter) Flush() error {
+	return nil
+}
+
+// TestSinksWriteWait 缓存已满时 WriteWait 等待写出, 不丢弃数据
+func TestSinksWriteWait(t *testing.T) {
+	slow := &blockingWriter{release: make(chan struct{})}
+	sink := NewSink("slow", slow, 1)
+	ss := Sinks{sink}
+	s := Sample{Name: "system_uptime", Value: 1, Timestamp: 1690892492000}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			_ = ss.WriteWait("0", "10084", []Sample{s})
+		}
+	}()
+	select {
+	case <-done:
+		t.Fatal("write should wait for the full buffer")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(slow.release)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("write blocked after the sink was released")
+	}
+	if n := atomic.LoadInt64(&sink.Dropped); n != 0 {
+		t.Errorf("got %d dropped samples, want 0", n)
+	}
+}
+
+// TestSinksFanOut 每个输出独立缓存, 写入慢的输出不影响其他输出
+func TestSinksFanOut(t *testing.T) {
+	slow := &blockingWriter{release: make(chan struct{})}
+	defer close(slow.release)
+	fast := &recordWriter{}
+	store := NewMetricStore()
+	ss := Sinks{NewSink("slow", slow, 1), NewSink("fast", fast, 10), NewSink("exporter", store, 0)}
+	s := Sample{Name: "system_uptime", Labels: []Label{{Name: "c", Value: "0"}}, Value: 1, Timestamp: 1690892492000}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			_ = ss.Write("0", "10084", []Sample{s})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("write blocked on the slow sink")
+	}
+	ss[1].flush(true)
+	if len(fast.samples) != 3 {
+		t.Errorf("fast sink got %d samples, want 3", len(fast.samples))
+	}
+	if n := len(store.Clusters["0"]["10084"]); n != 1 {
+		t.Errorf("exporter got %d series, want 1", n)
+	}
+	if atomic.LoadInt64(&ss[0].Dropped) == 0 {
+		t.Error("slow sink should drop samples when its buffer is full")
+	}
+
+	// Resolve: exporter删除该序列, 其他输出写入值为0的数据
+	fast.samples = nil
+	resolved := s
+	resolved.Value = 0
+	if er := (Sinks{ss[1], ss[2]}).Resolve("0", "10084", []Sample{resolved}); er != nil {
+		t.Fatal(er)
+	}
+	ss[1].flush(true)
+	if len(fast.samples) != 1 || fast.samples[0].Value != 0 {
+		t.Errorf("fast sink got %+v, want one resolved sample", fast.samples)
+	}
+	if n := len(store.Clusters["0"]["10084"]); n != 0 {
+		t.Errorf("exporter got %d series after resolve, want 0", n)
+	}
+}
+
+// TestSinksEvents 事件只写入事件输出, 事件输出不接收数据; 不支持事件的输出不能配置 events
+func TestSinksEvents(t *testing.T) {
+	var buf bytes.Buffer
+	events := NewSink("events", NewTextWriter(formatInfluxdb, &buf), 10)
+	events.Events = true
+	data := &recordWriter{}
+	ss := Sinks{NewSink("data", data, 10), events}
+	if !ss.HasEvents() || ss[:1].HasEvents() {
+		t.Error("only the events sink should receive events")
+	}
+	s := Sample{Name: "system_uptime", Labels: []Label{{Name: "c", Value: "0"}}, Value: 1, Timestamp: 1690892492000}
+	e := Event{Timestamp: "2023-08-01T12:21:32Z", Cluster: "0", HostId: "10084", Key: "log[/var/log/messages]", Value: "kernel: oops"}
+	_ = ss.Write("0", "10084", []Sample{s})
+	_ = ss.WriteEvents([]Event{e})
+	ss.Flush(true)
+	lines, _ := eventLines([]Event{e})
+	if got := buf.String(); got != lines[0]+"\n" {
+		t.Errorf("events sink got %q, want %q", got, lines[0])
+	}
+	if len(data.samples) != 1 {
+		t.Errorf("data sink got %d samples, want 1", len(data.samples))
+	}
+
+	if _, er := createSinks([]SinkConfig{{Type: "remoteWrite", Url: "http://127.0.0.1", Events: true}}); er == nil || er.Error() != "sink remoteWrite: remoteWrite 不支持 events" {
+		t.Errorf("got %v, want remoteWrite events error", er)
+	}
+	created, er := createSinks([]SinkConfig{
+		{Name: "a", Type: "file", Path: filepath.Join(t.TempDir(), "a")},
+		{Name: "b", Type: "file", Path: filepath.Join(t.TempDir(), "b"), Events: true},
+	})
+	if er != nil || len(created) != 2 || created[0].Events || !created[1].Events {
+		t.Errorf("got %v %v", created, er)
+	}
+}
+
+func TestCreateSinks(t *testing.T) {
+	for _, tc := range []struct {
+		configs []SinkConfig
+		want    string
+	}{
+		{[]SinkConfig{{Type: "file", Path: filepath.Join(t.TempDir(), "a")}, {Type: "file", Path: filepath.Join(t.TempDir(), "b")}}, "duplicate sink name:file"},
+		{[]SinkConfig{{Type: "file"}}, "sink file: path 不能为空"},
+		{[]SinkConfig{{Type: "http"}}, "sink http: url 不能为空"},
+		{[]SinkConfig{{Type: "influx"}}, "sink influx: influx.url 不能为空"},
+		{[]SinkConfig{{Type: "kafka"}}, "sink kafka: unknown type kafka"},
+	} {
+		if _, er := createSinks(tc.configs); er == nil || er.Error() != tc.want {
+			t.Errorf("got %v, want %s", er, tc.want)
+		}
+	}
+	ss, er := createSinks([]SinkConfig{
+		{Name: "a", Type: "file", Path: filepath.Join(t.TempDir(), "a")},
+		{Name: "b", Type: "file", Path: filepath.Join(t.TempDir(), "b"), Format: "prometheus"},
+	})
+	if er != nil || len(ss) != 2 || ss[1].Writer.(*TextWriter).Format != "prometheus" {
+		t.Errorf("got %v %v", ss, er)
+	}
+}
+
+// TestStdoutWriters 数据及事件都输出到标准输出时共用一个 Writer, 并发写入时行不交错
+func TestStdoutWriters(t *testing.T) {
+	data, events := NewStdoutWriter("influxdb"), NewStdoutWriter("influxdb")
+	if data.Writer != events.Writer || data.Locker != events.Locker {
+		t.Fatal("stdout writers should share the writer and locker")
+	}
+	var buf bytes.Buffer
+	var locker sync.Mutex
+	shared := bufio.NewWriterSize(&buf, 64)
+	data = &TextWriter{Format: "influxdb", Writer: shared, Locker: &locker}
+	events = &TextWriter{Format: "influxdb", Writer: shared, Locker: &locker}
+	sample := Sample{Name: "system_uptime", Labels: []Label{{Name: "c", Value: "0"}}, Value: 1, Timestamp: 1690892492000}
+	event := Event{Timestamp: "2023-08-01T12:21:32Z", Cluster: "0", HostId: "10084", Key: "log[/var/log/messages]", Value: "kernel: oops"}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_ = data.Write("0", "10084", []Sample{sample, sample})
+			data.Flush()
+		}()
+		go func() {
+			defer wg.Done()
+			_ = events.WriteEvents([]Event{event})
+			events.Flush()
+		}()
+	}
+	wg.Wait()
+	line, _ := formatInfluxSample(sample)
+	want := map[string]bool{line: true}
+	lines, _ := eventLines([]Event{event})
+	want[lines[0]] = true
+	got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(got) != 150 {
+		t.Fatalf("got %d lines, want 150", len(got))
+	}
+	for _, line := range got {
+		if !want[line] {
+			t.Fatalf("interleaved line %q", line)
+		}
+	}
+}
+
+// TestEmitDoesNotWait 开启实时导出后, 轮询输出的主机状态等数据在缓存已满时仍然丢弃, 不等待写入慢的输出
+func TestEmitDoesNotWait(t *testing.T) {
+	slow := &blockingWriter{release: make(chan struct{})}
+	defer close(slow.release)
+	defer func(s Sinks) { sinks = s }(sinks)
+	sink := NewSink("slow", slow, 1)
+	sinks = Sinks{sink}
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: "http://127.0.0.1", ExportDir: t.TempDir()})
+	if er != nil {
+		t.Fatal(er)
+	}
+	s := Sample{Name: "zabbix_host_monitored", Value: 1, Timestamp: 1690892492000}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			_ = c.emit("10084", s)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("emit blocked on a full sink buffer")
+	}
+	if atomic.LoadInt64(&sink.Dropped) == 0 {
+		t.Error("samples should be dropped when the buffer is full")
+	}
+}
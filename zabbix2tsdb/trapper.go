@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// zabbix 通信协议: "ZBXD" + flags + 数据长度 + 保留字段(压缩时为原始长度), 长度为小端序
+	zbxdHeader         = "ZBXD"
+	zbxdFlagProtocol   = 0x01
+	zbxdFlagCompressed = 0x02
+	zbxdFlagLarge      = 0x04
+	// trapperMaxSize 单个请求(解压后)的最大长度, 避免异常请求占用过多内存. agent 默认每次最多发送100条
+	trapperMaxSize = 16 << 20
+	trapperTimeout = 30 * time.Second
+	// trapperFlushInterval 接收到的数据合并后定时flush, 不在每个连接结束时flush
+	trapperFlushInterval = time.Second
+	// activeChecksTTL agent 主动模式的item列表缓存时间, 6.4+ 的agent默认每5秒请求一次
+	activeChecksTTL = time.Minute
+	// itemTypeZabbixActive item类型: zabbix agent(主动式)
+	itemTypeZabbixActive = "7"
+
+	metricTrapperValues      = "zabbix2tsdb_trapper_values_total"
+	metricTrapperConnections = "zabbix2tsdb_trapper_denied_connections_total"
+)
+
+// trapperRequest zabbix_sender 的 sender data, agent 主动模式的 active checks 及 agent data
+type trapperRequest struct {
+	Request string         `json:"request"`
+	Data    []trapperValue `json:"data"`
+	Clock   int64          `json:"clock"`
+	Ns      int64          `json:"ns"`
+	// Host active checks 请求的主机名称
+	Host string `json:"host"`
+}
+
+type trapperValue struct {
+	Host  string      `json:"host"`
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+	Clock int64       `json:"clock"`
+	Ns    int64       `json:"ns"`
+	// State agent data 中为1时表示item不支持, value 为错误信息
+	State int `json:"state"`
+	// LastLogSize 只有日志类型的item有
+	LastLogSize *int64 `json:"lastlogsize"`
+}
+
+// trapperPending 上次flush之后处理的数量
+var trapperPending int64
+
+type trapperResponse struct {
+	Response string `json:"response"`
+	Info     string `json:"info,omitempty"`
+	// Data active checks 的响应, 主机需要主动采集的item([]activeCheck), 没有item时也需要输出空数组
+	Data interface{} `json:"data,omitempty"`
+}
+
+// activeCheck active checks 响应中的一个item, 4.0 起的agent都支持该格式
+type activeCheck struct {
+	Key         string `json:"key"`
+	ItemId      uint64 `json:"itemid,omitempty"`
+	Delay       string `json:"delay"`
+	LastLogSize int64  `json:"lastlogsize"`
+	Mtime       int64  `json:"mtime"`
+}
+
+// activeChecks 缓存的主机item列表
+type activeChecks struct {
+	Expires time.Time
+	Checks  []activeCheck
+}
+
+// parseAllowedSenders 解析 --trapperAllow, 支持ip及CIDR, 与agent的 Server 参数一致
+func parseAllowedSenders(allow []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(allow))
+	for _, s := range allow {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trapper allow address:%s", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, er := net.ParseCIDR(s)
+		if er != nil {
+			return nil, fmt.Errorf("invalid trapper allow address:%s", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// allowedSender 连接的地址是否在 --trapperAllow 中
+func allowedSender(addr net.Addr, nets []*net.IPNet) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveTrapper 监听 zabbix trapper 端口, 只接受 allow 中的地址的连接. 接收 zabbix_sender 及 agent 主动推送的数据,
+// 按主机名称找到同步中的主机后与 item.get 的数据一样转换输出
+func serveTrapper(listen string, allow []string) error {
+	nets, er := parseAllowedSenders(allow)
+	if er != nil {
+		return er
+	}
+	l, er := net.Listen("tcp", listen)
+	if er != nil {
+		return er
+	}
+	go flushTrapper()
+	go func() {
+		for {
+			conn, er := l.Accept()
+			if er != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "trapper accept failed:%s\n", er)
+				time.Sleep(time.Second)
+				continue
+			}
+			if !allowedSender(conn.RemoteAddr(), nets) {
+				selfMetrics.Add(metricTrapperConnections, metricTypeCounter, 1)
+				_, _ = fmt.Fprintf(os.Stderr, "trapper connection from %s is not allowed\n", conn.RemoteAddr())
+				_ = conn.Close()
+				continue
+			}
+			go handleTrapper(conn)
+		}
+	}()
+	return nil
+}
+
+func handleTrapper(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(trapperTimeout))
+	data, er := readZbxd(conn)
+	if er != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "trapper read from %s failed:%s\n", conn.RemoteAddr(), er)
+		return
+	}
+	var req trapperRequest
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	resp := trapperResponse{Response: "success"}
+	switch er := decoder.Decode(&req); {
+	case er != nil:
+		resp = trapperResponse{Response: "failed", Info: fmt.Sprintf("cannot parse request:%s", er)}
+	case req.Request == "active checks":
+		resp = trapperActiveChecks(req.Host)
+	case req.Request != "sender data" && req.Request != "agent data":
+		resp = trapperResponse{Response: "failed", Info: fmt.Sprintf("unsupported request %q", req.Request)}
+	default:
+		start := time.Now()
+		processed := processTrapper(req)
+		resp.Info = fmt.Sprintf("processed: %d; failed: %d; total: %d; seconds spent: %.6f",
+			processed, len(req.Data)-processed, len(req.Data), time.Since(start).Seconds())
+	}
+	body, _ := json.Marshal(resp)
+	if er := writeZbxd(conn, body); er != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "trapper write to %s failed:%s\n", conn.RemoteAddr(), er)
+	}
+}
+
+// trapperActiveChecks 返回主机需要主动采集的item, 主机不在同步范围时返回failed
+func trapperActiveChecks(host string) trapperResponse {
+	for _, c := range clusters {
+		hostId, found := c.Hosts.Id(host)
+		if !found {
+			continue
+		}
+		checks, er := c.activeChecks(hostId)
+		if er != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "cluster %s query active checks of %s failed:%s\n", c.Config.Cluster, host, er)
+			return trapperResponse{Response: "failed", Info: fmt.Sprintf("cannot get active checks of host [%s]", host)}
+		}
+		return trapperResponse{Response: "success", Data: checks}
+	}
+	return trapperResponse{Response: "failed", Info: fmt.Sprintf("host [%s] not found", host)}
+}
+
+// activeChecks 查询主机已启用的 zabbix agent(主动式) item, 只返回匹配 --acceptKeys 的, 结果缓存 activeChecksTTL
+func (c *Cluster) activeChecks(hostId string) ([]activeCheck, error) {
+	if v, ok := c.ActiveChecks.Load(hostId); ok && time.Now().Before(v.(activeChecks).Expires) {
+		return v.(activeChecks).Checks, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), trapperTimeout)
+	defer cancel()
+	result, er := c.Api.request(ctx, "item.get", c.Api.itemParams(map[string]interface{}{
+		"output":    []string{"itemid", "key_", "delay"},
+		"hostids":   []string{hostId},
+		"filter":    map[string]interface{}{"type": itemTypeZabbixActive},
+		"monitored": true,
+	}))
+	if er != nil {
+		return nil, er
+	}
+	items, _ := result.([]interface{})
+	checks := make([]activeCheck, 0, len(items))
+	for _, v := range items {
+		item := v.(map[string]interface{})
+		itemId, _ := strconv.ParseUint(fmt.Sprint(item["itemid"]), 10, 64)
+		checks = append(checks, activeCheck{
+			Key:    fmt.Sprint(item["key_"]),
+			ItemId: itemId,
+			Delay:  strconv.FormatInt(itemDelay(fmt.Sprint(item["delay"]), c.Config.Interval), 10),
+		})
+	}
+	c.ActiveChecks.Store(hostId, activeChecks{Expires: time.Now().Add(activeChecksTTL), Checks: checks})
+	return checks, nil
+}
+
+// delayUnits item 更新间隔的时间后缀
+var delayUnits = map[byte]int64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}
+
+// itemDelay 转换item的更新间隔为秒, 忽略自定义间隔. 包含宏或无法解析时(如只有自定义间隔)使用 fallback
+func itemDelay(delay string, fallback int64) int64 {
+	if i := strings.Index(delay, ";"); i >= 0 {
+		delay = delay[:i]
+	}
+	unit := int64(1)
+	if n := len(delay); n > 0 {
+		if u, ok := delayUnits[delay[n-1]]; ok {
+			unit, delay = u, delay[:n-1]
+		}
+	}
+	seconds, er := strconv.ParseInt(delay, 10, 64)
+	if er != nil || seconds <= 0 {
+		return fallback
+	}
+	return seconds * unit
+}
+
+// processTrapper 返回成功处理的数量. 主机不在同步范围, key 不匹配 --acceptKeys, 不支持的item及无法转换的值为失败
+func processTrapper(req trapperRequest) int {
+	processed := 0
+	now := time.Now()
+	for _, v := range req.Data {
+		ok := false
+		for _, c := range clusters {
+			hostId, found := c.Hosts.Id(v.Host)
+			if !found {
+				continue
+			}
+			ok = c.processTrapperValue(hostId, v, now)
+			break
+		}
+		status := "failed"
+		if ok {
+			processed++
+			status = "processed"
+		}
+		selfMetrics.Add(metricTrapperValues, metricTypeCounter, 1, "status", status)
+	}
+	atomic.AddInt64(&trapperPending, int64(processed))
+	return processed
+}
+
+// flushTrapper 有新数据时定时flush
+func flushTrapper() {
+	ticker := time.NewTicker(trapperFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if atomic.SwapInt64(&trapperPending, 0) > 0 {
+			sinks.Flush(false)
+		}
+	}
+}
+
+// processTrapperValue 生成与 item.get 结果相同的item后按 processMetric 处理, 没有时间戳时使用接收时间.
+// 有 lastlogsize 的为日志类型, 数值为浮点数类型, 其他为字符类型, 需要匹配 --infoKeys
+func (c *Cluster) processTrapperValue(hostId string, v trapperValue, now time.Time) bool {
+	if v.State != 0 || v.Key == "" || !matchAny(c.AcceptKeys, v.Key) {
+		return false
+	}
+	value := fmt.Sprint(v.Value)
+	clock, ns := v.Clock, v.Ns
+	if clock == 0 {
+		clock, ns = now.Unix(), int64(now.Nanosecond())
+	}
+	item := map[string]interface{}{
+		"key_":       v.Key,
+		"hostid":     hostId,
+		"lastvalue":  value,
+		"lastclock":  strconv.FormatInt(clock, 10),
+		"ns":         strconv.FormatInt(ns, 10),
+		"value_type": valueTypeChar,
+	}
+	if v.LastLogSize != nil {
+		item["value_type"] = valueTypeLog
+	} else if _, er := parseValue(value); er == nil {
+		item["value_type"] = valueTypeFloat
+	}
+	if !c.exported(item) {
+		return false
+	}
+	// 值作为label输出时(_info, 值映射)需要记录上次的序列, 以主机及key作为item的标识
+	if item["value_type"] != valueTypeLog {
+		itemId := hostId + ":" + v.Key
+		item["itemid"] = itemId
+		c.ItemStates.LoadOrStore(itemId, &itemState{HostId: hostId, Key: v.Key, Clock: item["lastclock"].(string)})
+	}
+	if er := c.processMetric(item, false); er != nil {
+		_, _ = fmt.Fprintln(os.Stderr, er.Error())
+		return false
+	}
+	return true
+}
+
+// readZbxd 读取一个完整的请求, 支持压缩(zlib)及大数据包(8字节长度)
+func readZbxd(r io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, er := io.ReadFull(r, header); er != nil {
+		return nil, er
+	}
+	if string(header[:4]) != zbxdHeader || header[4]&zbxdFlagProtocol == 0 {
+		return nil, fmt.Errorf("invalid header %q", header)
+	}
+	flags := header[4]
+	var size, reserved uint64
+	if flags&zbxdFlagLarge != 0 {
+		lengths := make([]byte, 16)
+		if _, er := io.ReadFull(r, lengths); er != nil {
+			return nil, er
+		}
+		size, reserved = binary.LittleEndian.Uint64(lengths[:8]), binary.LittleEndian.Uint64(lengths[8:])
+	} else {
+		lengths := make([]byte, 8)
+		if _, er := io.ReadFull(r, lengths); er != nil {
+			return nil, er
+		}
+		size, reserved = uint64(binary.LittleEndian.Uint32(lengths[:4])), uint64(binary.LittleEndian.Uint32(lengths[4:]))
+	}
+	if size > trapperMaxSize || (flags&zbxdFlagCompressed != 0 && reserved > trapperMaxSize) {
+		return nil, fmt.Errorf("message size %d exceeds %d", size, trapperMaxSize)
+	}
+	data := make([]byte, size)
+	if _, er := io.ReadFull(r, data); er != nil {
+		return nil, er
+	}
+	if flags&zbxdFlagCompressed == 0 {
+		return data, nil
+	}
+	zr, er := zlib.NewReader(bytes.NewReader(data))
+	if er != nil {
+		return nil, er
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(io.LimitReader(zr, int64(reserved)))
+}
+
+// writeZbxd 响应不压缩
+func writeZbxd(w io.Writer, data []byte) error {
+	msg := make([]byte, 13, 13+len(data))
+	copy(msg, zbxdHeader)
+	msg[4] = zbxdFlagProtocol
+	binary.LittleEndian.PutUint32(msg[5:9], uint32(len(data)))
+	_, er := w.Write(append(msg, data...))
+	return er
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestProcessTrapperValueConcurrent 多个连接同时发送同一个 _info item 的不同值, 最后只保留一个序列
+func TestProcessTrapperValueConcurrent(t *testing.T) {
+	store := NewMetricStore()
+	defer func(s Sinks) { sinks = s }(sinks)
+	sinks = Sinks{NewSink("exporter", store, 0)}
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: "http://127.0.0.1", AccetpKeys: []string{"*"}, InfoKeys: []string{"app.version"}})
+	if er != nil {
+		t.Fatal(er)
+	}
+	c.HostIdHost.Store("10084", "web_01")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v := trapperValue{Host: "web_01", Key: "app.version", Value: fmt.Sprintf("1.0.%d", i)}
+			if !c.processTrapperValue("10084", v, time.Now()) {
+				t.Errorf("value %v not processed", v.Value)
+			}
+		}(i)
+	}
+	wg.Wait()
+	series := store.Clusters["0"]["10084"]
+	if len(series) != 1 {
+		t.Fatalf("got %d series, want 1: %v", len(series), series)
+	}
+	v, _ := c.ItemStates.Load("10084:app.version")
+	state := v.(*itemState)
+	if _, ok := series[state.Labeled.Series()]; !ok {
+		t.Errorf("last labeled series %s not in store %v", state.Labeled.Series(), series)
+	}
+}
+
+func TestAllowedSender(t *testing.T) {
+	nets, er := parseAllowedSenders([]string{"127.0.0.1", "::1", "10.0.0.0/8"})
+	if er != nil {
+		t.Fatal(er)
+	}
+	for addr, want := range map[string]bool{
+		"127.0.0.1": true, "::1": true, "10.1.2.3": true, "::ffff:10.1.2.3": true, "192.168.1.10": false, "127.0.0.2": false,
+	} {
+		if got := allowedSender(&net.TCPAddr{IP: net.ParseIP(addr), Port: 50000}, nets); got != want {
+			t.Errorf("allowedSender(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	if _, er := parseAllowedSenders([]string{"10.0.0.0/33"}); er == nil {
+		t.Error("invalid cidr should fail")
+	}
+}
+
+func TestItemDelay(t *testing.T) {
+	for delay, want := range map[string]int64{
+		"30": 30, "1m": 60, "2h": 7200, "1d": 86400, "1m;50s/1-5,09:00-18:00": 60, "0;wd1-5h9-18": 60, "{$INTERVAL}": 60, "": 60,
+	} {
+		if got := itemDelay(delay, 60); got != want {
+			t.Errorf("itemDelay(%q) = %d, want %d", delay, got, want)
+		}
+	}
+}
+
+// TestTrapperActiveChecks agent 主动模式获取同步中主机的item列表, 不在同步范围的主机返回failed
+func TestTrapperActiveChecks(t *testing.T) {
+	server := fakeZabbix(t, map[string]interface{}{
+		"apiinfo.version": "6.0.0",
+		"user.login":      "session",
+		"item.get": []interface{}{
+			map[string]interface{}{"itemid": "23000", "key_": "system.cpu.load[all,avg1]", "delay": "1m"},
+			map[string]interface{}{"itemid": "23001", "key_": "log[/var/log/messages]", "delay": "{$LOG_INTERVAL}"},
+		},
+	})
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: server.URL, Interval: 30})
+	if er != nil {
+		t.Fatal(er)
+	}
+	if er := c.Api.Login(); er != nil {
+		t.Fatal(er)
+	}
+	c.Hosts.SetNames(map[string]string{"web 01": "10084"})
+	defer func(cs []*Cluster) { clusters = cs }(clusters)
+	clusters = []*Cluster{c}
+	got, _ := json.Marshal(trapperActiveChecks("web 01"))
+	want := `{"response":"success","data":[{"key":"system.cpu.load[all,avg1]","itemid":23000,"delay":"60","lastlogsize":0,"mtime":0},` +
+		`{"key":"log[/var/log/messages]","itemid":23001,"delay":"30","lastlogsize":0,"mtime":0}]}`
+	if string(got) != want {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+	if resp := trapperActiveChecks("db 01"); resp.Response != "failed" {
+		t.Errorf("unknown host got %+v", resp)
+	}
+}
+
+func TestReadZbxdMaxSize(t *testing.T) {
+	header := []byte(zbxdHeader + string([]byte{zbxdFlagProtocol}))
+	lengths := make([]byte, 8)
+	binary.LittleEndian.PutUint32(lengths[:4], trapperMaxSize+1)
+	if _, er := readZbxd(bytes.NewReader(append(header, lengths...))); er == nil {
+		t.Error("oversized message should fail")
+	}
+}
+
+// TestReadZbxd 支持普通, 压缩及大数据包格式, 拒绝错误的协议头
+func TestReadZbxd(t *testing.T) {
+	data := []byte(`{"request":"sender data","data":[]}`)
+	var plain bytes.Buffer
+	if er := writeZbxd(&plain, data); er != nil {
+		t.Fatal(er)
+	}
+
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	_, _ = zw.Write(data)
+	_ = zw.Close()
+	zipped := make([]byte, 13)
+	copy(zipped, zbxdHeader)
+	zipped[4] = zbxdFlagProtocol | zbxdFlagCompressed
+	binary.LittleEndian.PutUint32(zipped[5:9], uint32(compressed.Len()))
+	binary.LittleEndian.PutUint32(zipped[9:13], uint32(len(data)))
+	zipped = append(zipped, compressed.Bytes()...)
+
+	large := make([]byte, 21)
+	copy(large, zbxdHeader)
+	large[4] = zbxdFlagProtocol | zbxdFlagLarge
+	binary.LittleEndian.PutUint64(large[5:13], uint64(len(data)))
+	large = append(large, data...)
+
+	for name, msg := range map[string][]byte{"plain": plain.Bytes(), "compressed": zipped, "large": large} {
+		got, er := readZbxd(bytes.NewReader(msg))
+		if er != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: got %q %v, want %q", name, got, er, data)
+		}
+	}
+	if _, er := readZbxd(strings.NewReader("HTTP/1.1 200 OK\r\n")); er == nil {
+		t.Error("invalid header should fail")
+	}
+}
+
+// TestHandleTrapper 只处理同步中的主机及匹配 --acceptKeys 的key, 响应中返回处理结果
+func TestHandleTrapper(t *testing.T) {
+	defer func(s Sinks, cs []*Cluster) { sinks, clusters = s, cs }(sinks, clusters)
+	store := NewMetricStore()
+	sinks = Sinks{NewSink("exporter", store, 0)}
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: "http://127.0.0.1", AccetpKeys: []string{"app.*"}})
+	if er != nil {
+		t.Fatal(er)
+	}
+	c.Hosts.SetNames(map[string]string{"web01": "10084"})
+	c.HostIdHost.Store("10084", "web01")
+	clusters = []*Cluster{c}
+
+	client, server := net.Pipe()
+	go handleTrapper(server)
+	body, _ := json.Marshal(trapperRequest{Request: "sender data", Data: []trapperValue{
+		{Host: "web01", Key: "app.requests", Value: "12", Clock: 1690892492},
+		{Host: "web01", Key: "system.uptime", Value: "100"},
+		{Host: "db01", Key: "app.requests", Value: "3"},
+	}})
+	if er := writeZbxd(client, body); er != nil {
+		t.Fatal(er)
+	}
+	data, er := readZbxd(client)
+	if er != nil {
+		t.Fatal(er)
+	}
+	_ = client.Close()
+	var resp trapperResponse
+	if er := json.Unmarshal(data, &resp); er != nil {
+		t.Fatal(er)
+	}
+	if resp.Response != "success" || !strings.HasPrefix(resp.Info, "processed: 1; failed: 2; total: 3;") {
+		t.Errorf("got response %+v", resp)
+	}
+	got := storeSeries(store, "0", "10084")
+	want := []string{`app_requests{c="0",__endpoint__="web01"} 12`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version zabbix server版本, 不同版本的api请求格式存在差异
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+func ParseVersion(s string) (Version, error) {
+	var v Version
+	parts := strings.SplitN(strings.TrimSpace(s), ".", 3)
+	if len(parts) < 2 {
+		return v, fmt.Errorf("invalid zabbix version:%s", s)
+	}
+	numbers := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, part := range parts {
+		// 如 7.0.0rc1, 只取开头的数字
+		if end := strings.IndexFunc(part, func(r rune) bool { return r < '0' || r > '9' }); end >= 0 {
+			part = part[:end]
+		}
+		n, er := strconv.Atoi(part)
+		if er != nil {
+			return v, fmt.Errorf("invalid zabbix version:%s", s)
+		}
+		*numbers[i] = n
+	}
+	return v, nil
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// AtLeast 版本不低于 major.minor
+func (v Version) AtLeast(major, minor int) bool {
+	return v.Major > major || (v.Major == major && v.Minor >= minor)
+}
+
+// LoginUserField user.login 的用户名参数, 5.4 改为 username, 6.4 移除了 user
+func (v Version) LoginUserField() string {
+	if v.AtLeast(5, 4) {
+		return "username"
+	}
+	return "user"
+}
+
+// BearerAuth 6.4 起支持 Authorization: Bearer, 7.2 移除了请求体中的 auth
+func (v Version) BearerAuth() bool {
+	return v.AtLeast(6, 4)
+}
+
+// HostGroupsField host.get 查询主机组的参数及返回字段, 6.2 起为 selectHostGroups/hostgroups
+func (v Version) HostGroupsField() (string, string) {
+	if v.AtLeast(6, 2) {
+		return "selectHostGroups", "hostgroups"
+	}
+	return "selectGroups", "groups"
+}
+
+// ItemTagsSupported 5.4 起采集项使用标签, 移除了应用集
+func (v Version) ItemTagsSupported() bool {
+	return v.AtLeast(5, 4)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want Version
+	}{
+		{"4.0.50", Version{4, 0, 50}},
+		{"6.0", Version{6, 0, 0}},
+		{" 7.0.0rc1\n", Version{7, 0, 0}},
+		{"5.4.0alpha1", Version{5, 4, 0}},
+	} {
+		if got, er := ParseVersion(tc.s); er != nil || got != tc.want {
+			t.Errorf("ParseVersion(%q) = %v %v, want %v", tc.s, got, er, tc.want)
+		}
+	}
+	for _, s := range []string{"", "6", "a.b", "six.0"} {
+		if _, er := ParseVersion(s); er == nil {
+			t.Errorf("ParseVersion(%q) should fail", s)
+		}
+	}
+}
+
+// TestLoginVersions user.login 的用户名参数及认证方式随版本变化, api token 不调用 user.login
+func TestLoginVersions(t *testing.T) {
+	for _, tc := range []struct {
+		version, token string
+		userField      string
+		bodyAuth       string
+		header         string
+	}{
+		{"5.0.30", "", "user", "session", ""},
+		{"6.0.20", "", "username", "session", ""},
+		{"6.4.0", "", "username", "", "Bearer session"},
+		{"7.0.0", "apitoken", "", "", "Bearer apitoken"},
+		{"5.4.0", "apitoken", "", "apitoken", ""},
+	} {
+		var login map[string]interface{}
+		var hostAuth interface{}
+		var header string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req struct {
+				Method string                 `json:"method"`
+				Params map[string]interface{} `json:"params"`
+				Auth   interface{}            `json:"auth"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			var result interface{} = []interface{}{}
+			switch req.Method {
+			case "apiinfo.version":
+				if req.Auth != nil || r.Header.Get("Authorization") != "" {
+					t.Errorf("%s: apiinfo.version should not carry auth", tc.version)
+				}
+				result = tc.version
+			case "user.login":
+				login = req.Params
+				result = "session"
+			case "host.get":
+				hostAuth, header = req.Auth, r.Header.Get("Authorization")
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "result": result, "id": 1})
+		}))
+		c, er := NewCluster(ClusterConfig{Cluster: "0", User: "Admin", Password: "zabbix", Token: tc.token, Address: server.URL, ApiVersion: "2.0"})
+		if er != nil {
+			t.Fatal(er)
+		}
+		api := c.Api
+		if er := api.Login(); er != nil {
+			t.Fatal(er)
+		}
+		if _, er := api.request(context.Background(), "host.get", map[string]interface{}{}); er != nil {
+			t.Fatal(er)
+		}
+		server.Close()
+		switch {
+		case tc.userField == "" && login != nil:
+			t.Errorf("%s: token auth should not call user.login", tc.version)
+		case tc.userField != "" && login[tc.userField] != "Admin":
+			t.Errorf("%s: got login params %v, want %s", tc.version, login, tc.userField)
+		}
+		if body, _ := hostAuth.(string); body != tc.bodyAuth || header != tc.header {
+			t.Errorf("%s: got auth %q header %q, want %q %q", tc.version, body, header, tc.bodyAuth, tc.header)
+		}
+	}
+}
@@ -4,16 +4,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"math"
 	"net/http"
 	"os"
 	"os/signal"
 	"regexp"
-	"strings"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -28,60 +29,117 @@ const (
 )
 
 func Init() {
-	KeyPattern = regexp.MustCompile(`^([0-9a-zA-Z_.]*)\\[(.*)\\]$`)
-	ReplMetricPattern = regexp.MustCompile(`([^a-zA-Z0-9:_]+?)`)
-	ReplParamsPattern = regexp.MustCompile(`([," =]+?)`)
 	//for _, v := range zabbixConfig.AccetpKeys{
 	//	if p, er := regexp.Compile(v); er == nil{
 	//		AcceptKeysPattern = append(AcceptKeysPattern, p)
 	//	}
 	//}
-	zabbixConfig.Cluster = ReplParamsPattern.ReplaceAllString(zabbixConfig.Cluster, "_")
-	address := zabbixConfig.Address
-	if !strings.HasSuffix(address, ApiSuffix) {
-		zabbixConfig.Address = fmt.Sprintf("%s/%s", strings.TrimSuffix(address, "/"), ApiSuffix)
+	if zabbixConfig.BuiltinKeyRules {
+		keyRules.Add(builtinKeyRules)
+	}
+	if zabbixConfig.KeyRules != "" {
+		rules, er := loadKeyRules(zabbixConfig.KeyRules)
+		if er != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "load key rules failed:%s\n", er)
+			os.Exit(1)
+		}
+		keyRules.Add(rules)
+	}
+	if zabbixConfig.MetricNames != "" {
+		mappings, er := loadMetricMappings(zabbixConfig.MetricNames)
+		if er == nil {
+			er = metricMappings.Add(mappings)
+		}
+		if er != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "load metric names failed:%s\n", er)
+			os.Exit(1)
+		}
+	}
+	if zabbixConfig.BuiltinMetricNames {
+		_ = metricMappings.Add(builtinMetricMappings)
+	}
+	if zabbixConfig.RelabelConfig != "" {
+		configs, er := loadRelabelConfigs(zabbixConfig.RelabelConfig)
+		if er != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "load relabel config failed:%s\n", er)
+			os.Exit(1)
+		}
+		relabelConfigs = configs
+	}
+	configs := []ClusterConfig{zabbixConfig.ClusterConfig}
+	if zabbixConfig.ConfigFile != "" {
+		var er error
+		if configs, zabbixConfig.Sinks, er = loadConfigFile(zabbixConfig.ConfigFile, zabbixConfig.ClusterConfig); er != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "load config failed:%s\n", er)
+			os.Exit(1)
+		}
+	}
+	for _, config := range configs {
+		c, er := NewCluster(config)
+		if er != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "load config failed:%s\n", er)
+			os.Exit(1)
+		}
+		clusters = append(clusters, c)
 	}
-	zApi = NewZabbixClient()
 	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 }
 
 type Host struct {
 	Locker sync.RWMutex
 	Ids    []string
+	// Names 主机名称 -> hostId, trapper 按主机名称查找
+	Names map[string]string
+	// Loaded 主机列表是否查询成功过, 没有匹配的主机时用来区分查询失败
+	Loaded bool
 }
 
 type Config struct {
-	Groups     map[string]struct{}
-	Cluster    string
-	Address    string
-	User       string
-	Password   string
-	ApiVersion string
-	AccetpKeys []string
-	Interval   int64
+	// ClusterConfig 命令行参数指定的集群配置, 同时作为 --config 中各集群的默认值
+	ClusterConfig
+	// ConfigFile 多集群配置文件
+	ConfigFile string
 	DataFormat string
+	Listen     string
+	// StatusListen 自身运行指标及健康检查地址
+	StatusListen  string
+	ReadyFailures int
+	// RemoteWrite prometheus remote_write 地址
+	RemoteWrite string
+	// Sinks --config 中的输出, 与命令行参数指定的输出同时写入
+	Sinks      []SinkConfig
+	SinkBuffer int
+	// LogEvents 日志类型item的事件输出
+	LogEvents string
+	// TrapperListen zabbix trapper 协议监听地址, TrapperAllow 允许连接的地址
+	TrapperListen string
+	TrapperAllow  []string
+	// KeyRules key参数映射规则文件
+	KeyRules        string
+	BuiltinKeyRules bool
+	// MetricNames metric名称映射文件
+	MetricNames        string
+	BuiltinMetricNames bool
+	// RelabelConfig relabel规则文件, CheckRules 为验证规则时的输入
+	RelabelConfig string
+	CheckRules    string
+	Influx        InfluxConfig
+	Backfill      BackfillConfig
 }
 
 var (
-	zabbixConfig = Config{Groups: map[string]struct{}{}}
-	zApi         *ZabbixApi
+	zabbixConfig = Config{}
 	signals      = make(chan os.Signal, 1)
-	// hostIdHost 通过item.get获取到hostId之后，需要查找对应的host
-	hostIdHost sync.Map
 	// globalHostIds 之所以使用map，是因为多个groupId可能包含相同的hostId
 	//globalHostIds sync.Map
-	hosts       = Host{Locker: sync.RWMutex{}}
-	groupNameId sync.Map
 
-	// KeyPattern key_中提取metric,params
-	KeyPattern *regexp.Regexp
 	// ReplMetricPattern metric名称转换
-	ReplMetricPattern *regexp.Regexp
-	// ReplParamsPattern 用来转换params,hostName
-	ReplParamsPattern *regexp.Regexp
+	ReplMetricPattern = regexp.MustCompile(`([^a-zA-Z0-9:_]+?)`)
+	// ReplParamsPattern 用来转换集群名称及主机名称(__endpoint__), 其他label值由各输出方式转义
+	ReplParamsPattern = regexp.MustCompile(`([," =]+?)`)
 	AcceptKeysPattern []*regexp.Regexp
 
-	ConnectError = fmt.Errorf("connectError")
+	noAuthMethods = map[string]struct{}{"apiinfo.version": {}, "user.login": {}}
 
 	// hostQueryBatch 批量查询host采集项时，控制一次性查询量,防止数据过多
 	hostQueryBatch int = 150
@@ -91,6 +149,7 @@ func (h *Host) Set(hostIds map[string]struct{}) {
 	tmp := make(map[string]struct{})
 	h.Locker.Lock()
 	defer h.Locker.Unlock()
+	h.Loaded = true
 	// delete expired hostId
 	for i := 0; i < len(h.Ids); i++ {
 		if _, ok := hostIds[h.Ids[i]]; !ok {
@@ -108,6 +167,20 @@ func (h *Host) Set(hostIds map[string]struct{}) {
 	}
 }
 
+func (h *Host) SetNames(names map[string]string) {
+	h.Locker.Lock()
+	h.Names = names
+	h.Locker.Unlock()
+}
+
+// Id 按主机名称查找同步中的主机
+func (h *Host) Id(name string) (string, bool) {
+	h.Locker.RLock()
+	defer h.Locker.RUnlock()
+	hostId, ok := h.Names[name]
+	return hostId, ok
+}
+
 // createHTTPClient for connection re-use
 func createHTTPClient() *http.Client {
 	client := &http.Client{
@@ -120,159 +193,187 @@ func createHTTPClient() *http.Client {
 }
 
 type ZabbixApi struct {
-	User       string
-	Password   string
+	// Cluster 请求结果保存到所属集群
+	Cluster  *Cluster
+	User     string
+	Password string
+	// Token 预先创建的api token, 配置后不再使用用户名密码登录(5.4+)
+	Token      string
 	Address    string
 	ApiVersion string
 	Auth       string
-	Client     *http.Client
+	// Version zabbix server版本, 登录前通过 apiinfo.version 获取
+	Version *Version
+	Client  *http.Client
+	Breaker Breaker
+	// Locker 保护 Auth, LoginLocker 避免并发重复登录
+	Locker      sync.RWMutex
+	LoginLocker sync.Mutex
 }
 
-func NewZabbixClient() *ZabbixApi {
+func NewZabbixClient(cluster *Cluster) *ZabbixApi {
 	c := createHTTPClient()
 	return &ZabbixApi{
-		User:       zabbixConfig.User,
-		Password:   zabbixConfig.Password,
-		Address:    zabbixConfig.Address,
-		ApiVersion: zabbixConfig.ApiVersion,
+		Cluster:    cluster,
+		User:       cluster.Config.User,
+		Password:   cluster.Config.Password,
+		Token:      cluster.Config.Token,
+		Address:    cluster.Config.Address,
+		ApiVersion: cluster.Config.ApiVersion,
 		Client:     c,
 	}
 }
 
-func (z *ZabbixApi) Login() error {
-	r, er := json.Marshal(map[string]interface{}{
-		"jsonrpc": z.ApiVersion,
-		"method":  "user.login",
-		"params": map[string]string{
-			"user":     z.User,
-			"password": z.Password,
-		},
-		"id": 1,
-	})
+// DetectVersion 获取zabbix版本, 用于适配不同版本的请求格式
+func (z *ZabbixApi) DetectVersion() error {
+	result, er := z.request(context.Background(), "apiinfo.version", []string{})
 	if er != nil {
 		return er
 	}
-	body := bytes.NewBuffer(r)
-	req, er := http.NewRequest("GET", z.Address, body)
+	v, er := ParseVersion(fmt.Sprint(result))
 	if er != nil {
 		return er
 	}
-	req.Header.Set("Content-Type", "application/json-rpc")
-	resp, er := z.Client.Do(req)
-	if er != nil {
-		return ConnectError
+	z.Version = &v
+	return nil
+}
+
+func (z *ZabbixApi) Login() (er error) {
+	defer func() {
+		status := statusOk
+		if er != nil {
+			status = statusError
+		}
+		selfMetrics.Add(metricLogins, metricTypeCounter, 1, "cluster", z.Cluster.Config.Cluster, "status", status)
+	}()
+	if z.Version == nil {
+		if er := z.DetectVersion(); er != nil {
+			return er
+		}
 	}
-	defer resp.Body.Close()
-	result, er := io.ReadAll(resp.Body)
-	if er != nil {
-		return er
+	if z.Token != "" {
+		z.setAuth(z.Token)
+		return nil
 	}
-	respData := make(map[string]interface{})
-	er = json.Unmarshal(result, &respData)
+	result, er := z.request(context.Background(), "user.login", map[string]string{
+		z.Version.LoginUserField(): z.User,
+		"password":                 z.Password,
+	})
 	if er != nil {
 		return er
 	}
-	if auth, ok := respData["result"]; ok {
-		z.Auth = auth.(string)
-	}
-	if z.Auth == "" {
+	auth, _ := result.(string)
+	if auth == "" {
 		return fmt.Errorf("获取认证秘钥为空")
 	}
+	z.setAuth(auth)
 	return nil
 }
 
+// relogin 多个worker同时发现session过期时只重新登录一次
+func (z *ZabbixApi) relogin(expired string) error {
+	z.LoginLocker.Lock()
+	defer z.LoginLocker.Unlock()
+	if z.auth() != expired {
+		return nil
+	}
+	return z.Login()
+}
+
+func (z *ZabbixApi) auth() string {
+	z.Locker.RLock()
+	defer z.Locker.RUnlock()
+	return z.Auth
+}
+
+func (z *ZabbixApi) setAuth(auth string) {
+	z.Locker.Lock()
+	z.Auth = auth
+	z.Locker.Unlock()
+}
+
 func (z *ZabbixApi) GroupIds() error {
-	r, _ := json.Marshal(map[string]interface{}{
-		"jsonrpc": z.ApiVersion,
-		"method":  "hostgroup.get",
-		"params": map[string]interface{}{
-			"output": []string{"name", "groupid"},
-		},
-		"auth": z.Auth,
-		"id":   1,
+	result, er := z.request(context.Background(), "hostgroup.get", map[string]interface{}{
+		"output": []string{"name", "groupid"},
 	})
-	body := bytes.NewBuffer(r)
-	req, er := http.NewRequest("GET", z.Address, body)
 	if er != nil {
 		return er
 	}
-	req.Header.Set("Content-Type", "application/json-rpc")
-	resp, er := z.Client.Do(req)
-	if er != nil {
-		return ConnectError
-	}
-	defer resp.Body.Close()
-	result, er := io.ReadAll(resp.Body)
-	if er != nil {
-		return er
-	}
-	respData := make(map[string]interface{})
-	er = json.Unmarshal(result, &respData)
-	if er != nil {
-		return er
-	}
-	if result, ok := respData["result"]; ok {
-		for _, v := range result.([]interface{}) {
-			groupNameId.Store(v.(map[string]interface{})["name"].(string),
+	if result, ok := result.([]interface{}); ok {
+		for _, v := range result {
+			z.Cluster.GroupNameId.Store(v.(map[string]interface{})["name"].(string),
 				v.(map[string]interface{})["groupid"].(string))
 		}
 	}
 	return nil
 }
 
-func (z *ZabbixApi) HostIds(groupIds []string) error {
-	r, er := json.Marshal(map[string]interface{}{
-		"jsonrpc": z.ApiVersion,
-		"method":  "host.get",
-		"params": map[string]interface{}{
-			"output": []string{"hostid", "host"},
-			//"output": "extend",
-			"groupids": groupIds,
-		},
-		"auth": z.Auth,
-		"id":   1,
-	})
-	if er != nil {
-		return er
-	}
-	body := bytes.NewBuffer(r)
-	req, er := http.NewRequest("GET", z.Address, body)
-	if er != nil {
-		return er
+// HostIds 查询组内的主机, 排除 exclude 中及不匹配主机过滤规则的主机
+func (z *ZabbixApi) HostIds(groupIds []string, exclude map[string]struct{}) error {
+	params := map[string]interface{}{
+		"output": []string{"hostid", "host"},
+		//"output": "extend",
+		"groupids": groupIds,
 	}
-	req.Header.Set("Content-Type", "application/json-rpc")
-	resp, er := z.Client.Do(req)
-	if er != nil {
+	if er := z.Cluster.HostFilter.HostParams(*z.Version, params); er != nil {
 		return er
 	}
-	defer resp.Body.Close()
-	result, er := ioutil.ReadAll(resp.Body)
-	if er != nil {
-		return er
+	z.Cluster.HostLabelConfig.HostParams(*z.Version, params)
+	if z.Cluster.Config.HostStatus {
+		hostStatusParams(*z.Version, params)
 	}
-	respData := make(map[string]interface{})
-	er = json.Unmarshal(result, &respData)
+	result, er := z.request(context.Background(), "host.get", params)
 	if er != nil {
 		return er
 	}
 	tmp := map[string]struct{}{}
-	if result, ok := respData["result"]; ok {
-		for _, v := range result.([]interface{}) {
+	names := map[string]string{}
+	excluded := 0
+	if result, ok := result.([]interface{}); ok {
+		for _, v := range result {
 			if hostId, ok := v.(map[string]interface{})["hostid"]; ok {
+				if _, ok := exclude[hostId.(string)]; ok || !z.Cluster.HostFilter.Match(v.(map[string]interface{})) {
+					excluded++
+					continue
+				}
 				tmp[hostId.(string)] = struct{}{}
 				if host, ok := v.(map[string]interface{})["host"]; ok {
-					if _, ok := hostIdHost.Load(host); !ok {
-						hostIdHost.Store(hostId, host)
-					}
+					z.Cluster.HostIdHost.Store(hostId, host)
+					names[fmt.Sprint(host)] = hostId.(string)
+				}
+				z.Cluster.HostIdLabels.Store(hostId,
+					z.Cluster.HostLabelConfig.HostLabels(*z.Version, v.(map[string]interface{})))
+				if z.Cluster.Config.HostStatus {
+					z.Cluster.outputHostStatus(*z.Version, v.(map[string]interface{}))
 				}
 			}
 		}
 	}
-	hosts.Set(tmp)
+	z.Cluster.Hosts.Set(tmp)
+	z.Cluster.Hosts.SetNames(names)
+	z.Cluster.logChange("hosts", fmt.Sprintf("%d matched, %d excluded", len(tmp), excluded))
 	return nil
 }
 
-func (z *ZabbixApi) SmartItems(hostIds []string) {
+// GroupHostIds 查询组内的全部主机id
+func (z *ZabbixApi) GroupHostIds(groupIds []string) (map[string]struct{}, error) {
+	result, er := z.request(context.Background(), "host.get", map[string]interface{}{
+		"output":   []string{"hostid"},
+		"groupids": groupIds,
+	})
+	if er != nil {
+		return nil, er
+	}
+	hostIds := map[string]struct{}{}
+	hosts, _ := result.([]interface{})
+	for _, v := range hosts {
+		hostIds[fmt.Sprint(v.(map[string]interface{})["hostid"])] = struct{}{}
+	}
+	return hostIds, nil
+}
+
+// SmartItems 按 hostQueryBatch 分批, 由 --concurrency 个worker并发查询, ctx 到期后不再查询剩余的批次
+func (z *ZabbixApi) SmartItems(ctx context.Context, hostIds []string) {
 	var hostIdsGroups [][]string
 	groupNumber := int(math.Ceil(float64(len(hostIds)) / float64(hostQueryBatch)))
 	for i := 0; i < groupNumber; i++ {
@@ -283,64 +384,268 @@ func (z *ZabbixApi) SmartItems(hostIds []string) {
 		}
 		hostIdsGroups = append(hostIdsGroups, hostIds[startIndex:endIndex])
 	}
-	for _, subHostIds := range hostIdsGroups {
-		er := z.Items(subHostIds)
-		if er != nil {
-			if er == ConnectError {
-				_ = z.Login()
+	batches := make(chan []string)
+	var failed int64
+	var wg sync.WaitGroup
+	for i := 0; i < z.Cluster.Config.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for subHostIds := range batches {
+				if er := z.Items(ctx, subHostIds); er != nil {
+					atomic.AddInt64(&failed, 1)
+					_, _ = fmt.Fprintf(os.Stderr, "cluster %s update items failed:%s\n", z.Cluster.Config.Cluster, er)
+				}
 			}
+		}()
+	}
+	skipped := 0
+	for i, subHostIds := range hostIdsGroups {
+		select {
+		case batches <- subHostIds:
+			continue
+		case <-ctx.Done():
+			skipped = len(hostIdsGroups) - i
 		}
+		break
+	}
+	close(batches)
+	wg.Wait()
+	if skipped > 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "cluster %s cycle exceeded %ds, skipped %d of %d batches\n",
+			z.Cluster.Config.Cluster, z.Cluster.Config.Interval, skipped, len(hostIdsGroups))
 	}
+	selfMetrics.Cycle(z.Cluster.Config.Cluster, int(failed)+skipped)
+	sinks.Flush(false)
+}
 
+// Items 查询主机的采集项. item.get 不支持 offset 及 itemid 范围条件, 每次多查询一条判断是否超过 --itemLimit:
+// 超过时丢弃该页, 将主机分成两半分别查询; 单台主机超过时先查询该主机的 itemid, 再按 itemid 分页
+func (z *ZabbixApi) Items(ctx context.Context, hostIds []string) error {
+	limit := z.Cluster.Config.ItemLimit
+	if limit > 0 && len(hostIds) == 1 {
+		return z.hostItems(ctx, hostIds[0], limit)
+	}
+	items, truncated, er := z.itemGet(ctx, map[string]interface{}{"hostids": hostIds}, limit)
+	if er != nil {
+		return er
+	}
+	if !truncated {
+		z.processItems(items)
+		return nil
+	}
+	middle := len(hostIds) / 2
+	if er := z.Items(ctx, hostIds[:middle]); er != nil {
+		return er
+	}
+	return z.Items(ctx, hostIds[middle:])
 }
 
-func (z *ZabbixApi) Items(hostIds []string) error {
-	r, er := json.Marshal(map[string]interface{}{
-		"jsonrpc": z.ApiVersion,
-		"method":  "item.get",
-		"params": map[string]interface{}{
-			//"output": []string{"hostid"},
-			"output":                 []string{"key_", "hostid", "lastvalue", "lastclock", "value_type"},
-			"hostids":                hostIds,
-			"search":                 map[string]interface{}{"key_": zabbixConfig.AccetpKeys},
-			"searchWildcardsEnabled": true,
-			"searchByAny":            true,
-		},
-		"auth": z.Auth,
-		"id":   1,
-	})
+// hostItems 单台主机的采集项, 超过 limit 时只查询 itemid, 再按 itemid 分页查询
+func (z *ZabbixApi) hostItems(ctx context.Context, hostId string, limit int) error {
+	items, truncated, er := z.itemGet(ctx, map[string]interface{}{"hostids": []string{hostId}}, limit)
 	if er != nil {
 		return er
 	}
-	body := bytes.NewBuffer(r)
-	req, er := http.NewRequest("GET", z.Address, body)
+	if !truncated {
+		z.processItems(items)
+		return nil
+	}
+	result, er := z.request(ctx, "item.get", z.itemParams(map[string]interface{}{
+		"output":    []string{"itemid"},
+		"hostids":   []string{hostId},
+		"sortfield": "itemid",
+	}))
 	if er != nil {
 		return er
 	}
+	rows, _ := result.([]interface{})
+	itemIds := make([]string, 0, len(rows))
+	for _, v := range rows {
+		itemIds = append(itemIds, fmt.Sprint(v.(map[string]interface{})["itemid"]))
+	}
+	for start := 0; start < len(itemIds); start += limit {
+		if er := ctx.Err(); er != nil {
+			return er
+		}
+		end := start + limit
+		if end > len(itemIds) {
+			end = len(itemIds)
+		}
+		items, _, er := z.itemGet(ctx, map[string]interface{}{"itemids": itemIds[start:end]}, 0)
+		if er != nil {
+			return er
+		}
+		z.processItems(items)
+	}
+	return nil
+}
+
+// itemParams 加上 --acceptKeys 过滤条件
+func (z *ZabbixApi) itemParams(params map[string]interface{}) map[string]interface{} {
+	params["search"] = map[string]interface{}{"key_": z.Cluster.Config.AccetpKeys}
+	params["searchWildcardsEnabled"] = true
+	params["searchByAny"] = true
+	return params
+}
+
+// itemGet 查询采集项的最新值, 按 itemid 排序. limit 大于0时查询 limit+1 条,
+// 超过 limit 时返回 truncated, 不再查询原型及值映射
+func (z *ZabbixApi) itemGet(ctx context.Context, filter map[string]interface{}, limit int) ([]interface{}, bool, error) {
+	params := z.itemParams(map[string]interface{}{
+		"output":    []string{"itemid", "key_", "hostid", "lastvalue", "lastclock", "value_type"},
+		"sortfield": "itemid",
+	})
+	for k, v := range filter {
+		params[k] = v
+	}
+	if limit > 0 {
+		params["limit"] = limit + 1
+	}
+	z.Cluster.ItemLabelConfig.ItemParams(*z.Version, params)
+	z.Cluster.lldParams(params)
+	z.Cluster.metadataParams(*z.Version, params)
+	result, er := z.request(ctx, "item.get", params)
+	if er != nil {
+		return nil, false, er
+	}
+	items, _ := result.([]interface{})
+	if limit > 0 && len(items) > limit {
+		return nil, true, nil
+	}
+	z.loadPrototypes(ctx, items)
+	z.loadValueMaps(ctx, items)
+	return items, false, nil
+}
+
+func (z *ZabbixApi) processItems(items []interface{}) {
+	for _, v := range items {
+		item := v.(map[string]interface{})
+		// lastclock 未更新说明zabbix没有采集到新数据, 不重复输出
+		if !z.Cluster.changed(item) {
+			continue
+		}
+		er := z.Cluster.processMetric(item, false)
+		if er != nil {
+			_, _ = fmt.Fprintln(os.Stderr, er.Error())
+		}
+		valueType := fmt.Sprint(item["value_type"])
+		if er != nil || !z.Cluster.exported(item) {
+			selfMetrics.Add(metricItemsDropped, metricTypeCounter, 1,
+				"cluster", z.Cluster.Config.Cluster, "value_type", valueType)
+		} else {
+			selfMetrics.Add(metricItemsProcessed, metricTypeCounter, 1,
+				"cluster", z.Cluster.Config.Cluster, "value_type", valueType)
+		}
+	}
+}
+
+// request 通用的api请求, 返回result字段.
+// session过期时重新登录后重试一次, 网络错误时按指数退避重试, 连续失败后熔断一段时间.
+// ctx 到期(超过同步周期)或退出时中断请求, 不再重试
+func (z *ZabbixApi) request(ctx context.Context, method string, params interface{}) (interface{}, error) {
+	if er := z.Breaker.Allow(); er != nil {
+		return nil, er
+	}
+	backoff := apiRetryBackoff
+	relogin := false
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		auth := z.auth()
+		result, er := z.doRequest(ctx, method, params, auth)
+		selfMetrics.ApiRequest(z.Cluster.Config.Cluster, method, start, er)
+		if er == nil {
+			z.Breaker.Success()
+			return result, nil
+		}
+		// 没有权限时重新登录及重试无效, 也不计入熔断
+		if permissionDenied(er) {
+			_, _ = fmt.Fprintf(os.Stderr, "cluster %s %s, permission denied: %s\n",
+				z.Cluster.Config.Cluster, er, requestObjects(params))
+			return nil, er
+		}
+		if _, ok := noAuthMethods[method]; !ok && !relogin && authFailed(er) {
+			relogin = true
+			_, _ = fmt.Fprintf(os.Stderr, "cluster %s %s, login again\n", z.Cluster.Config.Cluster, er)
+			if er := z.relogin(auth); er != nil {
+				return nil, er
+			}
+			continue
+		}
+		// 超过同步周期或退出时的错误不计入熔断
+		if !errors.Is(er, ConnectError) || ctx.Err() != nil {
+			return nil, er
+		}
+		if z.Breaker.Failure() {
+			selfMetrics.Add(metricBreakerOpens, metricTypeCounter, 1, "cluster", z.Cluster.Config.Cluster)
+			return nil, er
+		}
+		if attempt >= apiRetries {
+			return nil, er
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, er
+		}
+		backoff *= 2
+	}
+}
+
+func (z *ZabbixApi) doRequest(ctx context.Context, method string, params interface{}, auth string) (interface{}, error) {
+	data := map[string]interface{}{
+		"jsonrpc": z.ApiVersion,
+		"method":  method,
+		"params":  params,
+		"id":      1,
+	}
+	// apiinfo.version, user.login 不允许携带认证信息, 6.4+ 通过 Authorization 头认证
+	bearer := false
+	if _, ok := noAuthMethods[method]; !ok && auth != "" {
+		if z.Version != nil && z.Version.BearerAuth() {
+			bearer = true
+		} else {
+			data["auth"] = auth
+		}
+	}
+	r, er := json.Marshal(data)
+	if er != nil {
+		return nil, er
+	}
+	req, er := http.NewRequestWithContext(ctx, "POST", z.Address, bytes.NewBuffer(r))
+	if er != nil {
+		return nil, er
+	}
 	req.Header.Set("Content-Type", "application/json-rpc")
+	if bearer {
+		req.Header.Set("Authorization", "Bearer "+auth)
+	}
 	resp, er := z.Client.Do(req)
 	if er != nil {
-		return ConnectError
+		return nil, &TransportError{Method: method, Err: er}
 	}
 	defer resp.Body.Close()
 	result, er := io.ReadAll(resp.Body)
 	if er != nil {
-		return er
+		return nil, &TransportError{Method: method, Err: er}
+	}
+	// php-fpm 或 web服务异常
+	if resp.StatusCode >= 500 {
+		return nil, &TransportError{Method: method, Err: fmt.Errorf("http status %d", resp.StatusCode)}
+	}
+	var respData struct {
+		Result interface{} `json:"result"`
+		Error  *ApiError   `json:"error"`
 	}
-	respData := make(map[string]interface{})
 	er = json.Unmarshal(result, &respData)
 	if er != nil {
-		return er
+		return nil, er
 	}
-	if result, ok := respData["result"]; ok {
-		for _, v := range result.([]interface{}) {
-			er := processMetric(v.(map[string]interface{}))
-			if er != nil {
-				_, _ = fmt.Fprintln(os.Stderr, er.Error())
-			}
-		}
+	if respData.Error != nil {
+		respData.Error.Method = method
+		return nil, respData.Error
 	}
-	return nil
+	return respData.Result, nil
 }
 
 //func isAcceptedKey(key string) bool {
@@ -352,91 +657,122 @@ func (z *ZabbixApi) Items(hostIds []string) error {
 //	return false
 //}
 
-func processMetric(item map[string]interface{}) error {
-	dataStr := ""
-	// only numeric/float values can convert to prometheus
-	//dataStr := "%s,c=%s,__endpoint__=%s,params=%s {val}=%s %s000000000"
-	if item["value_type"] == "0" || item["value_type"].(string) == "3" {
-		if _, ok := item["key_"]; !ok {
-			return fmt.Errorf("no key_")
-		}
-		// step 1: metric
-		//if !isAcceptedKey(item["key_"].(string)){
-		//	return nil
-		//}
-		res := KeyPattern.FindStringSubmatch(item["key_"].(string))
-		if len(res) > 1 {
-			dataStr = ReplMetricPattern.ReplaceAllString(res[1], "_")
-		} else {
-			dataStr = ReplMetricPattern.ReplaceAllString(item["key_"].(string), "_")
-		}
-		// step 2 tags: zabbix cluster
-		dataStr = fmt.Sprintf("%s,c=%s", dataStr, zabbixConfig.Cluster)
-		// step3 tags: hostName
-		if hostName, ok := hostIdHost.Load(item["hostid"].(string)); ok {
-			dataStr = fmt.Sprintf("%s,__endpoint__=%s",
-				dataStr, ReplParamsPattern.ReplaceAllString(hostName.(string), "_"))
-		}
-		// step 4 tags: params
-		if len(res) >= 2 && res[0] != "" {
-			dataStr = fmt.Sprintf("%s,p=%s", dataStr, ReplParamsPattern.ReplaceAllString(res[2], "\\$1"))
-		}
-		// step5 处理值
-		if _, ok := item["lastvalue"]; !ok {
-			return nil
-		}
-		dataStr = fmt.Sprintf("%s %s=%v", dataStr, defaultKey, item["lastvalue"])
-		// step5 处理时间
-		if _, ok := item["lastclock"]; ok && len(item["lastclock"].(string)) == 10 {
-			dataStr = fmt.Sprintf(" %s %v000000000", dataStr, item["lastclock"])
-		} else {
-			return nil
-		}
+// processMetric 转换一个item后输出. wait 为true时缓存已满等待(实时导出), 否则丢弃
+func (c *Cluster) processMetric(item map[string]interface{}, wait bool) error {
+	switch {
+	case infoItem(item):
+		return c.processInfo(item, wait)
+	case item["value_type"] == valueTypeLog:
+		return c.processLog(item, wait)
+	case !numericItem(item):
+		return nil
+	}
+	mapping := metricMappings.Match(fmt.Sprint(item["key_"]))
+	sample, ok, er := c.itemSample(item, mapping)
+	if !ok || er != nil {
+		return er
+	}
+	// step6 处理值, trends数据输出 _min/_avg/_max 三个序列
+	fields := []struct{ suffix, field string }{{"", "lastvalue"}}
+	if _, ok := item["value_avg"]; ok {
+		fields = []struct{ suffix, field string }{{"_min", "value_min"}, {"_avg", "value_avg"}, {"_max", "value_max"}}
+	} else if _, ok := item["lastvalue"]; !ok {
+		return nil
 	}
-	if dataStr != "" {
-		if zabbixConfig.DataFormat == "prometheus" {
-			s := convertInfluxToPrometheus(dataStr)
-			for _, v := range s {
-				fmt.Println(v)
+	// 值映射只用于最新值, trends 的平均值等没有对应的映射. 同名的label被映射结果覆盖
+	labeled := len(fields) == 1 && c.Config.ValueMapLabels
+	if state := c.mappedValue(item, fmt.Sprint(item["lastvalue"])); labeled && state != "" {
+		labels := make([]Label, 0, len(sample.Labels)+1)
+		for _, l := range sample.Labels {
+			if l.Name != valueMapLabel {
+				labels = append(labels, l)
 			}
-		} else {
-			fmt.Println(dataStr)
 		}
+		sample.Labels = append(labels, Label{Name: valueMapLabel, Value: state})
 	}
-	return nil
+	scale := mapping.scale() * c.applyMetadata(item, &sample, len(fields) > 1, mapping != nil)
+	samples := make([]Sample, 0, len(fields))
+	for _, f := range fields {
+		s := sample
+		s.Name += f.suffix
+		if s.Value, er = parseValue(fmt.Sprint(item[f.field])); er != nil {
+			return fmt.Errorf("invalid value %v of %s", item[f.field], item["key_"])
+		}
+		s.Value *= scale
+		samples = append(samples, s)
+	}
+	if labeled {
+		return c.emitLabeled(item, samples[0], wait)
+	}
+	return c.output(item["hostid"].(string), wait, samples)
 }
 
-func convertInfluxToPrometheus(influxData string) []string {
-	var data []string
-	splitData := strings.Split(influxData, " ")
-	measurementTagSet := strings.Split(splitData[0], ",")
-	measurement := measurementTagSet[0]
-	tagSet := measurementTagSet[1:]
-
-	fieldSet := strings.Split(splitData[1], ",")
-	var timestamp string
-	if len(splitData) == 3 {
-		timestamp = splitData[2]
+// itemSample 由 key_ 或匹配的 --metricNames 映射生成metric名称及label, 时间戳为 lastclock, 没有 lastclock 时返回 false
+func (c *Cluster) itemSample(item map[string]interface{}, mapping *MetricMapping) (Sample, bool, error) {
+	if _, ok := item["key_"]; !ok {
+		return Sample{}, false, fmt.Errorf("no key_")
+	}
+	// step 1: metric
+	var name string
+	key, er := ParseKey(item["key_"].(string))
+	switch {
+	case mapping != nil:
+		name = mapping.Name
+	case er == nil:
+		name = ReplMetricPattern.ReplaceAllString(key.Name, "_")
+	default:
+		name = ReplMetricPattern.ReplaceAllString(item["key_"].(string), "_")
+	}
+	// step 2, 3: zabbix cluster, hostName, host tags, groups, inventory, ip 以及 item tags, applications
+	labels := c.ItemLabelConfig.ItemLabels(item)
+	// step 4 tags: params, 配置了规则的key按位置输出为对应的label, 否则整体输出为p
+	var paramLabels []Label
+	mapped := false
+	// 映射中配置的参数名称优先于自动发现的宏
+	switch {
+	case key != nil && mapping != nil && mapping.Params != nil:
+		paramLabels, mapped = KeyRule{Key: mapping.Key, Params: mapping.Params}.paramLabels(key, true, nil)
+	case key != nil:
+		paramLabels, mapped = keyRules.ParamLabels(key, c.lldNames(item))
+	}
+	labels = mergeLabels(labels, paramLabels)
+	if key != nil && !mapped && key.RawParams != "" {
+		labels = mergeLabels(labels, []Label{{Name: "p", Value: key.RawParams}})
 	}
+	if mapping != nil {
+		labels = mergeLabels(labels, mapping.labels)
+	}
+	sample := c.hostSample(name, item["hostid"].(string), labels)
+	// step5 处理时间
+	clock, _ := item["lastclock"].(string)
+	if len(clock) != 10 {
+		return sample, false, nil
+	}
+	ts, er := strconv.ParseInt(clock, 10, 64)
+	if er != nil {
+		return sample, false, fmt.Errorf("invalid lastclock %s of %s", clock, item["key_"])
+	}
+	sample.Timestamp = ts * 1e3
+	return sample, true, nil
+}
 
-	labelSet := make([]string, len(tagSet))
-	var t []string
-	for i, tag := range tagSet {
-		t = strings.SplitN(tag, "=", 2)
-		if len(t) == 2 {
-			labelSet[i] = fmt.Sprintf("%s=\"%s\"", t[0], t[1])
-		}
+// emit 执行relabel后输出, 缓存已满时丢弃, 不阻塞同步
+func (c *Cluster) emit(hostId string, samples ...Sample) error {
+	return c.output(hostId, false, samples)
+}
+
+// output 执行relabel后输出. 实时导出的数据丢弃后无法重新读取, wait 为true时缓存已满等待
+func (c *Cluster) output(hostId string, wait bool, samples []Sample) error {
+	if relabelConfigs != nil {
+		samples = relabelSamples(samples)
 	}
-	for _, val := range fieldSet {
-		t = strings.SplitN(val, "=", 2)
-		if len(t) == 2 {
-			if t[0] != defaultKey {
-				measurement = fmt.Sprintf(`%s_%s`, measurement, t[0])
-			}
-			data = append(data, fmt.Sprintf(`%s{%s} %s %s`, measurement, strings.Join(labelSet, ","), t[1], timestamp))
-		}
+	if len(samples) == 0 {
+		return nil
 	}
-	return data
+	if wait {
+		return sinks.WriteWait(c.Config.Cluster, hostId, samples)
+	}
+	return sinks.Write(c.Config.Cluster, hostId, samples)
 }
 
 func configParse() {
@@ -449,8 +785,39 @@ func configParse() {
 如写http://127.0.0.1:8080`, ApiSuffix))
 	pflag.StringVarP(&zabbixConfig.User, "user", "u", "Admin", "允许通过api访问数据的用户名, 推荐使用环境变量")
 	pflag.StringVarP(&zabbixConfig.Password, "password", "p", "zabbix", "允许通过api访问数据的用户对应的密码,推荐使用环境变量")
-	groups := pflag.StringSliceP("groups", "g",
-		[]string{"Linux servers", "Zabbix servers", "Virtual machines"}, "需要同步的group分组")
+	pflag.StringSliceVarP(&zabbixConfig.Groups, "groups", "g",
+		[]string{"Linux servers", "Zabbix servers", "Virtual machines"},
+		"需要同步的group分组, 支持通配符(*, ?)及正则(re:<正则>), 如 'Linux servers/*' 匹配所有子分组")
+	pflag.StringSliceVar(&zabbixConfig.ExcludeGroups, "excludeGroups", nil,
+		"排除的group分组, 格式同 --groups, 属于这些分组的主机都不同步")
+	pflag.StringSliceVar(&zabbixConfig.Hosts, "hosts", nil, "只同步主机名(host)匹配的主机, 支持通配符及正则(re:<正则>)")
+	pflag.StringSliceVar(&zabbixConfig.ExcludeHosts, "excludeHosts", nil, "排除主机名(host)匹配的主机, 格式同 --hosts")
+	pflag.StringSliceVar(&zabbixConfig.Templates, "templates", nil,
+		"只同步链接了这些模板的主机, 支持通配符及正则(re:<正则>), 如 'Linux by Zabbix agent*'")
+	pflag.StringSliceVar(&zabbixConfig.HostTags, "hostTags", nil,
+		"按主机标签过滤(4.2+), 全部满足时同步: <标签> 存在该标签, <标签>=<值> 值匹配, <标签>!=<值> 值不匹配, 值支持通配符及正则. 例如 'env=prod,team'")
+	pflag.StringVar(&zabbixConfig.ConfigFile, "config", "",
+		"配置文件(yaml): clusters 为多集群配置, 每个集群可单独配置地址、认证、分组、key、同步间隔及集群名称, 未配置的项使用命令行参数的值; sinks 为同时写入的多个输出")
+	pflag.StringVarP(&zabbixConfig.Token, "token", "t", "",
+		"zabbix 5.4+ 预先创建的api token, 配置后不再使用用户名密码登录, 推荐使用环境变量")
+	pflag.StringSliceVar(&zabbixConfig.HostLabels, "hostLabels", []string{},
+		"作为label输出的主机信息, 支持 tag:<标签名>, tag:*, groups, inventory:<资产字段>, ip. 例如 'tag:env,groups,inventory:os,ip'")
+	pflag.StringVar(&zabbixConfig.HostLabelPrefix, "hostLabelPrefix", "", "主机信息label名称的前缀, 如 'zbx_'")
+	pflag.StringSliceVar(&zabbixConfig.ItemLabels, "itemLabels", []string{},
+		"作为label输出的采集项信息, 5.4+ 支持 tag:<标签名>, tag:*, 之前的版本支持 application. 与内置label同名的标签将加上 tag_ 前缀")
+	pflag.StringVar(&zabbixConfig.ItemLabelPrefix, "itemLabelPrefix", "", "采集项信息label名称的前缀")
+	pflag.StringVar(&zabbixConfig.KeyRules, "keyRules", "",
+		"key参数映射规则文件(yaml), 将key_的位置参数输出为指定名称的label, 未配置规则的key仍输出为p")
+	pflag.BoolVar(&zabbixConfig.BuiltinKeyRules, "builtinKeyRules", false,
+		"使用内置的zabbix agent常用key参数映射规则, 如 net.if.in[eth0,bytes] 输出 interface=\"eth0\",mode=\"bytes\", 开启后这些key不再输出 p")
+	pflag.StringVar(&zabbixConfig.MetricNames, "metricNames", "",
+		"metric名称映射文件(yaml), 按完整的key_(通配符或 re:<正则>)指定metric名称, 固定label及值的换算系数, 优先于按key_自动生成的名称")
+	pflag.BoolVar(&zabbixConfig.BuiltinMetricNames, "builtinMetricNames", false,
+		"使用内置的 node_exporter 兼容名称映射, 如 vm.memory.size[available] 输出 node_memory_MemAvailable_bytes, 在 --metricNames 之后匹配")
+	pflag.StringVar(&zabbixConfig.RelabelConfig, "relabelConfig", "",
+		"relabel规则文件(yaml), 格式与prometheus的relabel_configs一致, 支持 replace, keep, drop, labelmap, labeldrop, labelkeep, hashmod")
+	pflag.StringVar(&zabbixConfig.CheckRules, "checkRules", "",
+		"验证relabel规则: 从该文件('-'为标准输入)读取influxdb或prometheus格式的数据, 输出relabel后的结果后退出")
 	pflag.StringVarP(&zabbixConfig.ApiVersion, "apiVersion", "v", "2.0", "api版本")
 	//pflag.StringSliceVarP(&zabbixConfig.AccetpKeys, "acceptKeys", "k",
 	//	[]string{"system\\..*"}, "需要同步的Key,正则匹配")
@@ -458,20 +825,88 @@ func configParse() {
 		[]string{"system.*"}, "需要同步的Key,通配符匹配(*). 例如:如需要同步'system.'开头的key_,则配置'system.*'")
 	pflag.Int64VarP(&zabbixConfig.Interval, "interval", "i", int64(60),
 		"同步时间间隔,单位秒. 防止对zabbix服务器造成太大压力,系统允许的最小时间间隔为30秒")
+	pflag.BoolVar(&zabbixConfig.Problems, "problems", false,
+		"同步主机未恢复的问题, 每个问题输出 ALERTS{alertname,severity,acknowledged,...} 1, 恢复后删除(exporter)或输出0")
+	pflag.IntVar(&zabbixConfig.Concurrency, "concurrency", 4,
+		"每个集群并发查询item.get的数量, 每次查询150台主机的采集项")
+	pflag.IntVar(&zabbixConfig.ItemLimit, "itemLimit", 10000,
+		"单次item.get返回的最大采集项数, 超过时拆分主机批次或按itemid分页查询, 避免超出zabbix php的内存限制. 0为不限制")
+	pflag.BoolVar(&zabbixConfig.LldLabels, "lldLabels", false,
+		"自动发现的item按原型key_中的宏输出参数label, 如原型 vfs.fs.size[{#FSNAME},pused] 输出 fsname=\"/\", 优先于 --keyRules")
+	pflag.StringSliceVar(&zabbixConfig.InfoKeys, "infoKeys", nil,
+		"字符及文本类型的item中需要输出的key, 支持通配符及正则(re:<正则>), 输出为 <metric>_info{value=\"<值>\"} 1, 同样需要匹配 --acceptKeys")
+	pflag.IntVar(&zabbixConfig.InfoMaxLength, "infoMaxLength", 256, "_info 序列 value label 的最大字符数, 超过时截断. 0为不限制")
+	pflag.BoolVar(&zabbixConfig.Metadata, "metadata", false,
+		"按item的名称, 单位, 描述及预处理步骤输出 # HELP, # TYPE: 单位转换为基本单位并加上后缀(B→_bytes, s/ms→_seconds, %→_ratio), "+
+			"计数器(无每秒变化预处理的 net.if.in 等及 --counterKeys)加上 _total 后缀")
+	pflag.StringSliceVar(&zabbixConfig.CounterKeys, "counterKeys", nil,
+		"开启 --metadata 时作为counter输出的key, 支持通配符及正则(re:<正则>), 匹配key名称或完整的key_")
+	pflag.BoolVar(&zabbixConfig.ValueMapLabels, "valueMapLabels", false,
+		"配置了值映射的item输出映射结果 state=\"<映射值>\" label, 只支持精确匹配的映射")
+	pflag.BoolVar(&zabbixConfig.RawHostNames, "rawHostNames", false,
+		"__endpoint__ 使用原始的主机名称, 默认将其中的逗号, 双引号, 空格及等号替换为 _. 开启后含这些字符的主机将产生新的序列")
+	pflag.StringVar(&zabbixConfig.LogEvents, "logEvents", "",
+		"日志类型item的事件输出, 每条日志一行JSON: '-' 为标准输出, http(s)地址为批量POST, 否则为追加写入的文件. 未配置时不处理日志类型")
+	pflag.StringVar(&zabbixConfig.TrapperListen, "trapperListen", "",
+		"zabbix trapper 协议(ZBXD)监听地址, 如 :10051. 接收 zabbix_sender 及 agent 主动模式推送的数据, 按主机名称匹配同步中的主机后转换输出")
+	pflag.StringSliceVar(&zabbixConfig.TrapperAllow, "trapperAllow", []string{"127.0.0.1", "::1"},
+		"允许连接 --trapperListen 的发送端地址, 支持ip及CIDR, 与agent的 Server 参数一致. 例如 '10.0.0.0/8,192.168.1.10'")
+	pflag.BoolVar(&zabbixConfig.TrapperOnly, "trapperOnly", false,
+		"只通过 --trapperListen 接收数据, 不再按 --interval 查询 item.get. 主机列表及问题仍然定期同步")
+	pflag.StringVar(&zabbixConfig.ExportDir, "exportDir", "",
+		"zabbix server 实时导出(ExportDir)的目录, 读取 history-history-syncer-*.ndjson 中的历史数据代替查询 item.get, 需要与zabbix server在同一台机器")
+	pflag.StringVar(&zabbixConfig.ExportCheckpoint, "exportCheckpoint", "export.checkpoint",
+		"实时导出文件的读取位置, 重启后从该位置继续. 多个集群时加上 .<cluster> 后缀")
+	pflag.BoolVar(&zabbixConfig.HostStatus, "hostStatus", false,
+		"输出主机状态: zabbix_host_available{type=\"agent|snmp|ipmi|jmx\",error=\"...\"}(0 未知, 1 可用, 2 不可用), "+
+			"zabbix_host_maintenance 及 zabbix_host_monitored, 随主机列表每5分钟更新")
+	pflag.IntVar(&zabbixConfig.StaleIntervals, "staleIntervals", 0,
+		"item的lastclock连续该数量的同步周期未更新时, 输出 zabbix_item_stale{key=\"<key_>\"} 1, 恢复后输出0. 0为不输出")
 	pflag.StringVarP(&zabbixConfig.DataFormat, "dataFormat", "f", "influxdb",
-		"data format that you want to convert to, you can choose 'prometheus' or 'influxdb', default is influxdb")
+		"data format that you want to convert to, you can choose 'prometheus', 'openmetrics' or 'influxdb', default is influxdb")
+	pflag.StringVarP(&zabbixConfig.Listen, "listen", "l", "",
+		"开启exporter模式, 在该地址(如 :9109)的 /metrics 接口以prometheus格式输出最新数据, 不再输出到标准输出")
+	pflag.StringVar(&zabbixConfig.StatusListen, "statusListen", "",
+		"在该地址输出自身运行指标(/metrics)及 /healthz, /readyz. exporter模式下自身指标同时在 --listen 的 /metrics 输出")
+	pflag.IntVar(&zabbixConfig.ReadyFailures, "readyFailures", 3, "连续该数量的同步周期失败时 /readyz 返回503, 最小为1")
+	pflag.IntVar(&zabbixConfig.SinkBuffer, "sinkBuffer", defaultSinkBuffer,
+		"每个输出缓存的最大行数, 输出写入慢或失败时超过该数量的数据被丢弃, 不影响其他输出及同步")
+	pflag.StringVar(&zabbixConfig.RemoteWrite, "remoteWrite", "",
+		"prometheus remote_write 地址, 如 http://127.0.0.1:8428/api/v1/write, 每个同步周期的数据批量推送, 不再输出到标准输出")
+	pflag.StringVar(&zabbixConfig.Influx.Url, "influxUrl", "",
+		"influxdb 地址, 如 http://127.0.0.1:8086, 数据以line protocol批量写入, 不再输出到标准输出")
+	pflag.StringVar(&zabbixConfig.Influx.Database, "influxDb", "zabbix", "influxdb v1 数据库")
+	pflag.StringVar(&zabbixConfig.Influx.RetentionPolicy, "influxRp", "", "influxdb v1 retention policy")
+	pflag.StringVar(&zabbixConfig.Influx.User, "influxUser", "", "influxdb v1 用户名")
+	pflag.StringVar(&zabbixConfig.Influx.Password, "influxPassword", "", "influxdb v1 密码, 推荐使用环境变量")
+	pflag.StringVar(&zabbixConfig.Influx.Org, "influxOrg", "", "influxdb v2 org")
+	pflag.StringVar(&zabbixConfig.Influx.Bucket, "influxBucket", "", "influxdb v2 bucket, 配置后使用 /api/v2/write 写入")
+	pflag.StringVar(&zabbixConfig.Influx.Token, "influxToken", "", "influxdb v2 token, 推荐使用环境变量")
+	pflag.IntVar(&zabbixConfig.Influx.BatchSize, "influxBatchSize", 5000, "influxdb 单次写入的最大行数")
+	pflag.Int64Var(&zabbixConfig.Influx.FlushInterval, "influxFlushInterval", 10, "influxdb 写入间隔,单位秒")
+	pflag.StringVar(&zabbixConfig.Backfill.From, "from", "",
+		"backfill模式的开始时间, 支持unix时间戳, '2006-01-02 15:04:05', '2006-01-02' 及RFC3339")
+	pflag.StringVar(&zabbixConfig.Backfill.To, "to", "", "backfill模式的结束时间(不包含), 格式同 --from")
+	pflag.StringVar(&zabbixConfig.Backfill.TrendsBefore, "trendsBefore", "",
+		"backfill模式下, 早于该时间的数据使用trends.get查询, 输出min/avg/max, 格式同 --from")
+	pflag.Int64Var(&zabbixConfig.Backfill.Window, "window", 3600, "backfill模式每次查询的时间窗口,单位秒")
+	pflag.IntVar(&zabbixConfig.Backfill.ItemBatch, "itemBatch", 100, "backfill模式每次查询的itemid数量")
+	pflag.StringVar(&zabbixConfig.Backfill.Checkpoint, "checkpoint", "backfill.checkpoint",
+		"backfill模式的进度文件, 中断后重新执行相同的 --from/--to 将从该进度继续")
 	pflag.Parse()
-	if zabbixConfig.Address == "" {
+	if zabbixConfig.Address == "" && zabbixConfig.ConfigFile == "" && zabbixConfig.CheckRules == "" {
 		_, _ = fmt.Fprintln(os.Stderr, "address 不能为空,我们推荐防止带宽占用，将节点选择在与zabbix api 服务在同一台机器上")
 		os.Exit(0)
 	}
-	if len(*groups) > 0 {
-		for _, group := range *groups {
-			zabbixConfig.Groups[group] = struct{}{}
-		}
+	if zabbixConfig.Backfill.Window <= 0 {
+		zabbixConfig.Backfill.Window = 3600
 	}
-	if zabbixConfig.Interval < 30 {
-		zabbixConfig.Interval = 30
+	if zabbixConfig.Backfill.ItemBatch <= 0 {
+		zabbixConfig.Backfill.ItemBatch = 100
+	}
+	// 小于1时 /readyz 始终返回503
+	if zabbixConfig.ReadyFailures < 1 {
+		zabbixConfig.ReadyFailures = 1
 	}
 	if s := os.Getenv("password"); s != "" {
 		zabbixConfig.Password = s
@@ -479,72 +914,201 @@ func configParse() {
 	if s := os.Getenv("user"); s != "" {
 		zabbixConfig.User = s
 	}
+	if s := os.Getenv("token"); s != "" {
+		zabbixConfig.Token = s
+	}
+	if s := os.Getenv("influxPassword"); s != "" {
+		zabbixConfig.Influx.Password = s
+	}
+	if s := os.Getenv("influxToken"); s != "" {
+		zabbixConfig.Influx.Token = s
+	}
 }
 
-func updateGroupAndHost() {
-	er := zApi.GroupIds()
-	if er != nil {
-		//_, _ = fmt.Fprintln(os.Stderr, fmt.Sprintf("update groups failed:%s", er))
-		_, _ = fmt.Fprintf(os.Stderr, "update groups failed:%s\n", er)
-		// login again
-		er := zApi.Login()
-		if er != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "login failed:%s\n", er)
+func (c *Cluster) updateGroupAndHost() {
+	// 启动时登录失败的集群在这里重试
+	if c.Api.auth() == "" {
+		if er := c.Api.Login(); er != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "cluster %s login failed:%s\n", c.Config.Cluster, er)
+			return
 		}
 	}
-	groupIds := []string{}
-	for groupName := range zabbixConfig.Groups {
-		if groupId, ok := groupNameId.Load(groupName); ok {
-			groupIds = append(groupIds, groupId.(string))
-		}
+	er := c.Api.GroupIds()
+	if er != nil {
+		//_, _ = fmt.Fprintln(os.Stderr, fmt.Sprintf("update groups failed:%s", er))
+		_, _ = fmt.Fprintf(os.Stderr, "cluster %s update groups failed:%s\n", c.Config.Cluster, er)
 	}
+	groupIds, excludeGroupIds := c.resolveGroups()
 	if len(groupIds) == 0 {
+		// 没有匹配的分组时没有需要同步的主机, 分组查询失败时保留之前的主机
+		if er == nil {
+			c.Hosts.Set(map[string]struct{}{})
+			c.Hosts.SetNames(map[string]string{})
+			c.logChange("hosts", "0 matched, 0 excluded")
+			c.retainHosts()
+		}
 		return
 	}
-	er = zApi.HostIds(groupIds)
-	if er != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "update hostid failed:%s\n", er)
-		// login again
-		er := zApi.Login()
-		if er != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "login failed:%s\n", er)
+	// 同时属于排除的组的主机也排除
+	var exclude map[string]struct{}
+	if len(excludeGroupIds) > 0 {
+		if exclude, er = c.Api.GroupHostIds(excludeGroupIds); er != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "cluster %s update excluded hosts failed:%s\n", c.Config.Cluster, er)
+			return
 		}
 	}
+	er = c.Api.HostIds(groupIds, exclude)
+	if er != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "cluster %s update hostid failed:%s\n", c.Config.Cluster, er)
+		return
+	}
+	c.retainHosts()
 }
 
-func GetItems() {
-	if len(hosts.Ids) == 0 {
+// retainHosts 删除已不再同步的主机的数据及item状态
+func (c *Cluster) retainHosts() {
+	c.Hosts.Locker.RLock()
+	selfMetrics.Set(metricHostsTracked, float64(len(c.Hosts.Ids)), "cluster", c.Config.Cluster)
+	sinks.Retain(c.Config.Cluster, c.Hosts.Ids)
+	c.retainItemStates(c.Hosts.Ids)
+	c.Hosts.Locker.RUnlock()
+}
+
+// GetItems 同步一个周期的数据, 超过同步间隔时放弃剩余的批次, 避免与下一个周期重叠
+func (c *Cluster) GetItems(ctx context.Context) {
+	c.Hosts.Locker.RLock()
+	hostIds := append([]string{}, c.Hosts.Ids...)
+	loaded := c.Hosts.Loaded
+	c.Hosts.Locker.RUnlock()
+	// 没有匹配的主机时周期完成, /readyz 不会一直503; 主机列表查询失败(如登录失败)时不记录
+	if len(hostIds) == 0 {
+		if loaded {
+			selfMetrics.Cycle(c.Config.Cluster, 0)
+		}
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(c.Config.Interval))
+	defer cancel()
+	// 问题与数据一起在 SmartItems 结束时推送
+	if c.Config.Problems {
+		if er := c.Api.Problems(ctx, hostIds); er != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "cluster %s update problems failed:%s\n", c.Config.Cluster, er)
+		}
+	}
+	// 只通过 trapper 或实时导出文件接收数据时不查询 item.get
+	if c.Config.TrapperOnly || c.Config.ExportDir != "" {
+		selfMetrics.Cycle(c.Config.Cluster, 0)
+		sinks.Flush(false)
 		return
 	}
-	zApi.SmartItems(hosts.Ids)
+	c.Api.SmartItems(ctx, hostIds)
 }
 
-func Loop(ctx context.Context) {
-	updateGroupAndHost()
-	GetItems()
+func (c *Cluster) Loop(ctx context.Context) {
+	c.updateGroupAndHost()
+	var tail sync.WaitGroup
+	if c.Config.ExportDir != "" {
+		tail.Add(1)
+		go func() {
+			defer tail.Done()
+			c.tailExport(ctx)
+		}()
+	}
+	c.GetItems(ctx)
 	ticker := time.NewTicker(time.Minute * 5)
-	itemTicker := time.NewTicker(time.Second * time.Duration(zabbixConfig.Interval))
+	itemTicker := time.NewTicker(time.Second * time.Duration(c.Config.Interval))
 	for {
 		select {
 		case <-ticker.C:
-			updateGroupAndHost()
+			c.updateGroupAndHost()
 		case <-itemTicker.C:
-			GetItems()
-		case <-signals:
-			return
+			c.GetItems(ctx)
 		case <-ctx.Done():
+			tail.Wait()
 			return
 		}
 	}
 }
 
 func main() {
+	// backfill 子命令: zabbix backfill --from ... --to ...
+	backfill := len(os.Args) > 1 && os.Args[1] == "backfill"
+	if backfill {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
 	configParse()
 	Init()
-	er := zApi.Login()
-	if er != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "login failed:%s\n", er)
+	if zabbixConfig.CheckRules != "" {
+		if er := runCheckRules(zabbixConfig.CheckRules); er != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "check rules failed:%s\n", er)
+			os.Exit(1)
+		}
+		return
+	}
+	// 登录失败的集群在 updateGroupAndHost 中重试, 全部失败时退出
+	loggedIn := 0
+	for _, c := range clusters {
+		if er := c.Api.Login(); er != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "cluster %s login failed:%s\n", c.Config.Cluster, er)
+			continue
+		}
+		loggedIn++
+	}
+	if loggedIn == 0 {
+		os.Exit(1)
+	}
+	configs := sinkConfigs(zabbixConfig.Sinks)
+	listens := map[string]struct{}{}
+	for _, c := range configs {
+		if c.Type != "exporter" {
+			continue
+		}
+		if backfill {
+			_, _ = fmt.Fprintln(os.Stderr, "backfill 不支持 --listen 及 exporter 输出")
+			os.Exit(1)
+		}
+		listens[c.Listen] = struct{}{}
+	}
+	var er error
+	if sinks, er = createSinks(configs); er != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "create sinks failed:%s\n", er)
 		os.Exit(1)
 	}
-	Loop(context.Background())
+	if _, ok := listens[zabbixConfig.StatusListen]; !ok && zabbixConfig.StatusListen != "" {
+		serveStatus(zabbixConfig.StatusListen)
+	}
+	if backfill {
+		for _, c := range clusters {
+			checkpoint := zabbixConfig.Backfill.Checkpoint
+			if len(clusters) > 1 {
+				checkpoint = fmt.Sprintf("%s.%s", checkpoint, c.Config.Cluster)
+			}
+			if er := c.Backfill(checkpoint); er != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "cluster %s backfill failed:%s\n", c.Config.Cluster, er)
+				os.Exit(1)
+			}
+		}
+		return
+	}
+	if zabbixConfig.TrapperListen != "" {
+		if er := serveTrapper(zabbixConfig.TrapperListen, zabbixConfig.TrapperAllow); er != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "trapper listen %s failed:%s\n", zabbixConfig.TrapperListen, er)
+			os.Exit(1)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-signals
+		cancel()
+	}()
+	var wg sync.WaitGroup
+	for _, c := range clusters {
+		wg.Add(1)
+		go func(c *Cluster) {
+			defer wg.Done()
+			c.Loop(ctx)
+		}(c)
+	}
+	wg.Wait()
+	sinks.Flush(true)
 }
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestRequestContext 请求超过 ctx 的期限时中断, 不再重试, 也不计入熔断
+func TestRequestContext(t *testing.T) {
+	var attempts int64
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&attempts, 1)
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: server.URL})
+	if er != nil {
+		t.Fatal(er)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, er := c.Api.request(ctx, "host.get", map[string]interface{}{}); er == nil {
+		t.Fatal("request should fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request returned after %s", elapsed)
+	}
+	if n := atomic.LoadInt64(&attempts); n != 1 {
+		t.Errorf("got %d attempts, want 1", n)
+	}
+	if c.Api.Breaker.Failures != 0 {
+		t.Errorf("got %d breaker failures, want 0", c.Api.Breaker.Failures)
+	}
+}
+
+// itemServer 按 hostids/itemids 及 limit 返回采集项, 记录每次 item.get 的参数
+type itemServer struct {
+	locker   sync.Mutex
+	items    []map[string]interface{}
+	requests []map[string]interface{}
+}
+
+func (s *itemServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Method string                 `json:"method"`
+		Params map[string]interface{} `json:"params"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&req)
+	var result interface{} = []interface{}{}
+	switch req.Method {
+	case "apiinfo.version":
+		result = "6.0.0"
+	case "user.login":
+		result = "session"
+	case "item.get":
+		s.locker.Lock()
+		s.requests = append(s.requests, req.Params)
+		s.locker.Unlock()
+		match := func(field string, item map[string]interface{}) bool {
+			ids, ok := req.Params[field].([]interface{})
+			if !ok {
+				return true
+			}
+			for _, id := range ids {
+				if id == item[strings.TrimSuffix(field, "s")] {
+					return true
+				}
+			}
+			return false
+		}
+		var items []interface{}
+		for _, item := range s.items {
+			if match("hostids", item) && match("itemids", item) {
+				items = append(items, item)
+			}
+		}
+		if limit, ok := req.Params["limit"].(float64); ok && len(items) > int(limit) {
+			items = items[:int(limit)]
+		}
+		result = items
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "result": result, "id": 1})
+}
+
+// TestItemsLimit 超过 --itemLimit 时拆分主机, 单台主机按 itemid 分页, 每个采集项只查询及输出一次
+func TestItemsLimit(t *testing.T) {
+	counts := map[string]int{"10001": 1, "10002": 5, "10003": 2, "10004": 1}
+	backend := &itemServer{}
+	itemId := 23000
+	for _, hostId := range []string{"10001", "10002", "10003", "10004"} {
+		for i := 0; i < counts[hostId]; i++ {
+			itemId++
+			backend.items = append(backend.items, map[string]interface{}{
+				"itemid": fmt.Sprint(itemId), "key_": fmt.Sprintf("custom.item[%d]", i), "hostid": hostId,
+				"value_type": "3", "lastvalue": "1", "lastclock": "1690892492",
+			})
+		}
+	}
+	server := httptest.NewServer(backend)
+	defer server.Close()
+	defer func(s Sinks) { sinks = s }(sinks)
+	records := &recordWriter{}
+	sinks = Sinks{NewSink("record", records, 0)}
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: server.URL, ItemLimit: 2})
+	if er != nil {
+		t.Fatal(er)
+	}
+	if er := c.Api.Login(); er != nil {
+		t.Fatal(er)
+	}
+	hostIds := []string{"10001", "10002", "10003", "10004"}
+	for _, hostId := range hostIds {
+		c.HostIdHost.Store(hostId, "host"+hostId)
+	}
+	if er := c.Api.Items(context.Background(), hostIds); er != nil {
+		t.Fatal(er)
+	}
+	if er := sinks.Flush(true); er != nil {
+		t.Fatal(er)
+	}
+	var got []string
+	for _, s := range records.samples {
+		got = append(got, s.Series())
+	}
+	sort.Strings(got)
+	if len(got) != len(backend.items) {
+		t.Errorf("got %d samples, want %d: %v", len(got), len(backend.items), got)
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i] == got[i-1] {
+			t.Errorf("duplicate sample %s", got[i])
+		}
+	}
+	for _, params := range backend.requests {
+		_, hasLimit := params["limit"]
+		itemIds, _ := params["itemids"].([]interface{})
+		hostIds, _ := params["hostids"].([]interface{})
+		switch {
+		case hasLimit:
+			if params["limit"] != float64(3) {
+				t.Errorf("got limit %v, want 3", params["limit"])
+			}
+		case itemIds != nil:
+			if len(itemIds) > 2 {
+				t.Errorf("got %d itemids in one page, want at most 2", len(itemIds))
+			}
+		case len(hostIds) == 1 && hostIds[0] == "10002":
+			if output, _ := params["output"].([]interface{}); len(output) != 1 || output[0] != "itemid" {
+				t.Errorf("unbounded item.get should only query itemid, got output %v", params["output"])
+			}
+		default:
+			t.Errorf("unexpected unbounded item.get %v", params)
+		}
+	}
+}
+
+// TestRequestPermissionDenied 没有权限时不重试, 不重新登录, 也不计入熔断
+func TestRequestPermissionDenied(t *testing.T) {
+	calls := map[string]int{}
+	var locker sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string `json:"method"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		locker.Lock()
+		calls[req.Method]++
+		locker.Unlock()
+		if req.Method == "user.login" {
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "result": "session", "id": 1})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "error": map[string]interface{}{
+			"code": -32500, "message": "Application error.", "data": "No permissions to referred object or it does not exist!",
+		}})
+	}))
+	defer server.Close()
+	c, er := NewCluster(ClusterConfig{Cluster: "0", Address: server.URL})
+	if er != nil {
+		t.Fatal(er)
+	}
+	c.Api.setAuth("session")
+	_, er = c.Api.request(context.Background(), "history.get", map[string]interface{}{"itemids": []string{"23000"}})
+	if !permissionDenied(er) {
+		t.Fatalf("got %v, want permission denied", er)
+	}
+	if calls["history.get"] != 1 || calls["user.login"] != 0 {
+		t.Errorf("got %v, want a single history.get without login", calls)
+	}
+	if c.Api.Breaker.Failures != 0 {
+		t.Errorf("got %d breaker failures, want 0", c.Api.Breaker.Failures)
+	}
+	if got := requestObjects(map[string]interface{}{"hostids": []string{"10084"}, "itemids": []string{"23000"}}); got != "hostids=[10084] itemids=[23000]" {
+		t.Errorf("got %q", got)
+	}
+}
+
+// TestRequestSessionExpired session过期时重新登录一次后重试原请求; 重新登录后仍然失败时不再循环
+func TestRequestSessionExpired(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		login   bool
+		renewed bool
+		history int
+		logins  int
+	}{
+		{"relogin", true, true, 2, 1},
+		{"relogin failed", false, false, 1, 1},
+		{"still expired", true, false, 2, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := map[string]int{}
+			var locker sync.Mutex
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req struct {
+					Method string `json:"method"`
+					Auth   string `json:"auth"`
+				}
+				_ = json.NewDecoder(r.Body).Decode(&req)
+				locker.Lock()
+				calls[req.Method]++
+				locker.Unlock()
+				resp := map[string]interface{}{"jsonrpc": "2.0", "id": 1}
+				switch {
+				case req.Method == "user.login" && !tc.login:
+					resp["error"] = map[string]interface{}{"code": -32500, "message": "Application error.", "data": "Incorrect user name or password or account is temporarily blocked."}
+				case req.Method == "user.login":
+					resp["result"] = "renewed"
+				case req.Auth != "renewed" || !tc.renewed:
+					resp["error"] = map[string]interface{}{"code": -32602, "message": "Invalid params.", "data": "Session terminated, re-login, please."}
+				default:
+					resp["result"] = []interface{}{}
+				}
+				_ = json.NewEncoder(w).Encode(resp)
+			}))
+			defer server.Close()
+			c, er := NewCluster(ClusterConfig{Cluster: "0", Address: server.URL})
+			if er != nil {
+				t.Fatal(er)
+			}
+			v, _ := ParseVersion("6.0.0")
+			c.Api.Version = &v
+			c.Api.setAuth("expired")
+			_, er = c.Api.request(context.Background(), "history.get", map[string]interface{}{"itemids": []string{"23000"}})
+			if (er == nil) != tc.renewed {
+				t.Errorf("got error %v", er)
+			}
+			if calls["history.get"] != tc.history || calls["user.login"] != tc.logins {
+				t.Errorf("got %v, want %d history.get and %d user.login", calls, tc.history, tc.logins)
+			}
+		})
+	}
+}
+
+// TestBreaker 连续失败达到阈值后熔断, 再次失败时冷却时间翻倍, 成功后重置
+func TestBreaker(t *testing.T) {
+	var b Breaker
+	for i := 1; i < breakerThreshold; i++ {
+		if b.Failure() || b.Allow() != nil {
+			t.Fatalf("breaker opened after %d failures", i)
+		}
+	}
+	if !b.Failure() {
+		t.Fatal("breaker should open after the threshold")
+	}
+	var open *CircuitOpenError
+	if er := b.Allow(); !errors.As(er, &open) || !open.Until.Equal(b.Until) {
+		t.Errorf("got %v, want circuit open error", er)
+	}
+	for _, want := range []time.Duration{2 * breakerCooldown, 4 * breakerCooldown, 8 * breakerCooldown, breakerMaxCooldown, breakerMaxCooldown} {
+		b.Until = time.Time{}
+		if !b.Failure() || b.Cooldown != want {
+			t.Errorf("got cooldown %s, want %s", b.Cooldown, want)
+		}
+	}
+	b.Success()
+	if er := b.Allow(); er != nil || b.Failures != 0 || b.Cooldown != 0 {
+		t.Errorf("got %v %d %s after success, want reset", er, b.Failures, b.Cooldown)
+	}
+	if b.Failure() {
+		t.Error("breaker should not open after a single failure")
+	}
+}